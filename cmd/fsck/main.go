@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"godb/fsck"
+	"godb/logs"
+	s "godb/storage"
+
+	_ "modernc.org/sqlite"
+)
+
+const usage = `Usage: fsck [-storage <uri>] [-repair]
+
+Looks for the inconsistencies left by crashes in a storage and its indexes,
+and repairs them with -repair. Only file storages, cached or not, can be
+checked. The storage shouldn't be in use meanwhile. Exits with 1 when there
+are problems left.
+
+`
+
+func main() {
+	storageURI := flag.String("storage", "file:_data", "uri of the storage to check, see storage.Open")
+	repair := flag.Bool("repair", false, "repair the problems found")
+	asJson := flag.Bool("json", false, "print the problems as json")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	logs.Initialize()
+
+	storage, err := s.Open(*storageURI)
+	if err != nil {
+		logs.Error(err, "fsck.storage")
+		os.Exit(1)
+	}
+
+	problems, err := fsck.Run(context.Background(), storage, *repair)
+	if *asJson {
+		json.NewEncoder(os.Stdout).Encode(problems)
+	} else {
+		for _, problem := range problems {
+			location := problem.Path
+			if location == "" {
+				location = problem.Id
+			}
+			status := "to " + problem.Repair
+			if problem.Repaired {
+				status = "repaired: " + problem.Repair
+			}
+			fmt.Printf("%s %s: %s (%s)\n", problem.Kind, location, problem.Detail, status)
+		}
+	}
+	if err != nil {
+		logs.Error(err, "fsck")
+		os.Exit(1)
+	}
+
+	for _, problem := range problems {
+		if !problem.Repaired {
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"godb/logs"
+	"godb/migrate"
+	s "godb/storage"
+
+	_ "modernc.org/sqlite"
+)
+
+const usage = `Usage: migrate -from <uri> -to <uri> [options]
+
+Copies the documents of a storage into another one. Storages are given as
+uris, like "file:_data", "sqlite:///var/godb.db" or "s3://bucket/prefix",
+see storage.Open.
+
+`
+
+func main() {
+	from := flag.String("from", "file:_data", "uri of the storage to copy the documents from")
+	to := flag.String("to", "", "uri of the storage to copy the documents to")
+	folder := flag.String("folder", "", "copy only this folder")
+	checkpoint := flag.String("checkpoint", "_migration.json", "file to resume an interrupted migration from, empty to disable it")
+	batch := flag.Int("batch", 100, "documents committed together")
+	rebuildIndexes := flag.Bool("rebuild-indexes", false, "recompute the indexes in the destination instead of copying them")
+	verify := flag.Bool("verify", true, "compare the counts and checksums of both storages at the end")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	logs.Initialize()
+	if *to == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	source, err := s.Open(*from)
+	if err != nil {
+		logs.Error(err, "migrate.from")
+		os.Exit(1)
+	}
+	destination, err := s.Open(*to)
+	if err != nil {
+		logs.Error(err, "migrate.to")
+		os.Exit(1)
+	}
+
+	// an interrupted migration keeps its checkpoint, to be resumed later
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report, err := migrate.Migrate(ctx, source, destination, migrate.Options{
+		Folder:         *folder,
+		RebuildIndexes: *rebuildIndexes,
+		BatchSize:      *batch,
+		Checkpoint:     *checkpoint,
+		Verify:         *verify,
+		Source:         *from,
+		Destination:    *to,
+	})
+	if report.Resumed {
+		logs.Info("Resumed from %s", *checkpoint)
+	}
+	if err != nil {
+		logs.Error(err, "migrate")
+		os.Exit(1)
+	}
+
+	logs.Info("Copied %d documents from %s to %s, deleted %d missing in the source", report.Copied, *from, *to, report.Deleted)
+	if report.Verified {
+		logs.Info("Verified %d documents, checksum %s", report.Target.Count, report.Target.Checksum)
+	}
+}
@@ -23,3 +23,62 @@ func Test_Folder(t *testing.T) {
 		}
 	}
 }
+
+func Test_EscapeSegment(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{in: "matrix", out: "matrix"},
+		{in: "", out: "%"},
+		{in: "..", out: "%2E."},
+		{in: ".hidden", out: "%2Ehidden"},
+		{in: "a/b\\c", out: "a%2Fb%5Cc"},
+		{in: "100%", out: "100%25"},
+		{in: "nul\x00", out: "nul%00"},
+		{in: "bad\xff", out: "bad%FF"},
+		{in: "ñandú 🐦", out: "ñandú 🐦"},
+	}
+
+	for _, test := range tests {
+		out := EscapeSegment(test.in)
+		if out != test.out {
+			t.Errorf("Expected '%s' to be escaped as '%s' but got '%s'", test.in, test.out, out)
+		}
+		in, err := UnescapeSegment(out)
+		if err != nil || in != test.in {
+			t.Errorf("Expected '%s' to be unescaped as '%s' but got '%s' (%v)", out, test.in, in, err)
+		}
+	}
+
+	for _, escaped := range []string{"%2", "%zz", "a%"} {
+		_, err := UnescapeSegment(escaped)
+		if err != ErrInvalidId {
+			t.Errorf("Expected '%s' to be invalid but got %v", escaped, err)
+		}
+	}
+}
+
+func Test_ValidateId(t *testing.T) {
+	for _, id := range []string{"movies/matrix", "/movies/matrix/", "movies/_indexes/by_name/a%2Fb", "películas/ñ"} {
+		if err := ValidateId(id); err != nil {
+			t.Errorf("Expected '%s' to be valid but got %v", id, err)
+		}
+	}
+	for _, id := range []string{"", "/", "movies//matrix", "movies/../etc", "./movies", "movies/\x00", "bad\xff"} {
+		if err := ValidateId(id); err != ErrInvalidId {
+			t.Errorf("Expected '%s' to be invalid but got %v", id, err)
+		}
+	}
+}
+
+func Test_GetRev(t *testing.T) {
+	for _, rev := range []any{3, int8(3), int64(3), uint64(3), float64(3)} {
+		if got := NewDocument("movies/matrix", "_rev", rev).GetRev(); got != 3 {
+			t.Errorf("Expected rev %v (%T) to be read as 3 but got %d", rev, rev, got)
+		}
+	}
+	if got := NewDocument("movies/matrix").GetRev(); got != 0 {
+		t.Errorf("Expected a missing rev to be read as 0 but got %d", got)
+	}
+}
@@ -48,3 +48,76 @@ func (document Document) Patch(other Document) {
 		document[key] = value
 	}
 }
+
+// Clone copies the document along with its nested maps and slices, keeping
+// the types of the values, unlike DeepClone.
+func (document Document) Clone() Document {
+	if document == nil {
+		return nil
+	}
+
+	return cloneValue(document).(Document)
+}
+
+func cloneValue(value any) any {
+	switch value := value.(type) {
+	case Document:
+		clone := make(Document, len(value))
+		for key, element := range value {
+			clone[key] = cloneValue(element)
+		}
+		return clone
+	case map[string]any:
+		clone := make(map[string]any, len(value))
+		for key, element := range value {
+			clone[key] = cloneValue(element)
+		}
+		return clone
+	case []any:
+		clone := make([]any, len(value))
+		for i, element := range value {
+			clone[i] = cloneValue(element)
+		}
+		return clone
+	}
+
+	return value
+}
+
+func (document Document) GetRev() int {
+	rev, _ := Int(document["_rev"])
+
+	return rev
+}
+
+// Int reads the number as an int, whichever type the codec decoded it to.
+func Int(value any) (int, bool) {
+	switch value := value.(type) {
+	case int:
+		return value, true
+	case int8:
+		return int(value), true
+	case int16:
+		return int(value), true
+	case int32:
+		return int(value), true
+	case int64:
+		return int(value), true
+	case uint:
+		return int(value), true
+	case uint8:
+		return int(value), true
+	case uint16:
+		return int(value), true
+	case uint32:
+		return int(value), true
+	case uint64:
+		return int(value), true
+	case float32:
+		return int(value), true
+	case float64:
+		return int(value), true
+	}
+
+	return 0, false
+}
@@ -5,8 +5,10 @@ import (
 )
 
 var (
-	ErrDocumentAlreadyExists = errors.New("document already exists")
-	ErrDocumentDoestNotExist = errors.New("document does not exist")
-	ErrEmptyDocument         = errors.New("empty document")
-	ErrInvalidId             = errors.New("invalid id")
+	ErrAttachmentDoesNotExist = errors.New("attachment does not exist")
+	ErrDocumentAlreadyExists  = errors.New("document already exists")
+	ErrDocumentDoestNotExist  = errors.New("document does not exist")
+	ErrEmptyDocument          = errors.New("empty document")
+	ErrInvalidId              = errors.New("invalid id")
+	ErrRevisionConflict       = errors.New("revision conflict")
 )
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const hexDigits = "0123456789ABCDEF"
+
+// MaxIdLength bounds the ids, whose segments can be of any length.
+const MaxIdLength = 4096
+
+// EscapeSegment makes any string usable as a single segment of an id, and as
+// a file name. '%', '/', '\', the control characters, the invalid UTF-8 bytes
+// and a leading '.' are percent-encoded, and the empty string becomes "%".
+// The rest, including any other Unicode, is kept as is.
+func EscapeSegment(segment string) string {
+	if segment == "" {
+		return "%"
+	}
+
+	var builder strings.Builder
+	for i := 0; i < len(segment); {
+		r, size := utf8.DecodeRuneInString(segment[i:])
+		escape := r == '%' || r == '/' || r == '\\' || r < 0x20 || r == 0x7f ||
+			(r == utf8.RuneError && size == 1) || (i == 0 && r == '.')
+		if !escape {
+			builder.WriteString(segment[i : i+size])
+			i += size
+			continue
+		}
+		for j := i; j < i+size; j++ {
+			builder.WriteByte('%')
+			builder.WriteByte(hexDigits[segment[j]>>4])
+			builder.WriteByte(hexDigits[segment[j]&0xf])
+		}
+		i += size
+	}
+
+	return builder.String()
+}
+
+// UnescapeSegment reverses EscapeSegment, failing with ErrInvalidId on
+// malformed escapes.
+func UnescapeSegment(escaped string) (string, error) {
+	if escaped == "%" {
+		return "", nil
+	}
+	if !strings.Contains(escaped, "%") {
+		return escaped, nil
+	}
+
+	var builder strings.Builder
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] != '%' {
+			builder.WriteByte(escaped[i])
+			continue
+		}
+		if i+2 >= len(escaped) {
+			return "", ErrInvalidId
+		}
+		high := strings.IndexByte(hexDigits, upper(escaped[i+1]))
+		low := strings.IndexByte(hexDigits, upper(escaped[i+2]))
+		if high < 0 || low < 0 {
+			return "", ErrInvalidId
+		}
+		builder.WriteByte(byte(high<<4 | low))
+		i += 2
+	}
+
+	return builder.String(), nil
+}
+
+// ValidateId fails with ErrInvalidId for the ids that would be ambiguous as
+// paths: empty segments, "." and "..", control characters and invalid
+// UTF-8. The leading and trailing slashes are ignored. Keys coming from user
+// data can be made valid with EscapeSegment.
+func ValidateId(id string) error {
+	id = strings.Trim(id, "/")
+	if id == "" || len(id) > MaxIdLength || !utf8.ValidString(id) {
+		return ErrInvalidId
+	}
+
+	for _, segment := range strings.Split(id, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return ErrInvalidId
+		}
+		for _, r := range segment {
+			if r < 0x20 || r == 0x7f {
+				return ErrInvalidId
+			}
+		}
+	}
+
+	return nil
+}
+
+func upper(b byte) byte {
+	if b >= 'a' && b <= 'f' {
+		return b - 'a' + 'A'
+	}
+
+	return b
+}
@@ -0,0 +1,77 @@
+package fsck
+
+import (
+	"context"
+	"strings"
+
+	c "godb/common"
+	"godb/index"
+	s "godb/storage"
+)
+
+// Run looks for the inconsistencies of the storage, failing with
+// s.ErrNotCheckable when it isn't a CheckableStorage, and then of the indexes
+// of every folder. With repair they are repaired, rebuilding the
+// inconsistent indexes.
+//
+// The indexes are only checked once the storage is consistent, as reading
+// from it repairs some problems silently, like completing a pending commit.
+func Run(ctx context.Context, storage s.Storage, repair bool) ([]s.Problem, error) {
+	problems, err := s.Check(storage, repair)
+	if err != nil {
+		return nil, err
+	}
+	if !repair && len(problems) > 0 {
+		return problems, nil
+	}
+
+	folders, err := indexedFolders(ctx, storage, "")
+	if err != nil {
+		return problems, err
+	}
+	for _, folder := range folders {
+		index_problems, err := index.Check(ctx, storage, folder)
+		if err != nil {
+			return problems, err
+		}
+		if repair && len(index_problems) > 0 {
+			err = index.Rebuild(ctx, storage, folder)
+			if err != nil {
+				return problems, err
+			}
+			for i := range index_problems {
+				index_problems[i].Repaired = true
+			}
+		}
+		problems = append(problems, index_problems...)
+	}
+
+	return problems, nil
+}
+
+// indexedFolders returns the folders, inside folder, that have indexes.
+func indexedFolders(ctx context.Context, storage s.Storage, folder string) ([]string, error) {
+	simple_ids, err := s.ListContext(ctx, storage, folder)
+	if err != nil {
+		return nil, err
+	}
+
+	folders := []string{}
+	for _, simple_id := range simple_ids {
+		if !strings.HasSuffix(simple_id, "/") {
+			continue
+		}
+		if simple_id == "_indexes/" {
+			folders = append(folders, folder)
+			continue
+		}
+
+		subfolders, err := indexedFolders(ctx, storage, c.J(folder, simple_id))
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, subfolders...)
+	}
+
+	return folders, nil
+}
@@ -0,0 +1,116 @@
+package fsck
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	c "godb/common"
+	"godb/godb"
+	"godb/index"
+	s "godb/storage"
+)
+
+func Test_RunRepairsStorageAndIndexes(t *testing.T) {
+	root := t.TempDir()
+	storage := &s.FileStorage{Root: root}
+	db := godb.NewGodb(storage)
+
+	_, err := db.Set(c.NewDocument("movies/_indexes/by_name", "func", "(doc) => ([doc.name, {year: doc.year}])"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	for _, document := range []c.Document{
+		c.NewDocument("movies/matrix", "name", "Matrix", "year", 1999),
+		c.NewDocument("movies/alien", "name", "Alien", "year", 1979),
+	} {
+		_, err = db.Set(document)
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+
+	// an index entry lost, another one outdated and one left behind
+	err = storage.Delete("movies/_indexes/by_name/Alien")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	_, err = storage.Set(c.NewDocument("movies/_indexes/by_name/Matrix", "year", 2000))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	_, err = storage.Set(c.NewDocument("movies/_indexes/by_name/Superman", "year", 1978))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	err = os.WriteFile(filepath.Join(root, "movies", "broken.json"), []byte("{"), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	problems, err := Run(context.Background(), storage, false)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(problems) != 1 || problems[0].Kind != s.ProblemCorrupted {
+		t.Fatalf("expected only the corrupted document until it's repaired but got %+v", problems)
+	}
+
+	problems, err = Run(context.Background(), storage, true)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	kinds := map[string]s.ProblemKind{}
+	for _, problem := range problems {
+		if !problem.Repaired {
+			t.Fatalf("expected the problem to be repaired but got %+v", problem)
+		}
+		kinds[problem.Id] = problem.Kind
+	}
+	expected_kinds := map[string]s.ProblemKind{
+		"movies/broken":                    s.ProblemCorrupted,
+		"movies/_indexes/by_name/Alien":    index.ProblemMissingEntry,
+		"movies/_indexes/by_name/Matrix":   index.ProblemStaleEntry,
+		"movies/_indexes/by_name/Superman": index.ProblemDanglingEntry,
+	}
+	if !reflect.DeepEqual(kinds, expected_kinds) {
+		t.Fatalf("expected the problems %v but got %v", expected_kinds, kinds)
+	}
+
+	problems, err = Run(context.Background(), storage, false)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("expected no problems after repairing but got %+v", problems)
+	}
+}
+
+func Test_RunChecksThroughTheCache(t *testing.T) {
+	root := t.TempDir()
+	storage := &s.CachedStorage{Backend: &s.FileStorage{Root: root}}
+	_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	err = os.WriteFile(filepath.Join(root, "movies", "broken.json"), []byte("{"), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	problems, err := Run(context.Background(), storage, false)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(problems) != 1 || problems[0].Kind != s.ProblemCorrupted {
+		t.Fatalf("expected the corrupted document to be found through the cache but got %+v", problems)
+	}
+
+	_, err = Run(context.Background(), &s.MemoryStorage{}, false)
+	if !errors.Is(err, s.ErrNotCheckable) {
+		t.Fatalf("expected error '%s' but got '%v'", s.ErrNotCheckable, err)
+	}
+}
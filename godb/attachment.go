@@ -0,0 +1,279 @@
+package godb
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+
+	c "godb/common"
+	"godb/index"
+	"godb/logs"
+	s "godb/storage"
+)
+
+// attachmentsKey is the field of the documents keeping the metadata of their
+// attachments, by name. It's kept as it is by Set and Patch.
+const attachmentsKey = "_attachments"
+
+// Attachment is the metadata of a binary attachment of a document. Digest is
+// "sha256:" followed by the hex sha256 of the content.
+type Attachment struct {
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Digest      string `json:"digest"`
+}
+
+// PutAttachment streams the content under the document, which must exist,
+// and records its metadata in the document, as a new revision. The storage
+// must support attachments, see s.AttachmentStorage.
+//
+// The content is staged without holding the lock, so other writes aren't
+// blocked by slow uploads, and only put in place along with its metadata. If
+// it can't be, the previous metadata is restored.
+func (godb *Godb) PutAttachment(id, name, content_type string, content io.Reader) (Attachment, error) {
+	return godb.PutAttachmentContext(context.Background(), id, name, content_type, content)
+}
+
+func (godb *Godb) PutAttachmentContext(ctx context.Context, id, name, content_type string, content io.Reader) (Attachment, error) {
+	// fails before streaming the content when the document doesn't exist
+	_, err := godb.GetContext(ctx, id)
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	reader := &digestReader{ctx: ctx, reader: content, hash: sha256.New()}
+	staged, err := s.StageAttachment(godb.storage, id, name, reader)
+	if err != nil {
+		logs.Error(err, "attachment.put %s %s", id, name)
+		return Attachment{}, err
+	}
+
+	attachment := Attachment{
+		ContentType: content_type,
+		Size:        reader.size,
+		Digest:      "sha256:" + hex.EncodeToString(reader.hash.Sum(nil)),
+	}
+
+	godb.mutex.Lock()
+	defer godb.mutex.Unlock()
+
+	var previous *Attachment
+	err = godb.transaction(ctx, func(tx *Tx) error {
+		document, err := tx.Get(id)
+		if err != nil {
+			return err
+		}
+		if previous_attachment, exists := attachmentsOf(document)[name]; exists {
+			previous = &previous_attachment
+		}
+		return tx.setAttachment(id, name, &attachment)
+	})
+	if err == nil {
+		err = s.CommitAttachment(godb.storage, id, name, staged)
+		if err != nil {
+			// the metadata must keep describing the content in place
+			restore_err := godb.transaction(context.WithoutCancel(ctx), func(tx *Tx) error {
+				return tx.setAttachment(id, name, previous)
+			})
+			if restore_err != nil {
+				logs.Error(restore_err, "attachment.restore %s %s", id, name)
+			}
+		}
+	}
+	if err != nil {
+		logs.Error(err, "attachment.put %s %s", id, name)
+		discard_err := s.DiscardAttachment(godb.storage, id, staged)
+		if discard_err != nil {
+			logs.Error(discard_err, "attachment.discard %s %s", id, name)
+		}
+		return Attachment{}, err
+	}
+
+	logs.Info("attachment.put %s %s %v", id, name, attachment)
+
+	return attachment, nil
+}
+
+// GetAttachment returns the content of the attachment, which the caller must
+// close, along with its metadata. It fails with c.ErrAttachmentDoesNotExist
+// when the document has no such attachment.
+func (godb *Godb) GetAttachment(id, name string) (io.ReadSeekCloser, Attachment, error) {
+	return godb.GetAttachmentContext(context.Background(), id, name)
+}
+
+func (godb *Godb) GetAttachmentContext(ctx context.Context, id, name string) (io.ReadSeekCloser, Attachment, error) {
+	err := c.ValidateId(id)
+	if err != nil {
+		return nil, Attachment{}, err
+	}
+
+	godb.mutex.RLock()
+	defer godb.mutex.RUnlock()
+
+	document, err := s.GetContext(ctx, godb.storage, id)
+	if err != nil {
+		return nil, Attachment{}, err
+	}
+	attachment, exists := attachmentsOf(document)[name]
+	if !exists {
+		return nil, Attachment{}, c.ErrAttachmentDoesNotExist
+	}
+
+	content, err := s.GetAttachment(godb.storage, id, name)
+	if err != nil {
+		return nil, Attachment{}, err
+	}
+
+	return content, attachment, nil
+}
+
+func (godb *Godb) DeleteAttachment(id, name string) error {
+	return godb.DeleteAttachmentContext(context.Background(), id, name)
+}
+
+func (godb *Godb) DeleteAttachmentContext(ctx context.Context, id, name string) error {
+	err := c.ValidateId(id)
+	if err != nil {
+		return err
+	}
+
+	godb.mutex.Lock()
+	defer godb.mutex.Unlock()
+
+	// the metadata goes first, a content left behind isn't seen
+	err = godb.transaction(ctx, func(tx *Tx) error {
+		return tx.setAttachment(id, name, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.DeleteAttachment(godb.storage, id, name)
+	if err != nil {
+		logs.Error(err, "attachment.delete %s %s", id, name)
+		return err
+	}
+
+	logs.Info("attachment.delete %s %s", id, name)
+
+	return nil
+}
+
+// ListAttachments returns the metadata of the attachments of the document,
+// by name.
+func (godb *Godb) ListAttachments(id string) (map[string]Attachment, error) {
+	return godb.ListAttachmentsContext(context.Background(), id)
+}
+
+func (godb *Godb) ListAttachmentsContext(ctx context.Context, id string) (map[string]Attachment, error) {
+	document, err := godb.GetContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return attachmentsOf(document), nil
+}
+
+// setAttachment records the metadata of the attachment in the document, or
+// removes it when nil.
+func (tx *Tx) setAttachment(id, name string, attachment *Attachment) error {
+	next_rev, existing_document, err := nextRev(tx.storage, id, AnyRev)
+	if err != nil {
+		return err
+	}
+	if existing_document == nil {
+		return c.ErrDocumentDoestNotExist
+	}
+
+	attachments := attachmentsOf(existing_document)
+	if attachment != nil {
+		attachments[name] = *attachment
+	} else if _, exists := attachments[name]; exists {
+		delete(attachments, name)
+	} else {
+		return c.ErrAttachmentDoesNotExist
+	}
+
+	document := withRev(existing_document, next_rev)
+	delete(document, attachmentsKey)
+	if len(attachments) > 0 {
+		attachments_document := c.Document{}
+		for name, attachment := range attachments {
+			attachments_document[name] = c.Document{
+				"content_type": attachment.ContentType,
+				"size":         attachment.Size,
+				"digest":       attachment.Digest,
+			}
+		}
+		document[attachmentsKey] = attachments_document
+	}
+
+	document, err = tx.storage.Set(document)
+	if err != nil {
+		logs.Error(err, "document.setAttachment %v", document)
+		return err
+	}
+
+	err = index.OnDocumentModifiedContext(tx.ctx, tx.storage, document)
+	if err != nil {
+		logs.Error(err, "document.setAttachment.updateIndex %v", document)
+		return err
+	}
+
+	return nil
+}
+
+// withAttachments replaces the attachments of the document with those of the
+// existing one, so they're only changed through the attachments API.
+func withAttachments(document c.Document, existing_document c.Document) c.Document {
+	delete(document, attachmentsKey)
+	if attachments, ok := existing_document[attachmentsKey]; ok {
+		document[attachmentsKey] = attachments
+	}
+
+	return document
+}
+
+// attachmentsOf decodes the metadata of the attachments of the document,
+// which can come from any codec.
+func attachmentsOf(document c.Document) map[string]Attachment {
+	attachments := map[string]Attachment{}
+	value, ok := document[attachmentsKey]
+	if !ok {
+		return attachments
+	}
+
+	attachments_bytes, err := json.Marshal(value)
+	if err == nil {
+		err = json.Unmarshal(attachments_bytes, &attachments)
+	}
+	if err != nil {
+		logs.Error(err, "document.attachments %v", document)
+	}
+
+	return attachments
+}
+
+// digestReader hashes and counts the content as it's read, and stops it once
+// the context is done.
+type digestReader struct {
+	ctx    context.Context
+	reader io.Reader
+	hash   hash.Hash
+	size   int64
+}
+
+func (reader *digestReader) Read(p []byte) (int, error) {
+	if err := reader.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := reader.reader.Read(p)
+	reader.hash.Write(p[:n])
+	reader.size += int64(n)
+
+	return n, err
+}
@@ -1,15 +1,30 @@
 package godb
 
 import (
+	"context"
 	c "godb/common"
-	"godb/index"
 	"godb/logs"
 	s "godb/storage"
-	"strings"
+	"sync"
 )
 
+// The revisions given to the *IfRev operations are the one of the stored
+// document, 0 for documents written before revisions existed, or one of:
+const (
+	// AnyRev disables the revision check.
+	AnyRev = -1
+	// CreateOnly requires the document not to exist yet.
+	CreateOnly = -2
+	// AnyExistingRev requires the document to exist, at any revision.
+	AnyExistingRev = -3
+)
+
+// Godb is the database. Every operation has a *Context variant that stops,
+// with the context's error, once the context is done, including the index
+// updates. Ids are validated with c.ValidateId and fail with c.ErrInvalidId.
 type Godb struct {
 	storage s.Storage
+	mutex   sync.RWMutex
 }
 
 func NewGodb(storage s.Storage) *Godb {
@@ -21,67 +36,147 @@ func NewGodb(storage s.Storage) *Godb {
 	return godb
 }
 
-func (godb *Godb) Set(document c.Document) (c.Document, error) {
-	document, err := godb.storage.Set(document)
+// Transaction runs f with a transaction whose writes, together with their
+// index updates, are committed atomically when f returns without error.
+// Transactions are serialized, so reads inside f see a consistent view.
+func (godb *Godb) Transaction(f func(tx *Tx) error) error {
+	return godb.TransactionContext(context.Background(), f)
+}
+
+func (godb *Godb) TransactionContext(ctx context.Context, f func(tx *Tx) error) error {
+	godb.mutex.Lock()
+	defer godb.mutex.Unlock()
+
+	return godb.transaction(ctx, f)
+}
+
+// transaction is TransactionContext for callers already holding the lock.
+func (godb *Godb) transaction(ctx context.Context, f func(tx *Tx) error) error {
+	tx := &Tx{ctx: ctx, storage: s.NewOverlayStorageContext(ctx, godb.storage)}
+	err := f(tx)
 	if err != nil {
-		logs.Error(err, "document.set %v", document)
-		return nil, err
+		return err
 	}
 
-	err = index.OnDocumentModified(godb.storage, document)
+	err = s.CommitContext(ctx, godb.storage, tx.storage.Operations())
 	if err != nil {
-		logs.Error(err, "document.set.updateIndex %v", document)
-		return nil, err
+		logs.Error(err, "transaction.commit")
+		return err
 	}
 
-	logs.Info("document.set %v", document)
+	return nil
+}
 
-	return document, nil
+func (godb *Godb) Set(document c.Document) (c.Document, error) {
+	return godb.SetIfRevContext(context.Background(), document, AnyRev)
 }
 
-func (godb *Godb) Get(id string) (c.Document, error) {
-	return godb.storage.Get(id)
+func (godb *Godb) SetContext(ctx context.Context, document c.Document) (c.Document, error) {
+	return godb.SetIfRevContext(ctx, document, AnyRev)
 }
 
-func (godb *Godb) Patch(document c.Document) (c.Document, error) {
-	document, err := godb.storage.Patch(document)
+// SetIfRev stores the document only if the stored one is at revision rev.
+// CreateOnly creates it only if it doesn't exist yet.
+func (godb *Godb) SetIfRev(document c.Document, rev int) (c.Document, error) {
+	return godb.SetIfRevContext(context.Background(), document, rev)
+}
+
+func (godb *Godb) SetIfRevContext(ctx context.Context, document c.Document, rev int) (c.Document, error) {
+	var result c.Document
+	err := godb.TransactionContext(ctx, func(tx *Tx) error {
+		var err error
+		result, err = tx.SetIfRev(document, rev)
+		return err
+	})
 	if err != nil {
-		logs.Error(err, "document.patch %v", document)
 		return nil, err
 	}
 
-	err = index.OnDocumentModified(godb.storage, document)
+	return result, nil
+}
+
+func (godb *Godb) Get(id string) (c.Document, error) {
+	return godb.GetContext(context.Background(), id)
+}
+
+func (godb *Godb) GetContext(ctx context.Context, id string) (c.Document, error) {
+	err := c.ValidateId(id)
 	if err != nil {
-		logs.Error(err, "document.patch.updateIndex %v", document)
 		return nil, err
 	}
 
-	logs.Info("document.patch %v", document)
+	godb.mutex.RLock()
+	defer godb.mutex.RUnlock()
 
-	return document, nil
+	return s.GetContext(ctx, godb.storage, id)
 }
 
-func (godb *Godb) List(id string) ([]string, error) {
-	ids, err := godb.storage.List(id)
+func (godb *Godb) Patch(document c.Document) (c.Document, error) {
+	return godb.PatchIfRevContext(context.Background(), document, AnyRev)
+}
+
+func (godb *Godb) PatchContext(ctx context.Context, document c.Document) (c.Document, error) {
+	return godb.PatchIfRevContext(ctx, document, AnyRev)
+}
+
+// PatchIfRev patches the document only if the stored one is at revision rev.
+func (godb *Godb) PatchIfRev(document c.Document, rev int) (c.Document, error) {
+	return godb.PatchIfRevContext(context.Background(), document, rev)
+}
+
+func (godb *Godb) PatchIfRevContext(ctx context.Context, document c.Document, rev int) (c.Document, error) {
+	var result c.Document
+	err := godb.TransactionContext(ctx, func(tx *Tx) error {
+		var err error
+		result, err = tx.PatchIfRev(document, rev)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	final_ids := []string{}
-	for _, id := range ids {
-		if strings.HasSuffix(id, "/") {
-			if strings.HasPrefix(id, "_") {
-				final_ids = append(final_ids, strings.TrimRight(id, "/"))
-			}
-			continue
-		}
+	return result, nil
+}
 
-		final_ids = append(final_ids, id)
-	}
+func (godb *Godb) List(id string) ([]string, error) {
+	return godb.ListContext(context.Background(), id)
+}
+
+func (godb *Godb) ListContext(ctx context.Context, id string) ([]string, error) {
+	godb.mutex.RLock()
+	defer godb.mutex.RUnlock()
 
-	return final_ids, nil
+	return list(ctx, godb.storage, id)
+}
+
+// ListPage lists the folder in lexical order, a page at a time: the returned
+// cursor, empty on the last page, is the StartAfter of the next one.
+func (godb *Godb) ListPage(id string, options s.IterateOptions) ([]string, string, error) {
+	return godb.ListPageContext(context.Background(), id, options)
+}
+
+func (godb *Godb) ListPageContext(ctx context.Context, id string, options s.IterateOptions) ([]string, string, error) {
+	godb.mutex.RLock()
+	defer godb.mutex.RUnlock()
+
+	return listPage(ctx, godb.storage, id, options)
 }
 
 func (godb *Godb) Delete(id string) error {
-	return godb.storage.Delete(id)
+	return godb.DeleteIfRevContext(context.Background(), id, AnyRev)
+}
+
+func (godb *Godb) DeleteContext(ctx context.Context, id string) error {
+	return godb.DeleteIfRevContext(ctx, id, AnyRev)
+}
+
+// DeleteIfRev deletes the document only if the stored one is at revision rev.
+func (godb *Godb) DeleteIfRev(id string, rev int) error {
+	return godb.DeleteIfRevContext(context.Background(), id, rev)
+}
+
+func (godb *Godb) DeleteIfRevContext(ctx context.Context, id string, rev int) error {
+	return godb.TransactionContext(ctx, func(tx *Tx) error {
+		return tx.DeleteIfRev(id, rev)
+	})
 }
@@ -1,8 +1,17 @@
 package godb
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	c "godb/common"
 	s "godb/storage"
@@ -48,3 +57,469 @@ func Test_CreateIndex(t *testing.T) {
 		t.Fatalf("expected indexed document to be {a: 23, b: 'movies/matrix'} but got %s", document)
 	}
 }
+
+func Test_Revisions(t *testing.T) {
+	storage := &s.FileStorage{Root: t.TempDir()}
+	godb := NewGodb(storage)
+
+	_, err := godb.SetIfRev(c.NewDocument("movies/matrix", "name", "Matrix"), AnyExistingRev)
+	if !errors.Is(err, c.ErrRevisionConflict) {
+		t.Fatalf("expected error 'RevisionConflict' but got '%s'", err)
+	}
+
+	document, err := godb.SetIfRev(c.NewDocument("movies/matrix", "name", "Matrix"), CreateOnly)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if document.GetRev() != 1 {
+		t.Fatalf("expected rev to be 1 but got %d", document.GetRev())
+	}
+
+	_, err = godb.SetIfRev(c.NewDocument("movies/matrix", "name", "Matrix"), CreateOnly)
+	if !errors.Is(err, c.ErrRevisionConflict) {
+		t.Fatalf("expected error 'RevisionConflict' but got '%s'", err)
+	}
+
+	document, err = godb.PatchIfRev(c.NewDocument("movies/matrix", "year", 1999), 1)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if document.GetRev() != 2 {
+		t.Fatalf("expected rev to be 2 but got %d", document.GetRev())
+	}
+
+	document, err = godb.Get("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if document.GetRev() != 2 {
+		t.Fatalf("expected stored rev to be 2 but got %d", document.GetRev())
+	}
+
+	err = godb.DeleteIfRev("movies/matrix", 1)
+	if !errors.Is(err, c.ErrRevisionConflict) {
+		t.Fatalf("expected error 'RevisionConflict' but got '%s'", err)
+	}
+
+	err = godb.DeleteIfRev("movies/matrix", 2)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	// written before revisions existed, it's at rev 0 but exists
+	_, err = storage.Set(c.NewDocument("movies/dune", "name", "Dune"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	_, err = godb.SetIfRev(c.NewDocument("movies/dune", "name", "Dune"), CreateOnly)
+	if !errors.Is(err, c.ErrRevisionConflict) {
+		t.Fatalf("expected error 'RevisionConflict' but got '%s'", err)
+	}
+	document, err = godb.SetIfRev(c.NewDocument("movies/dune", "name", "Dune"), 0)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if document.GetRev() != 1 {
+		t.Fatalf("expected rev to be 1 but got %d", document.GetRev())
+	}
+}
+
+func Test_Transaction(t *testing.T) {
+	storage := &s.FileStorage{Root: t.TempDir()}
+	godb := NewGodb(storage)
+
+	_, err := godb.Set(c.NewDocument("stock/matrix", "units", 3))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	err = godb.Transaction(func(tx *Tx) error {
+		_, err := tx.Set(c.NewDocument("orders/1", "item", "stock/matrix"))
+		if err != nil {
+			return err
+		}
+		stock, err := tx.Get("stock/matrix")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Patch(c.NewDocument("stock/matrix", "units", stock["units"].(float64)-1))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	stock, err := godb.Get("stock/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if stock["units"] != float64(2) {
+		t.Fatalf("expected units to be 2 but got %v", stock["units"])
+	}
+
+	failure := errors.New("failure")
+	err = godb.Transaction(func(tx *Tx) error {
+		_, err := tx.Set(c.NewDocument("orders/2", "item", "stock/matrix"))
+		if err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("expected error 'failure' but got '%s'", err)
+	}
+
+	_, err = godb.Get("orders/2")
+	if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+		t.Fatalf("expected error 'DocumentDoesNotExist' but got '%s'", err)
+	}
+}
+
+func Test_ListPage(t *testing.T) {
+	storage := &s.MemoryStorage{}
+	godb := NewGodb(storage)
+
+	_, err := godb.Set(c.NewDocument("movies/_indexes/by_name", "func", "(doc) => ([doc.name, {}])"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	for _, name := range []string{"matrix", "alien", "superman"} {
+		_, err := godb.Set(c.NewDocument("movies/"+name, "name", name))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+
+	ids, next, err := godb.ListPage("movies", s.IterateOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !reflect.DeepEqual(ids, []string{"_indexes", "alien"}) || next != "alien" {
+		t.Fatalf("expected the first page to be ['_indexes', 'alien'] but got %s, next %q", ids, next)
+	}
+
+	ids, next, err = godb.ListPage("movies", s.IterateOptions{Limit: 2, StartAfter: next})
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !reflect.DeepEqual(ids, []string{"matrix", "superman"}) || next != "" {
+		t.Fatalf("expected the last page to be ['matrix', 'superman'] but got %s, next %q", ids, next)
+	}
+}
+
+func Test_ContextStopsIndexing(t *testing.T) {
+	storage := &s.MemoryStorage{}
+	godb := NewGodb(storage)
+
+	_, err := godb.Set(c.NewDocument("movies/_indexes/forever", "func", "(doc) => { while (true) {} }"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = godb.SetContext(ctx, c.NewDocument("movies/matrix", "name", "Matrix"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected error '%s' but got '%v'", context.DeadlineExceeded, err)
+	}
+
+	_, err = godb.Get("movies/matrix")
+	if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+		t.Fatalf("expected the document to not be stored but got '%v'", err)
+	}
+}
+
+func Test_FailedCommitsKeepIndexesConsistent(t *testing.T) {
+	storage := &s.FaultStorage{Backend: &s.FileStorage{Root: t.TempDir()}}
+	godb := NewGodb(storage)
+
+	_, err := godb.Set(c.NewDocument("movies/_indexes/by_name", "func", "(doc) => ([doc.name, {id: doc.id}])"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	storage.Rules = []s.FaultRule{{Operations: []string{"commit"}, IdPattern: "movies/matrix", Crash: true}}
+	_, err = godb.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if !errors.Is(err, s.ErrInjectedFault) {
+		t.Fatalf("expected error '%s' but got '%v'", s.ErrInjectedFault, err)
+	}
+	_, err = godb.Set(c.NewDocument("movies/alien", "name", "Alien"))
+	if !errors.Is(err, s.ErrCrashed) {
+		t.Fatalf("expected error '%s' but got '%v'", s.ErrCrashed, err)
+	}
+
+	storage.Rules = nil
+	storage.Recover()
+	for _, id := range []string{"movies/matrix", "movies/alien", "movies/_indexes/by_name/Matrix", "movies/_indexes/by_name/Alien"} {
+		_, err = godb.Get(id)
+		if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+			t.Fatalf("expected '%s' to not be stored but got '%v'", id, err)
+		}
+	}
+
+	_, err = godb.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	ids, err := godb.List("movies/_indexes/by_name")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !reflect.DeepEqual(ids, []string{"Matrix"}) {
+		t.Fatalf("expected ids to be ['Matrix'] but got %s", ids)
+	}
+}
+
+func Test_IdsAreValidatedAndIndexKeysEscaped(t *testing.T) {
+	storage := &s.FileStorage{Root: t.TempDir()}
+	godb := NewGodb(storage)
+
+	for _, id := range []string{"movies/../etc", "movies//matrix", "movies/\x00"} {
+		_, err := godb.Set(c.NewDocument(id, "name", "Matrix"))
+		if !errors.Is(err, c.ErrInvalidId) {
+			t.Fatalf("expected error '%s' setting %q but got '%v'", c.ErrInvalidId, id, err)
+		}
+		_, err = godb.Get(id)
+		if !errors.Is(err, c.ErrInvalidId) {
+			t.Fatalf("expected error '%s' getting %q but got '%v'", c.ErrInvalidId, id, err)
+		}
+	}
+
+	_, err := godb.Set(c.NewDocument("movies/_indexes/by_name", "func", "(doc) => ([doc.name, {id: doc.id}])"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	for i, name := range []string{"AC/DC", "..", "100%"} {
+		_, err := godb.Set(c.NewDocument(c.S("movies/%d", i), "name", name))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+
+	ids, err := godb.List("movies/_indexes/by_name")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !reflect.DeepEqual(ids, []string{"%2E.", "100%25", "AC%2FDC"}) {
+		t.Fatalf("expected the escaped keys but got %s", ids)
+	}
+	document, err := godb.Get("movies/_indexes/by_name/" + c.EscapeSegment("AC/DC"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if document["id"] != "movies/_indexes/by_name/AC%2FDC" {
+		t.Fatalf("expected the 'AC/DC' entry but got %v", document)
+	}
+}
+
+func Test_AttachmentsAreRecordedInTheDocument(t *testing.T) {
+	storage := &s.FileStorage{Root: t.TempDir()}
+	godb := NewGodb(storage)
+
+	_, err := godb.PutAttachment("movies/matrix", "poster.png", "image/png", strings.NewReader("png"))
+	if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+		t.Fatalf("expected error '%s' but got '%v'", c.ErrDocumentDoestNotExist, err)
+	}
+	_, err = godb.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	attachment, err := godb.PutAttachment("movies/matrix", "poster.png", "image/png", strings.NewReader("png"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	sum := sha256.Sum256([]byte("png"))
+	expected_attachment := Attachment{
+		ContentType: "image/png",
+		Size:        3,
+		Digest:      "sha256:" + hex.EncodeToString(sum[:]),
+	}
+	if attachment != expected_attachment {
+		t.Fatalf("expected the attachment %+v but got %+v", expected_attachment, attachment)
+	}
+
+	// Set and Patch keep the attachments as they are
+	_, err = godb.Set(c.NewDocument("movies/matrix", "name", "The Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	_, err = godb.Patch(c.NewDocument("movies/matrix", "_attachments", c.Document{}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	document, err := godb.Get("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if document.GetRev() != 4 || document["name"] != "The Matrix" {
+		t.Fatalf("expected the revision 4 of 'The Matrix' but got %v", document)
+	}
+	attachments, err := godb.ListAttachments("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !reflect.DeepEqual(attachments, map[string]Attachment{"poster.png": expected_attachment}) {
+		t.Fatalf("expected the poster but got %v", attachments)
+	}
+
+	content, attachment, err := godb.GetAttachment("movies/matrix", "poster.png")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	content_bytes, err := io.ReadAll(content)
+	content.Close()
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if string(content_bytes) != "png" || attachment != expected_attachment {
+		t.Fatalf("expected the poster but got %q %+v", content_bytes, attachment)
+	}
+
+	err = godb.DeleteAttachment("movies/matrix", "poster.png")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	err = godb.DeleteAttachment("movies/matrix", "poster.png")
+	if !errors.Is(err, c.ErrAttachmentDoesNotExist) {
+		t.Fatalf("expected error '%s' but got '%v'", c.ErrAttachmentDoesNotExist, err)
+	}
+	document, err = godb.Get("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if _, ok := document["_attachments"]; ok {
+		t.Fatalf("expected no attachments but got %v", document)
+	}
+
+	// a cancelled upload isn't recorded
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = godb.PutAttachmentContext(ctx, "movies/matrix", "poster.png", "image/png", strings.NewReader("png"))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected error '%s' but got '%v'", context.Canceled, err)
+	}
+	_, _, err = godb.GetAttachment("movies/matrix", "poster.png")
+	if !errors.Is(err, c.ErrAttachmentDoesNotExist) {
+		t.Fatalf("expected error '%s' but got '%v'", c.ErrAttachmentDoesNotExist, err)
+	}
+}
+
+// failingCommitStorage fails to put the staged attachments in place.
+type failingCommitStorage struct {
+	*s.MemoryStorage
+	fail bool
+}
+
+func (storage *failingCommitStorage) CommitAttachment(id, name, staged string) error {
+	if storage.fail {
+		return errors.New("commit failed")
+	}
+
+	return storage.MemoryStorage.CommitAttachment(id, name, staged)
+}
+
+func Test_PutAttachmentRestoresMetadataWhenContentFails(t *testing.T) {
+	storage := &failingCommitStorage{MemoryStorage: &s.MemoryStorage{}}
+	godb := NewGodb(storage)
+
+	_, err := godb.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	attachment, err := godb.PutAttachment("movies/matrix", "poster.png", "image/png", strings.NewReader("v1"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	storage.fail = true
+	_, err = godb.PutAttachment("movies/matrix", "poster.png", "image/png", strings.NewReader("version 2"))
+	if err == nil {
+		t.Fatalf("expected the put to fail")
+	}
+	_, err = godb.PutAttachment("movies/matrix", "trailer.mp4", "video/mp4", strings.NewReader("mp4"))
+	if err == nil {
+		t.Fatalf("expected the put to fail")
+	}
+
+	attachments, err := godb.ListAttachments("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := map[string]Attachment{"poster.png": attachment}
+	if !reflect.DeepEqual(attachments, expected) {
+		t.Fatalf("expected the attachments to be %v but got %v", expected, attachments)
+	}
+	content, _, err := godb.GetAttachment("movies/matrix", "poster.png")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	defer content.Close()
+	content_bytes, err := io.ReadAll(content)
+	if err != nil || string(content_bytes) != "v1" {
+		t.Fatalf("expected the content to be 'v1' but got '%s', '%v'", content_bytes, err)
+	}
+}
+
+func Test_PutAttachmentStreamsWithoutBlockingWrites(t *testing.T) {
+	root := t.TempDir()
+	godb := NewGodb(&s.FileStorage{Root: root})
+	_, err := godb.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	put := func(content io.Reader) chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := godb.PutAttachment("movies/matrix", "poster.png", "image/png", content)
+			done <- err
+		}()
+		return done
+	}
+
+	// the write returns once the upload has started
+	reader, writer := io.Pipe()
+	done := put(reader)
+	writer.Write([]byte("pn"))
+	_, err = godb.Set(c.NewDocument("movies/alien", "name", "Alien"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	writer.Write([]byte("g"))
+	writer.Close()
+	err = <-done
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	attachments, err := godb.ListAttachments("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if attachments["poster.png"].Size != 3 {
+		t.Fatalf("expected the 3 bytes attachment to be recorded but got %v", attachments)
+	}
+
+	// the staged content is discarded when the metadata can't be recorded
+	reader, writer = io.Pipe()
+	done = put(reader)
+	writer.Write([]byte("jpg"))
+	err = godb.Delete("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	writer.Close()
+	err = <-done
+	if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+		t.Fatalf("expected error '%s' but got '%v'", c.ErrDocumentDoestNotExist, err)
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "movies"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "alien.json" {
+			t.Fatalf("expected only the alien document to be left but got %s", entry.Name())
+		}
+	}
+}
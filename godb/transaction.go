@@ -0,0 +1,228 @@
+package godb
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	c "godb/common"
+	"godb/index"
+	"godb/logs"
+	s "godb/storage"
+)
+
+// Tx buffers the writes of a transaction until it's committed. It must not
+// be used once the function given to Godb.Transaction has returned.
+type Tx struct {
+	ctx     context.Context
+	storage *s.OverlayStorage
+}
+
+func (tx *Tx) Get(id string) (c.Document, error) {
+	err := c.ValidateId(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return tx.storage.Get(id)
+}
+
+func (tx *Tx) List(id string) ([]string, error) {
+	return list(tx.ctx, tx.storage, id)
+}
+
+func (tx *Tx) Set(document c.Document) (c.Document, error) {
+	return tx.SetIfRev(document, AnyRev)
+}
+
+func (tx *Tx) SetIfRev(document c.Document, rev int) (c.Document, error) {
+	document_id, err := document.GetId()
+	if err != nil {
+		return nil, err
+	}
+	err = c.ValidateId(document_id)
+	if err != nil {
+		return nil, err
+	}
+
+	next_rev, existing_document, err := nextRev(tx.storage, document_id, rev)
+	if err != nil {
+		logs.Error(err, "document.set %v", document)
+		return nil, err
+	}
+
+	document, err = tx.storage.Set(withAttachments(withRev(document, next_rev), existing_document))
+	if err != nil {
+		logs.Error(err, "document.set %v", document)
+		return nil, err
+	}
+
+	err = index.OnDocumentModifiedContext(tx.ctx, tx.storage, document)
+	if err != nil {
+		logs.Error(err, "document.set.updateIndex %v", document)
+		return nil, err
+	}
+
+	logs.Info("document.set %v", document)
+
+	return document, nil
+}
+
+func (tx *Tx) Patch(document c.Document) (c.Document, error) {
+	return tx.PatchIfRev(document, AnyRev)
+}
+
+func (tx *Tx) PatchIfRev(document c.Document, rev int) (c.Document, error) {
+	document_id, err := document.GetId()
+	if err != nil {
+		return nil, err
+	}
+	err = c.ValidateId(document_id)
+	if err != nil {
+		return nil, err
+	}
+
+	next_rev, existing_document, err := nextRev(tx.storage, document_id, rev)
+	if err != nil {
+		logs.Error(err, "document.patch %v", document)
+		return nil, err
+	}
+
+	document, err = tx.storage.Patch(withAttachments(withRev(document, next_rev), existing_document))
+	if err != nil {
+		logs.Error(err, "document.patch %v", document)
+		return nil, err
+	}
+
+	err = index.OnDocumentModifiedContext(tx.ctx, tx.storage, document)
+	if err != nil {
+		logs.Error(err, "document.patch.updateIndex %v", document)
+		return nil, err
+	}
+
+	logs.Info("document.patch %v", document)
+
+	return document, nil
+}
+
+func (tx *Tx) Delete(id string) error {
+	return tx.DeleteIfRev(id, AnyRev)
+}
+
+func (tx *Tx) DeleteIfRev(id string, rev int) error {
+	err := c.ValidateId(id)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = nextRev(tx.storage, id, rev)
+	if err != nil {
+		logs.Error(err, "document.delete %s", id)
+		return err
+	}
+
+	err = tx.storage.Delete(id)
+	if err != nil {
+		logs.Error(err, "document.delete %s", id)
+		return err
+	}
+
+	err = index.OnDocumentDeletedContext(tx.ctx, tx.storage, id)
+	if err != nil {
+		logs.Error(err, "document.delete.updateIndex %s", id)
+		return err
+	}
+
+	logs.Info("document.delete %s", id)
+
+	return nil
+}
+
+func list(ctx context.Context, storage s.Storage, id string) ([]string, error) {
+	ids, _, err := listPage(ctx, storage, id, s.IterateOptions{})
+
+	return ids, err
+}
+
+// listPage lists the documents and the "_" folders, like indexes, of the
+// folder. When the limit is reached it also returns the cursor of the next
+// page.
+func listPage(ctx context.Context, storage s.Storage, id string, options s.IterateOptions) ([]string, string, error) {
+	if strings.Trim(id, "/") != "" {
+		err := c.ValidateId(id)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	limit := options.Limit
+	options.Limit = 0
+	options.IncludeDocuments = false
+
+	iterator := s.IterateContext(ctx, storage, id, options)
+	defer iterator.Close()
+
+	final_ids := []string{}
+	last_id := ""
+	next := ""
+	for iterator.Next() {
+		id := iterator.Id()
+		if strings.HasSuffix(id, "/") && !strings.HasPrefix(id, "_") {
+			continue
+		}
+		if limit > 0 && len(final_ids) == limit {
+			next = last_id
+			break
+		}
+
+		last_id = id
+		final_ids = append(final_ids, strings.TrimRight(id, "/"))
+	}
+	if iterator.Err() != nil {
+		return nil, "", iterator.Err()
+	}
+
+	return final_ids, next, nil
+}
+
+// nextRev checks the revision of the stored document, returned along with
+// it, nil when missing. A missing document has no revision, so only AnyRev
+// and CreateOnly accept it.
+func nextRev(storage s.Storage, id string, rev int) (int, c.Document, error) {
+	current_rev := 0
+	existing_document, err := storage.Get(id)
+	if err != nil {
+		if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+			return 0, nil, err
+		}
+	} else {
+		current_rev = existing_document.GetRev()
+	}
+
+	exists := existing_document != nil
+	switch rev {
+	case AnyRev:
+	case CreateOnly:
+		if exists {
+			return 0, nil, c.ErrRevisionConflict
+		}
+	case AnyExistingRev:
+		if !exists {
+			return 0, nil, c.ErrRevisionConflict
+		}
+	default:
+		if !exists || rev != current_rev {
+			return 0, nil, c.ErrRevisionConflict
+		}
+	}
+
+	return current_rev + 1, existing_document, nil
+}
+
+func withRev(document c.Document, rev int) c.Document {
+	revised_document := c.Document{}
+	revised_document.Patch(document)
+	revised_document["_rev"] = rev
+
+	return revised_document
+}
@@ -1,13 +1,16 @@
 package http
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	c "godb/common"
 	"godb/godb"
@@ -18,8 +21,7 @@ type httpJsonApi struct {
 	godb *godb.Godb
 }
 
-func NewHttpJsonApi(rootFolder string) *httpJsonApi {
-	storage := &s.FileStorage{Root: rootFolder}
+func NewHttpJsonApi(storage s.Storage) *httpJsonApi {
 	return &httpJsonApi{
 		godb: godb.NewGodb(storage),
 	}
@@ -34,18 +36,108 @@ func (api *httpJsonApi) handle(w http.ResponseWriter, r *http.Request) {
 	path := strings.Trim(r.URL.Path, "/")
 	query := r.URL.Query()
 
-	response := api.handleInner(path, query)
+	if id, name, ok := attachmentPath(path); ok {
+		api.handleAttachment(w, r, id, name)
+		return
+	}
+
+	var response any
+	rev, err := ifMatchRev(r.Header)
+	if err != nil {
+		response = err
+	} else {
+		// the context is cancelled if the client goes away
+		response = api.handleInner(r.Context(), path, query, rev)
+	}
 
 	if err, ok := response.(error); ok {
-		response = c.Document{
-			"error": err.Error(),
+		writeError(w, err)
+		return
+	}
+	if etag := responseETag(response); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, c.ErrRevisionConflict) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+	} else if errors.Is(err, c.ErrInvalidId) {
+		w.WriteHeader(http.StatusBadRequest)
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		w.WriteHeader(http.StatusGatewayTimeout)
+	} else if errors.Is(err, c.ErrAttachmentDoesNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+	} else if errors.Is(err, s.ErrAttachmentsNotSupported) {
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+
+	json.NewEncoder(w).Encode(c.Document{
+		"error": err.Error(),
+	})
+}
+
+// handleAttachment serves "<id>/_attachments/<name>": GET downloads it, with
+// range requests, PUT or POST upload the body with its Content-Type, and
+// DELETE removes it. A GET without name lists the attachments.
+func (api *httpJsonApi) handleAttachment(w http.ResponseWriter, r *http.Request, id string, name string) {
+	ctx := r.Context()
+
+	var response any
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		attachments, err := api.godb.ListAttachmentsContext(ctx, id)
+		response = attachments
+		if err != nil {
+			response = err
 		}
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		content, attachment, err := api.godb.GetAttachmentContext(ctx, id, name)
+		if err != nil {
+			response = err
+			break
+		}
+		defer content.Close()
+
+		w.Header().Set("Content-Type", attachment.ContentType)
+		w.Header().Set("ETag", `"`+attachment.Digest+`"`)
+		http.ServeContent(w, r, name, time.Time{}, content)
+		return
+	case r.Method == http.MethodPut || r.Method == http.MethodPost:
+		content_type := r.Header.Get("Content-Type")
+		if content_type == "" {
+			content_type = "application/octet-stream"
+		}
+		attachment, err := api.godb.PutAttachmentContext(ctx, id, name, content_type, r.Body)
+		response = attachment
+		if err != nil {
+			response = err
+		}
+	case r.Method == http.MethodDelete:
+		response = "deleted"
+		err := api.godb.DeleteAttachmentContext(ctx, id, name)
+		if err != nil {
+			response = err
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response = errors.New("method not allowed")
+	}
+
+	if err, ok := response.(error); ok {
+		if errors.Is(err, c.ErrDocumentDoestNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		writeError(w, err)
+		return
 	}
 
 	json.NewEncoder(w).Encode(response)
 }
 
-func (api *httpJsonApi) handleInner(path string, query url.Values) any {
+func (api *httpJsonApi) handleInner(ctx context.Context, path string, query url.Values, rev int) any {
 	for key := range query {
 		if key == "id" {
 			return errors.New("id needs to be set in the url")
@@ -59,37 +151,38 @@ func (api *httpJsonApi) handleInner(path string, query url.Values) any {
 	case "_set":
 		id := c.J(itemsList[:len(itemsList)-1]...)
 		document := queryToDocument(id, query)
-		return api.set(document)
+		return api.set(ctx, document, rev)
 	case "_patch":
 		id := c.J(itemsList[:len(itemsList)-1]...)
 		fmt.Println("id " + id)
 
 		document := queryToDocument(id, query)
-		return api.patch(document)
+		return api.patch(ctx, document, rev)
 	case "_delete":
 		id := c.J(itemsList[:len(itemsList)-1]...)
-		return api.delete(id)
+		return api.delete(ctx, id, rev)
 	case "_list":
 		id := c.J(itemsList[:len(itemsList)-1]...)
-		return api.list(id)
+		return api.list(ctx, id, query)
 	}
 
-	return api.get(path)
+	return api.get(ctx, path)
 }
 
-func (api *httpJsonApi) get(id string) any {
+func (api *httpJsonApi) get(ctx context.Context, id string) any {
+	var document c.Document
 	if id == "" {
+		// the root has no document
 		id = "/"
-	}
-
-	document, err := api.godb.Get(id)
-	if err != nil {
-		if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+	} else {
+		var err error
+		document, err = api.godb.GetContext(ctx, id)
+		if err != nil && !errors.Is(err, c.ErrDocumentDoestNotExist) {
 			return err
 		}
 	}
 
-	ids, err := api.godb.List(id)
+	ids, err := api.godb.ListContext(ctx, id)
 	if err != nil {
 		return err
 	}
@@ -100,13 +193,13 @@ func (api *httpJsonApi) get(id string) any {
 	}
 }
 
-func (api *httpJsonApi) set(document c.Document) any {
-	document, err := api.godb.Set(document)
+func (api *httpJsonApi) set(ctx context.Context, document c.Document, rev int) any {
+	document, err := api.godb.SetIfRevContext(ctx, document, rev)
 	if err != nil {
 		return err
 	}
 
-	ids, err := api.godb.List(document.GetIdOrNil())
+	ids, err := api.godb.ListContext(ctx, document.GetIdOrNil())
 	if err != nil {
 		return err
 	}
@@ -117,13 +210,13 @@ func (api *httpJsonApi) set(document c.Document) any {
 	}
 }
 
-func (api *httpJsonApi) patch(document c.Document) any {
-	document, err := api.godb.Patch(document)
+func (api *httpJsonApi) patch(ctx context.Context, document c.Document, rev int) any {
+	document, err := api.godb.PatchIfRevContext(ctx, document, rev)
 	if err != nil {
 		return err
 	}
 
-	ids, err := api.godb.List(document.GetIdOrNil())
+	ids, err := api.godb.ListContext(ctx, document.GetIdOrNil())
 	if err != nil {
 		return err
 	}
@@ -134,17 +227,42 @@ func (api *httpJsonApi) patch(document c.Document) any {
 	}
 }
 
-func (api *httpJsonApi) list(id string) any {
-	ids, err := api.godb.List(id)
+// list returns the ids of the folder or, when paginated with the limit,
+// after or recursive parameters, a page of them with the "next" cursor.
+func (api *httpJsonApi) list(ctx context.Context, id string, query url.Values) any {
+	if !query.Has("limit") && !query.Has("after") && !query.Has("recursive") {
+		ids, err := api.godb.ListContext(ctx, id)
+		if err != nil {
+			return err
+		}
+		return ids
+	}
+
+	options := s.IterateOptions{
+		StartAfter: query.Get("after"),
+		Recursive:  query.Get("recursive") == "true",
+	}
+	if query.Has("limit") {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 0 {
+			return errors.New("invalid limit")
+		}
+		options.Limit = limit
+	}
+
+	ids, next, err := api.godb.ListPageContext(ctx, id, options)
 	if err != nil {
 		return err
 	}
 
-	return ids
+	return c.Document{
+		"ids":  ids,
+		"next": next,
+	}
 }
 
-func (api *httpJsonApi) delete(id string) any {
-	err := api.godb.Delete(id)
+func (api *httpJsonApi) delete(ctx context.Context, id string, rev int) any {
+	err := api.godb.DeleteIfRevContext(ctx, id, rev)
 	if err != nil {
 		return err
 	}
@@ -152,6 +270,19 @@ func (api *httpJsonApi) delete(id string) any {
 	return "deleted"
 }
 
+// attachmentPath splits "<id>/_attachments/<name>" paths. The name is empty
+// for the list of attachments.
+func attachmentPath(path string) (string, string, bool) {
+	itemsList := strings.Split(path, "/")
+	for i, item := range itemsList {
+		if item == "_attachments" && i > 0 {
+			return c.J(itemsList[:i]...), strings.Join(itemsList[i+1:], "/"), true
+		}
+	}
+
+	return "", "", false
+}
+
 func queryToDocument(id string, query url.Values) c.Document {
 	document := c.NewDocument(id)
 
@@ -161,3 +292,44 @@ func queryToDocument(id string, query url.Values) c.Document {
 
 	return document
 }
+
+// ifMatchRev reads the revision expected by the client from the If-Match
+// header, "*" requiring the document to exist. "If-None-Match: *" requires
+// it not to exist. Without them there's no check.
+func ifMatchRev(header http.Header) (int, error) {
+	none_match := strings.TrimSpace(header.Get("If-None-Match"))
+	etag := strings.TrimSpace(header.Get("If-Match"))
+	if none_match != "" {
+		if none_match != "*" || etag != "" {
+			return 0, errors.New("invalid If-None-Match header")
+		}
+		return godb.CreateOnly, nil
+	}
+	if etag == "" {
+		return godb.AnyRev, nil
+	}
+	if etag == "*" {
+		return godb.AnyExistingRev, nil
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	rev, err := strconv.Atoi(strings.Trim(etag, `"`))
+	if err != nil || rev < 0 {
+		return 0, errors.New("invalid If-Match header")
+	}
+
+	return rev, nil
+}
+
+func responseETag(response any) string {
+	wrapper, ok := response.(c.Document)
+	if !ok {
+		return ""
+	}
+	document, ok := wrapper["document"].(c.Document)
+	if !ok || document == nil {
+		return ""
+	}
+
+	return c.S(`"%d"`, document.GetRev())
+}
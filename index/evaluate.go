@@ -1,14 +1,23 @@
 package index
 
 import (
+	"context"
 	"encoding/json"
+	"sync"
 
 	v8 "rogchap.com/v8go"
 
 	c "godb/common"
 )
 
-func evaluate(document c.Document, index_func string) (string, c.Document, error) {
+// evaluate runs the index function over the document. The script is
+// terminated as soon as the context is done.
+func evaluate(ctx context.Context, document c.Document, index_func string) (string, c.Document, error) {
+	err := ctx.Err()
+	if err != nil {
+		return "", nil, err
+	}
+
 	document_bytes, err := json.Marshal(document)
 	if err != nil {
 		return "", nil, err
@@ -16,23 +25,50 @@ func evaluate(document c.Document, index_func string) (string, c.Document, error
 	document_json := string(document_bytes)
 
 	iso := v8.NewIsolate()
-	ctx := v8.NewContext(iso)
-	_, err = ctx.RunScript(c.S("const indexFunc = %s", index_func), "main.js")
+	defer iso.Dispose()
+	v8_context := v8.NewContext(iso)
+	defer v8_context.Close()
+
+	done := make(chan struct{})
+	var watcher sync.WaitGroup
+	watcher.Add(1)
+	go func() {
+		defer watcher.Done()
+		select {
+		case <-ctx.Done():
+			iso.TerminateExecution()
+		case <-done:
+		}
+	}()
+	defer func() {
+		close(done)
+		watcher.Wait()
+	}()
+
+	run := func(script string) (*v8.Value, error) {
+		value, err := v8_context.RunScript(script, "main.js")
+		if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return value, err
+	}
+
+	_, err = run(c.S("const indexFunc = %s", index_func))
 	if err != nil {
 		return "", nil, err
 	}
-	_, err = ctx.RunScript(c.S("const indexResult = indexFunc(%s)", document_json), "main.js")
+	_, err = run(c.S("const indexResult = indexFunc(%s)", document_json))
 	if err != nil {
 		return "", nil, err
 	}
-	indexId, err := ctx.RunScript("indexResult && indexResult[0] || null", "main.js")
+	indexId, err := run("indexResult && indexResult[0] || null")
 	if err != nil {
 		return "", nil, err
 	}
 	if indexId.IsNull() {
 		return "", nil, nil
 	}
-	indexContent, err := ctx.RunScript("JSON.stringify(indexResult && indexResult[1] || null)", "main.js")
+	indexContent, err := run("JSON.stringify(indexResult && indexResult[1] || null)")
 	if err != nil {
 		return "", nil, err
 	}
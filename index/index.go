@@ -1,6 +1,9 @@
 package index
 
 import (
+	"context"
+	"encoding/json"
+	"sort"
 	"strings"
 
 	c "godb/common"
@@ -19,17 +22,21 @@ func indexFromDocument(document c.Document) Index {
 	}
 }
 
-func load_indexes(storage s.Storage, folder string) ([]Index, error) {
+func load_indexes(ctx context.Context, storage s.Storage, folder string) ([]Index, error) {
 	indexes_folder := c.J(folder, "_indexes")
-	indexes_simple_ids, err := storage.List(indexes_folder)
+	indexes_simple_ids, err := s.ListContext(ctx, storage, indexes_folder)
 	if err != nil {
 		return nil, err
 	}
 
 	var indexes []Index
 	for _, index_simple_id := range indexes_simple_ids {
+		// the folders hold the entries of the indexes
+		if strings.HasSuffix(index_simple_id, "/") {
+			continue
+		}
 		index_id := c.J(indexes_folder, index_simple_id)
-		index_document, err := storage.Get(index_id)
+		index_document, err := s.GetContext(ctx, storage, index_id)
 		if err != nil {
 			return nil, err
 		}
@@ -42,59 +49,168 @@ func load_indexes(storage s.Storage, folder string) ([]Index, error) {
 }
 
 func OnDocumentModified(storage s.Storage, document c.Document) error {
+	return OnDocumentModifiedContext(context.Background(), storage, document)
+}
+
+// OnDocumentModifiedContext rebuilds the indexes of the document's folder,
+// stopping with the context's error once it's done.
+func OnDocumentModifiedContext(ctx context.Context, storage s.Storage, document c.Document) error {
 	document_id, err := document.GetId()
 	if err != nil {
 		return err
 	}
 
-	document_folder := c.Folder(document_id)
-	indexes, err := load_indexes(storage, document_folder)
+	return updateFolder(ctx, storage, c.Folder(document_id))
+}
+
+func OnDocumentDeleted(storage s.Storage, document_id string) error {
+	return OnDocumentDeletedContext(context.Background(), storage, document_id)
+}
+
+func OnDocumentDeletedContext(ctx context.Context, storage s.Storage, document_id string) error {
+	return updateFolder(ctx, storage, c.Folder(document_id))
+}
+
+const (
+	// ProblemMissingEntry is an entry the documents give that isn't stored.
+	ProblemMissingEntry s.ProblemKind = "missing-index-entry"
+	// ProblemDanglingEntry is a stored entry no document gives.
+	ProblemDanglingEntry s.ProblemKind = "dangling-index-entry"
+	// ProblemStaleEntry is a stored entry whose content is outdated.
+	ProblemStaleEntry s.ProblemKind = "stale-index-entry"
+)
+
+// Check compares the stored entries of the folder's indexes with the ones
+// its documents give. Rebuild repairs them.
+func Check(ctx context.Context, storage s.Storage, folder string) ([]s.Problem, error) {
+	indexes, err := load_indexes(ctx, storage, folder)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := indexEntries(ctx, storage, folder, indexes)
+	if err != nil {
+		return nil, err
+	}
+
+	expected_entries := map[string][]byte{}
+	for _, entry := range entries {
+		entry_bytes, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		expected_entries[entry.GetIdOrNil()] = entry_bytes
+	}
+
+	problems := []s.Problem{}
+	for _, index := range indexes {
+		iterator := s.IterateContext(ctx, storage, index.Id, s.IterateOptions{Recursive: true, IncludeDocuments: true})
+		for iterator.Next() {
+			entry_id := c.J(index.Id, iterator.Id())
+			expected_bytes, found := expected_entries[entry_id]
+			delete(expected_entries, entry_id)
+			if !found {
+				problems = append(problems, s.Problem{Kind: ProblemDanglingEntry, Id: entry_id, Detail: "no document gives the entry", Repair: "rebuild the index"})
+				continue
+			}
+			entry_bytes, err := json.Marshal(iterator.Document())
+			if err != nil {
+				iterator.Close()
+				return nil, err
+			}
+			if string(entry_bytes) != string(expected_bytes) {
+				problems = append(problems, s.Problem{Kind: ProblemStaleEntry, Id: entry_id, Detail: c.S("expected %s", expected_bytes), Repair: "rebuild the index"})
+			}
+		}
+		err = iterator.Err()
+		iterator.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	missing_ids := []string{}
+	for entry_id := range expected_entries {
+		missing_ids = append(missing_ids, entry_id)
+	}
+	sort.Strings(missing_ids)
+	for _, entry_id := range missing_ids {
+		problems = append(problems, s.Problem{Kind: ProblemMissingEntry, Id: entry_id, Detail: "entry not stored", Repair: "rebuild the index"})
+	}
+
+	return problems, nil
+}
+
+// Rebuild recomputes every index of the folder from its documents, like
+// after copying them without their index entries.
+func Rebuild(ctx context.Context, storage s.Storage, folder string) error {
+	return updateFolder(ctx, storage, folder)
+}
+
+func updateFolder(ctx context.Context, storage s.Storage, document_folder string) error {
+	indexes, err := load_indexes(ctx, storage, document_folder)
 	if err != nil {
 		return err
 	}
 
-	document_simple_ids, err := storage.List(document_folder)
+	entries, err := indexEntries(ctx, storage, document_folder, indexes)
 	if err != nil {
 		return err
 	}
 
 	for _, index := range indexes {
-		err = storage.DeleteFolder(index.Id)
+		err = s.DeleteFolderContext(ctx, storage, index.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		_, err = s.SetContext(ctx, storage, entry)
 		if err != nil {
 			return err
 		}
 	}
 
+	return nil
+}
+
+// indexEntries evaluates the indexes over the documents of the folder. When
+// two documents give the same entry id the last one wins.
+func indexEntries(ctx context.Context, storage s.Storage, document_folder string, indexes []Index) ([]c.Document, error) {
+	document_simple_ids, err := s.ListContext(ctx, storage, document_folder)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []c.Document{}
 	for _, document_simple_id := range document_simple_ids {
 		if strings.HasSuffix(document_simple_id, "/") {
 			continue
 		}
 		document_id := c.J(document_folder, document_simple_id)
-		document, err := storage.Get(document_id)
+		document, err := s.GetContext(ctx, storage, document_id)
 		if err != nil {
 			// TODO ya veremos que hacemos
-			return err
+			return nil, err
 		}
 
 		for _, index := range indexes {
-			evaluation_id, evaluation_content, err := evaluate(document, index.Func)
+			evaluation_id, evaluation_content, err := evaluate(ctx, document, index.Func)
 			if err != nil {
 				// TODO ya veremos que hacemos
-				return err
+				return nil, err
 			}
 			if evaluation_id == "" {
 				continue
 			}
 
-			evaluation_document_id := c.J(index.Id, evaluation_id)
+			// the key comes from user data, so it's escaped into a single
+			// segment
+			evaluation_document_id := index.Id + "/" + c.EscapeSegment(evaluation_id)
 			evaluation_content["id"] = evaluation_document_id
-
-			_, err = storage.Set(evaluation_content)
-			if err != nil {
-				return err
-			}
+			entries = append(entries, evaluation_content)
 		}
 	}
 
-	return nil
+	return entries, nil
 }
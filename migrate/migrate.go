@@ -0,0 +1,341 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	c "godb/common"
+	"godb/index"
+	s "godb/storage"
+)
+
+var ErrVerificationFailed = errors.New("migration verification failed")
+
+// Options tunes Migrate.
+type Options struct {
+	// Folder migrates only the documents inside it, everything when empty.
+	Folder string
+	// RebuildIndexes skips the index entries and recomputes them in the
+	// destination from the documents, instead of copying them.
+	RebuildIndexes bool
+	// BatchSize is how many documents are committed together, 100 by default.
+	BatchSize int
+	// Checkpoint is the path of a file where the progress is saved after each
+	// batch, so an interrupted migration resumes where it stopped. It's
+	// removed once the migration finishes, or fails its verification.
+	Checkpoint string
+	// Source and Destination identify the storages, like their uris. A
+	// checkpoint saved for other storages or another Folder is discarded
+	// instead of resumed.
+	Source      string
+	Destination string
+	// Verify compares the counts and checksums of both storages at the end.
+	Verify bool
+}
+
+type Report struct {
+	Copied   int
+	Deleted  int
+	Resumed  bool
+	Source   Summary
+	Target   Summary
+	Verified bool
+}
+
+// Summary is the count and checksum of the documents of a storage, as seen
+// by Summarize.
+type Summary struct {
+	Count    int
+	Checksum string
+}
+
+// checkpoint is the progress saved between batches. Ids are relative to the
+// migrated folder and copied in lexical order.
+type checkpoint struct {
+	Source         string   `json:"source"`
+	Destination    string   `json:"destination"`
+	Folder         string   `json:"folder"`
+	LastId         string   `json:"lastId"`
+	Copied         int      `json:"copied"`
+	IndexedFolders []string `json:"indexedFolders,omitempty"`
+}
+
+// Migrate copies the documents of source into destination. Documents already
+// in destination are overwritten and those missing in source are deleted, so
+// a migration can be run again to catch the changes made to source meanwhile.
+func Migrate(ctx context.Context, source s.Storage, destination s.Storage, options Options) (Report, error) {
+	report := Report{}
+	if options.BatchSize <= 0 {
+		options.BatchSize = 100
+	}
+	folder := strings.Trim(options.Folder, "/")
+
+	progress, err := readCheckpoint(options.Checkpoint)
+	if err != nil {
+		return report, err
+	}
+	if progress.Source != options.Source || progress.Destination != options.Destination || progress.Folder != folder {
+		progress = checkpoint{Source: options.Source, Destination: options.Destination, Folder: folder}
+	}
+	report.Resumed = progress.LastId != ""
+
+	indexed_folders := map[string]bool{}
+	for _, indexed_folder := range progress.IndexedFolders {
+		indexed_folders[indexed_folder] = true
+	}
+
+	iterator := s.IterateContext(ctx, source, folder, s.IterateOptions{
+		Recursive:        true,
+		StartAfter:       progress.LastId,
+		IncludeDocuments: true,
+	})
+	defer iterator.Close()
+
+	operations := []s.Operation{}
+	flush := func() error {
+		if len(operations) == 0 {
+			return nil
+		}
+		err := s.CommitContext(ctx, destination, operations)
+		if err != nil {
+			return err
+		}
+		progress.Copied += len(operations)
+		operations = operations[:0]
+
+		progress.IndexedFolders = progress.IndexedFolders[:0]
+		for indexed_folder := range indexed_folders {
+			progress.IndexedFolders = append(progress.IndexedFolders, indexed_folder)
+		}
+		return writeCheckpoint(options.Checkpoint, progress)
+	}
+
+	for iterator.Next() {
+		document_id := join(folder, iterator.Id())
+		if options.RebuildIndexes {
+			if isIndexEntry(document_id) {
+				progress.LastId = iterator.Id()
+				continue
+			}
+			if indexes_folder := c.Folder(document_id); isIndexesFolder(indexes_folder) {
+				indexed_folders[c.Folder(indexes_folder)] = true
+			}
+		}
+
+		operations = append(operations, s.Operation{Type: s.OperationSet, Document: iterator.Document()})
+		progress.LastId = iterator.Id()
+		if len(operations) >= options.BatchSize {
+			err = flush()
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+	if err := iterator.Err(); err != nil {
+		return report, err
+	}
+	err = flush()
+	if err != nil {
+		return report, err
+	}
+	report.Copied = progress.Copied
+
+	report.Deleted, err = prune(ctx, source, destination, folder, options)
+	if err != nil {
+		return report, err
+	}
+
+	for indexed_folder := range indexed_folders {
+		err = index.Rebuild(ctx, destination, indexed_folder)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if options.Verify {
+		report.Source, err = Summarize(ctx, source, folder, options.RebuildIndexes)
+		if err != nil {
+			return report, err
+		}
+		report.Target, err = Summarize(ctx, destination, folder, options.RebuildIndexes)
+		if err != nil {
+			return report, err
+		}
+		if report.Source != report.Target {
+			// the copy is wrong somewhere, so the next run starts over
+			err = removeCheckpoint(options.Checkpoint)
+			if err != nil {
+				return report, err
+			}
+			return report, fmt.Errorf("%w: source has %d documents (%s) but destination %d (%s)", ErrVerificationFailed,
+				report.Source.Count, report.Source.Checksum, report.Target.Count, report.Target.Checksum)
+		}
+		report.Verified = true
+	}
+
+	return report, removeCheckpoint(options.Checkpoint)
+}
+
+// prune deletes the documents of the destination folder missing in source,
+// walking both in lexical order. With RebuildIndexes the index entries are
+// left to the rebuild.
+func prune(ctx context.Context, source s.Storage, destination s.Storage, folder string, options Options) (int, error) {
+	source_iterator := s.IterateContext(ctx, source, folder, s.IterateOptions{Recursive: true})
+	defer source_iterator.Close()
+	destination_iterator := s.IterateContext(ctx, destination, folder, s.IterateOptions{Recursive: true})
+	defer destination_iterator.Close()
+
+	// deleted once both are walked, so the destination doesn't change under
+	// its iterator
+	operations := []s.Operation{}
+	has_source := source_iterator.Next()
+	for destination_iterator.Next() {
+		destination_id := destination_iterator.Id()
+		for has_source && source_iterator.Id() < destination_id {
+			has_source = source_iterator.Next()
+		}
+		if has_source && source_iterator.Id() == destination_id {
+			continue
+		}
+		document_id := join(folder, destination_id)
+		if options.RebuildIndexes && isIndexEntry(document_id) {
+			continue
+		}
+		operations = append(operations, s.Operation{Type: s.OperationDelete, Id: document_id})
+	}
+	if err := source_iterator.Err(); err != nil {
+		return 0, err
+	}
+	if err := destination_iterator.Err(); err != nil {
+		return 0, err
+	}
+
+	for start := 0; start < len(operations); start += options.BatchSize {
+		end := start + options.BatchSize
+		if end > len(operations) {
+			end = len(operations)
+		}
+		err := s.CommitContext(ctx, destination, operations[start:end])
+		if err != nil {
+			return start, err
+		}
+	}
+
+	return len(operations), nil
+}
+
+// Summarize counts the documents of the folder and hashes them, with their
+// ids, in lexical order. The index entries are left out when skipIndexes.
+func Summarize(ctx context.Context, storage s.Storage, folder string, skipIndexes bool) (Summary, error) {
+	folder = strings.Trim(folder, "/")
+	summary := Summary{}
+	hash := sha256.New()
+
+	iterator := s.IterateContext(ctx, storage, folder, s.IterateOptions{Recursive: true, IncludeDocuments: true})
+	defer iterator.Close()
+	for iterator.Next() {
+		document_id := join(folder, iterator.Id())
+		if skipIndexes && isIndexEntry(document_id) {
+			continue
+		}
+
+		// json sorts the keys and writes every number the same way, whatever
+		// the codec decoded them as
+		document_bytes, err := json.Marshal(iterator.Document())
+		if err != nil {
+			return summary, err
+		}
+		hash.Write([]byte(document_id))
+		hash.Write([]byte{0})
+		hash.Write(document_bytes)
+		hash.Write([]byte{0})
+		summary.Count++
+	}
+	if err := iterator.Err(); err != nil {
+		return summary, err
+	}
+	summary.Checksum = hex.EncodeToString(hash.Sum(nil))
+
+	return summary, nil
+}
+
+// isIndexEntry is true for the documents computed by an index, those inside
+// "<folder>/_indexes/<index>/".
+func isIndexEntry(id string) bool {
+	segments := strings.Split(id, "/")
+	for i := 0; i < len(segments)-2; i++ {
+		if segments[i] == "_indexes" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isIndexesFolder(folder string) bool {
+	return folder == "_indexes" || strings.HasSuffix(folder, "/_indexes")
+}
+
+func join(folder string, id string) string {
+	if folder == "" {
+		return id
+	}
+
+	return folder + "/" + id
+}
+
+func readCheckpoint(path string) (checkpoint, error) {
+	progress := checkpoint{}
+	if path == "" {
+		return progress, nil
+	}
+
+	checkpoint_bytes, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return progress, nil
+	}
+	if err != nil {
+		return progress, err
+	}
+	err = json.Unmarshal(checkpoint_bytes, &progress)
+
+	return progress, err
+}
+
+func removeCheckpoint(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// writeCheckpoint replaces the checkpoint atomically, so an interruption
+// leaves either the previous one or the new one.
+func writeCheckpoint(path string, progress checkpoint) error {
+	if path == "" {
+		return nil
+	}
+
+	checkpoint_bytes, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path+".tmp", checkpoint_bytes, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
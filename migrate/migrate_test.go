@@ -0,0 +1,177 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	c "godb/common"
+	"godb/godb"
+	s "godb/storage"
+)
+
+func Test_MigrateRebuildsIndexesAndVerifies(t *testing.T) {
+	source := &s.FileStorage{Root: t.TempDir()}
+	source_godb := godb.NewGodb(source)
+	_, err := source_godb.Set(c.NewDocument("movies/_indexes/by_name", "func", "(doc) => ([doc.name, {id: doc.id}])"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	for _, name := range []string{"Matrix", "Alien", "Superman"} {
+		_, err := source_godb.Set(c.NewDocument("movies/"+name, "name", name))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+	_, err = source_godb.Set(c.NewDocument("users/john", "name", "John"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	destination := &s.MemoryStorage{}
+	report, err := Migrate(context.Background(), source, destination, Options{RebuildIndexes: true, Verify: true})
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if report.Copied != 5 || !report.Verified || report.Source.Count != 5 {
+		t.Fatalf("expected 5 verified documents to be copied but got %+v", report)
+	}
+
+	ids, err := godb.NewGodb(destination).List("movies/_indexes/by_name")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !reflect.DeepEqual(ids, []string{"Alien", "Matrix", "Superman"}) {
+		t.Fatalf("expected the index to be rebuilt but got %s", ids)
+	}
+
+	_, err = destination.Set(c.NewDocument("users/john", "name", "Johnny"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	source_summary, err := Summarize(context.Background(), source, "", false)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	destination_summary, err := Summarize(context.Background(), destination, "", false)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if source_summary.Count != destination_summary.Count || source_summary.Checksum == destination_summary.Checksum {
+		t.Fatalf("expected only the checksums to differ but got %+v and %+v", source_summary, destination_summary)
+	}
+}
+
+func Test_MigrateResumesFromCheckpoint(t *testing.T) {
+	source := &s.MemoryStorage{}
+	for _, id := range []string{"a/1", "a/2", "b/1", "b/2", "c"} {
+		_, err := source.Set(c.NewDocument(id, "value", id))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+
+	backend := &s.MemoryStorage{}
+	destination := &s.FaultStorage{
+		Backend: backend,
+		Rules:   []s.FaultRule{{Operations: []string{"commit"}, Nth: 2, Crash: true}},
+	}
+	checkpoint := filepath.Join(t.TempDir(), "migration.json")
+	options := Options{BatchSize: 2, Checkpoint: checkpoint, Verify: true}
+
+	_, err := Migrate(context.Background(), source, destination, options)
+	if !errors.Is(err, s.ErrInjectedFault) {
+		t.Fatalf("expected error '%s' but got '%v'", s.ErrInjectedFault, err)
+	}
+	ids, err := backend.List("")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !reflect.DeepEqual(ids, []string{"a/"}) {
+		t.Fatalf("expected only the first batch to be copied but got %s", ids)
+	}
+
+	destination.Recover()
+	report, err := Migrate(context.Background(), source, destination, options)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !report.Resumed || report.Copied != 5 || !report.Verified {
+		t.Fatalf("expected the migration to resume and copy 5 documents but got %+v", report)
+	}
+	_, err = os.Stat(checkpoint)
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected the checkpoint to be removed but got '%v'", err)
+	}
+}
+
+// lossyStorage drops the documents with the id, as if they had been lost on
+// the way.
+type lossyStorage struct {
+	*s.MemoryStorage
+	lostId string
+}
+
+func (ls lossyStorage) Commit(operations []s.Operation) error {
+	kept_operations := []s.Operation{}
+	for _, operation := range operations {
+		if operation.Type != s.OperationSet || operation.Document.GetIdOrNil() != ls.lostId {
+			kept_operations = append(kept_operations, operation)
+		}
+	}
+
+	return ls.MemoryStorage.Commit(kept_operations)
+}
+
+func Test_MigrateMirrorsTheSourceAndDiscardsStaleCheckpoints(t *testing.T) {
+	source := &s.MemoryStorage{}
+	for _, id := range []string{"a/1", "a/2", "c"} {
+		_, err := source.Set(c.NewDocument(id, "value", id))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+	destination := &s.MemoryStorage{}
+	for _, id := range []string{"a/0", "a/3", "b/1"} {
+		_, err := destination.Set(c.NewDocument(id, "value", id))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+
+	// left by a migration of other storages, it would skip everything
+	checkpoint := filepath.Join(t.TempDir(), "migration.json")
+	err := os.WriteFile(checkpoint, []byte(`{"source":"mem:other","destination":"mem:b","lastId":"z"}`), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	options := Options{Checkpoint: checkpoint, Verify: true, Source: "mem:a", Destination: "mem:b"}
+
+	report, err := Migrate(context.Background(), source, destination, options)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if report.Resumed || report.Copied != 3 || report.Deleted != 3 || !report.Verified {
+		t.Fatalf("expected 3 documents to be copied and 3 deleted but got %+v", report)
+	}
+	ids, err := destination.List("a")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !reflect.DeepEqual(ids, []string{"1", "2"}) {
+		t.Fatalf("expected the documents missing in the source to be deleted but got %s", ids)
+	}
+
+	options.BatchSize = 1
+	_, err = Migrate(context.Background(), source, lossyStorage{&s.MemoryStorage{}, "c"}, options)
+	if !errors.Is(err, ErrVerificationFailed) {
+		t.Fatalf("expected error '%s' but got '%v'", ErrVerificationFailed, err)
+	}
+	_, err = os.Stat(checkpoint)
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected the checkpoint to be removed after the failed verification but got '%v'", err)
+	}
+}
@@ -1,16 +1,30 @@
 package main
 
 import (
+	"flag"
+	"os"
+
 	"godb/http"
 	logs "godb/logs"
+	s "godb/storage"
+
+	_ "modernc.org/sqlite"
 )
 
 func main() {
+	addr := flag.String("addr", "localhost:5001", "address to listen at")
+	storageURI := flag.String("storage", "file:_data", "uri of the storage, like file:///var/godb, mem:// or sqlite:///var/godb.db?cache=1000")
+	flag.Parse()
+
 	logs.Initialize()
 
-	addr := "localhost:5001"
-	api := http.NewHttpJsonApi("_data")
-	logs.Info("HttpJsonApi listening at %s\n", addr)
+	storage, err := s.Open(*storageURI)
+	if err != nil {
+		logs.Error(err, "storage")
+		os.Exit(1)
+	}
+	api := http.NewHttpJsonApi(storage)
+	logs.Info("HttpJsonApi listening at %s\n", *addr)
 
-	api.Start(addr)
+	api.Start(*addr)
 }
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	c "godb/common"
+)
+
+var (
+	ErrAttachmentsNotSupported = errors.New("storage does not support attachments")
+	ErrAttachmentNotStaged     = errors.New("attachment not staged")
+)
+
+// AttachmentStorage is implemented by the storages that can keep binary
+// attachments, by name, under their documents. The content is streamed
+// instead of held in memory, and it's deleted along with its document, or
+// its folder. Attachments can only be put under existing documents.
+//
+// PutAttachment can also be done in two steps, to stream the content without
+// holding any lock: StageAttachment streams it to a staged name, unseen, and
+// CommitAttachment puts it in place, or DiscardAttachment removes it.
+type AttachmentStorage interface {
+	PutAttachment(id, name string, content io.Reader) error
+	// StageAttachment returns the staged name of the content, for
+	// CommitAttachment or DiscardAttachment.
+	StageAttachment(id, name string, content io.Reader) (string, error)
+	CommitAttachment(id, name, staged string) error
+	DiscardAttachment(id, staged string) error
+	// GetAttachment fails with c.ErrAttachmentDoesNotExist when missing.
+	GetAttachment(id, name string) (io.ReadSeekCloser, error)
+	DeleteAttachment(id, name string) error
+	// ListAttachments returns the names of the attachments, sorted.
+	ListAttachments(id string) ([]string, error)
+}
+
+// PutAttachment stores the attachment when the storage supports them, and
+// fails with ErrAttachmentsNotSupported otherwise.
+func PutAttachment(storage Storage, id, name string, content io.Reader) error {
+	attachment_storage, ok := storage.(AttachmentStorage)
+	if !ok {
+		return ErrAttachmentsNotSupported
+	}
+
+	return attachment_storage.PutAttachment(id, name, content)
+}
+
+func StageAttachment(storage Storage, id, name string, content io.Reader) (string, error) {
+	attachment_storage, ok := storage.(AttachmentStorage)
+	if !ok {
+		return "", ErrAttachmentsNotSupported
+	}
+
+	return attachment_storage.StageAttachment(id, name, content)
+}
+
+func CommitAttachment(storage Storage, id, name, staged string) error {
+	attachment_storage, ok := storage.(AttachmentStorage)
+	if !ok {
+		return ErrAttachmentsNotSupported
+	}
+
+	return attachment_storage.CommitAttachment(id, name, staged)
+}
+
+func DiscardAttachment(storage Storage, id, staged string) error {
+	attachment_storage, ok := storage.(AttachmentStorage)
+	if !ok {
+		return ErrAttachmentsNotSupported
+	}
+
+	return attachment_storage.DiscardAttachment(id, staged)
+}
+
+func GetAttachment(storage Storage, id, name string) (io.ReadSeekCloser, error) {
+	attachment_storage, ok := storage.(AttachmentStorage)
+	if !ok {
+		return nil, ErrAttachmentsNotSupported
+	}
+
+	return attachment_storage.GetAttachment(id, name)
+}
+
+func DeleteAttachment(storage Storage, id, name string) error {
+	attachment_storage, ok := storage.(AttachmentStorage)
+	if !ok {
+		return ErrAttachmentsNotSupported
+	}
+
+	return attachment_storage.DeleteAttachment(id, name)
+}
+
+func ListAttachments(storage Storage, id string) ([]string, error) {
+	attachment_storage, ok := storage.(AttachmentStorage)
+	if !ok {
+		return nil, ErrAttachmentsNotSupported
+	}
+
+	return attachment_storage.ListAttachments(id)
+}
+
+// validateAttachment fails with c.ErrInvalidId for invalid ids and for names
+// that aren't a valid single segment.
+func validateAttachment(id, name string) error {
+	err := c.ValidateId(id)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(name, "/") {
+		return c.ErrInvalidId
+	}
+
+	return c.ValidateId(name)
+}
@@ -0,0 +1,941 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	c "godb/common"
+)
+
+const (
+	btreePageSize   = 4096
+	btreeMagic      = 0x474f4442 // "GODB"
+	btreeVersion    = 1
+	btreeHeaderSize = 12
+
+	btreePageLeaf     = 1
+	btreePageBranch   = 2
+	btreePageFreelist = 3
+)
+
+var ErrCorruptedFile = errors.New("corrupted file")
+
+// BTreeStorage keeps the whole database in a single file, as a B+tree of
+// pages ordered by id. Writes never modify the pages in use: the changed
+// nodes are written to free pages and the commit is made visible by writing
+// one of the two meta pages, which alternate between transactions. On open
+// the valid meta page with the highest transaction id is used.
+//
+// Page layout: type (1 byte) + padding (3) + overflow pages (4) + elements
+// count (4), followed by the elements. Nodes bigger than a page continue on
+// the following overflow pages.
+type BTreeStorage struct {
+	Storage
+	Path       string
+	Durability Durability
+
+	mutex    sync.RWMutex
+	openOnce sync.Once
+	openErr  error
+	file     *os.File
+	meta     btreeMeta
+	free     []uint64
+}
+
+type btreeMeta struct {
+	txid      uint64
+	root      uint64
+	freelist  uint64
+	pageCount uint64
+}
+
+type btreeNode struct {
+	leaf     bool
+	keys     []string
+	values   [][]byte
+	children []btreeRef
+	pgid     uint64
+	overflow uint32
+}
+
+// btreeRef points to a node, either stored in a page or, when it's been
+// modified by the transaction, kept in memory.
+type btreeRef struct {
+	pgid uint64
+	node *btreeNode
+}
+
+type btreeTx struct {
+	bs      *BTreeStorage
+	meta    btreeMeta
+	root    btreeRef
+	free    []uint64
+	pending []uint64
+}
+
+func (bs *BTreeStorage) Get(id string) (c.Document, error) {
+	tx, err := bs.readTx()
+	if err != nil {
+		return nil, err
+	}
+	defer bs.mutex.RUnlock()
+
+	return tx.getDocument(id)
+}
+
+func (bs *BTreeStorage) Set(document c.Document) (c.Document, error) {
+	err := bs.Commit([]Operation{{Type: OperationSet, Document: document}})
+	if err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+func (bs *BTreeStorage) Patch(document c.Document) (c.Document, error) {
+	document_id, err := document.GetId()
+	if err != nil {
+		return nil, err
+	}
+
+	var patched_document c.Document
+	err = bs.update(func(tx *btreeTx) error {
+		existing_document, err := tx.getDocument(document_id)
+		if err != nil {
+			if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+				return err
+			}
+			existing_document = c.NewDocument(document_id)
+		}
+		existing_document.Patch(document)
+		patched_document = existing_document
+
+		return tx.putDocument(existing_document)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return patched_document, nil
+}
+
+func (bs *BTreeStorage) Exists(id string) (bool, error) {
+	tx, err := bs.readTx()
+	if err != nil {
+		return false, err
+	}
+	defer bs.mutex.RUnlock()
+
+	_, found, err := tx.get(id)
+
+	return found, err
+}
+
+// List walks the ids of the folder in order, skipping the content of the
+// subfolders by seeking past them.
+func (bs *BTreeStorage) List(folder string) ([]string, error) {
+	tx, err := bs.readTx()
+	if err != nil {
+		return nil, err
+	}
+	defer bs.mutex.RUnlock()
+
+	prefix := folderPrefix(folder)
+	simple_ids := []string{}
+	start := prefix
+	for {
+		key, found, err := tx.seek(tx.root, start)
+		if err != nil {
+			return nil, err
+		}
+		if !found || !strings.HasPrefix(key, prefix) {
+			break
+		}
+
+		relative_id := key[len(prefix):]
+		slash := strings.Index(relative_id, "/")
+		if slash == -1 {
+			simple_ids = append(simple_ids, relative_id)
+			start = key + "\x00"
+		} else {
+			simple_ids = append(simple_ids, relative_id[:slash+1])
+			// "0" is the character right after "/"
+			start = prefix + relative_id[:slash] + "0"
+		}
+	}
+
+	return simple_ids, nil
+}
+
+func (bs *BTreeStorage) Delete(id string) error {
+	return bs.update(func(tx *btreeTx) error {
+		removed, err := tx.delete(id)
+		if err != nil {
+			return err
+		}
+		if !removed {
+			return c.ErrDocumentDoestNotExist
+		}
+
+		return nil
+	})
+}
+
+func (bs *BTreeStorage) DeleteFolder(folder string) error {
+	return bs.update(func(tx *btreeTx) error {
+		return tx.deleteFolder(folder)
+	})
+}
+
+func (bs *BTreeStorage) Commit(operations []Operation) error {
+	return bs.update(func(tx *btreeTx) error {
+		for _, operation := range operations {
+			var err error
+			switch operation.Type {
+			case OperationSet:
+				err = tx.putDocument(operation.Document)
+			case OperationDelete:
+				_, err = tx.delete(operation.Id)
+			case OperationDeleteFolder:
+				err = tx.deleteFolder(operation.Id)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (bs *BTreeStorage) Close() error {
+	err := bs.ensureOpen()
+	if err != nil {
+		return err
+	}
+
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	bs.openErr = errors.New("btree storage closed")
+
+	return bs.file.Close()
+}
+
+// readTx returns a transaction over the last commit holding the read lock,
+// which the caller must release.
+func (bs *BTreeStorage) readTx() (*btreeTx, error) {
+	err := bs.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	bs.mutex.RLock()
+	if bs.openErr != nil {
+		bs.mutex.RUnlock()
+		return nil, bs.openErr
+	}
+
+	return &btreeTx{bs: bs, meta: bs.meta, root: btreeRef{pgid: bs.meta.root}}, nil
+}
+
+// update runs f in a write transaction that's committed if f succeeds.
+func (bs *BTreeStorage) update(f func(tx *btreeTx) error) error {
+	err := bs.ensureOpen()
+	if err != nil {
+		return err
+	}
+
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	if bs.openErr != nil {
+		return bs.openErr
+	}
+
+	tx := &btreeTx{
+		bs:   bs,
+		meta: bs.meta,
+		root: btreeRef{pgid: bs.meta.root},
+		free: append([]uint64{}, bs.free...),
+	}
+	err = f(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.commit()
+}
+
+func (bs *BTreeStorage) ensureOpen() error {
+	bs.openOnce.Do(func() {
+		bs.openErr = bs.open()
+	})
+
+	return bs.openErr
+}
+
+func (bs *BTreeStorage) open() error {
+	err := os.MkdirAll(filepath.Dir(bs.Path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	bs.file, err = os.OpenFile(bs.Path, os.O_CREATE|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	info, err := bs.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return bs.initialize()
+	}
+
+	found := false
+	for _, pgid := range []uint64{0, 1} {
+		page := make([]byte, btreePageSize)
+		_, err = bs.file.ReadAt(page, int64(pgid)*btreePageSize)
+		if err != nil {
+			continue
+		}
+		meta, ok := decodeMeta(page)
+		if ok && (!found || meta.txid > bs.meta.txid) {
+			bs.meta = meta
+			found = true
+		}
+	}
+	if !found {
+		return ErrCorruptedFile
+	}
+
+	tx := &btreeTx{bs: bs}
+	freelist, err := tx.readNode(bs.meta.freelist)
+	if err != nil {
+		return err
+	}
+	bs.free = freelistPages(freelist)
+
+	return nil
+}
+
+// initialize writes an empty tree to a new file.
+func (bs *BTreeStorage) initialize() error {
+	tx := &btreeTx{
+		bs:   bs,
+		meta: btreeMeta{txid: 0, pageCount: 2},
+		root: btreeRef{node: &btreeNode{leaf: true}},
+	}
+	err := tx.commit()
+	if err != nil {
+		return err
+	}
+
+	// write the same meta on both pages so the file is valid from the start
+	tx.meta.txid++
+	return tx.writeMeta()
+}
+
+func (tx *btreeTx) getDocument(id string) (c.Document, error) {
+	value, found, err := tx.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, c.ErrDocumentDoestNotExist
+	}
+
+	document := c.Document{}
+	err = json.Unmarshal(value, &document)
+
+	return document, err
+}
+
+func (tx *btreeTx) putDocument(document c.Document) error {
+	document_id, err := document.GetId()
+	if err != nil {
+		return err
+	}
+	if document_id == "" {
+		return c.ErrInvalidId
+	}
+
+	value, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+
+	return tx.put(document_id, value)
+}
+
+func (tx *btreeTx) get(key string) ([]byte, bool, error) {
+	ref := tx.root
+	for {
+		n, err := tx.load(ref)
+		if err != nil {
+			return nil, false, err
+		}
+		if n.leaf {
+			i := sort.SearchStrings(n.keys, key)
+			if i < len(n.keys) && n.keys[i] == key {
+				return n.values[i], true, nil
+			}
+			return nil, false, nil
+		}
+		if len(n.children) == 0 {
+			return nil, false, nil
+		}
+		ref = n.children[childIndex(n.keys, key)]
+	}
+}
+
+// seek returns the first key equal or greater than start.
+func (tx *btreeTx) seek(ref btreeRef, start string) (string, bool, error) {
+	n, err := tx.load(ref)
+	if err != nil {
+		return "", false, err
+	}
+
+	if n.leaf {
+		i := sort.SearchStrings(n.keys, start)
+		if i < len(n.keys) {
+			return n.keys[i], true, nil
+		}
+		return "", false, nil
+	}
+
+	for i := childIndex(n.keys, start); i < len(n.children); i++ {
+		key, found, err := tx.seek(n.children[i], start)
+		if err != nil || found {
+			return key, found, err
+		}
+	}
+
+	return "", false, nil
+}
+
+func (tx *btreeTx) put(key string, value []byte) error {
+	refs, err := tx.putInto(tx.root, key, value)
+	if err != nil {
+		return err
+	}
+
+	// grow the tree while the root keeps splitting
+	for len(refs) > 1 {
+		root := &btreeNode{}
+		for _, ref := range refs {
+			root.keys = append(root.keys, ref.node.keys[0])
+			root.children = append(root.children, ref)
+		}
+		refs = []btreeRef{}
+		for _, part := range root.split() {
+			refs = append(refs, btreeRef{node: part})
+		}
+	}
+	tx.root = refs[0]
+
+	return nil
+}
+
+// putInto inserts the key into the subtree, returning the nodes replacing it,
+// which are more than one when it had to be split.
+func (tx *btreeTx) putInto(ref btreeRef, key string, value []byte) ([]btreeRef, error) {
+	n, err := tx.load(ref)
+	if err != nil {
+		return nil, err
+	}
+	tx.touch(n)
+
+	if n.leaf {
+		i := sort.SearchStrings(n.keys, key)
+		if i < len(n.keys) && n.keys[i] == key {
+			n.values[i] = value
+		} else {
+			n.keys = append(n.keys[:i], append([]string{key}, n.keys[i:]...)...)
+			n.values = append(n.values[:i], append([][]byte{value}, n.values[i:]...)...)
+		}
+	} else if len(n.children) == 0 {
+		leaf := &btreeNode{leaf: true, keys: []string{key}, values: [][]byte{value}}
+		n.keys = []string{key}
+		n.children = []btreeRef{{node: leaf}}
+	} else {
+		i := childIndex(n.keys, key)
+		refs, err := tx.putInto(n.children[i], key, value)
+		if err != nil {
+			return nil, err
+		}
+		keys := []string{}
+		for _, ref := range refs {
+			keys = append(keys, ref.node.keys[0])
+		}
+		n.keys = append(n.keys[:i], append(keys, n.keys[i+1:]...)...)
+		n.children = append(n.children[:i], append(refs, n.children[i+1:]...)...)
+	}
+
+	refs := []btreeRef{}
+	for _, part := range n.split() {
+		refs = append(refs, btreeRef{node: part})
+	}
+
+	return refs, nil
+}
+
+func (tx *btreeTx) delete(key string) (bool, error) {
+	ref, removed, err := tx.deleteFrom(tx.root, key)
+	if err != nil || !removed {
+		return removed, err
+	}
+
+	// collapse the branches left with a single child
+	for {
+		n, err := tx.load(ref)
+		if err != nil {
+			return false, err
+		}
+		if n.leaf || len(n.children) > 1 {
+			break
+		}
+		tx.touch(n)
+		if len(n.children) == 0 {
+			ref = btreeRef{node: &btreeNode{leaf: true}}
+			break
+		}
+		ref = n.children[0]
+	}
+	tx.root = ref
+
+	return true, nil
+}
+
+func (tx *btreeTx) deleteFrom(ref btreeRef, key string) (btreeRef, bool, error) {
+	n, err := tx.load(ref)
+	if err != nil {
+		return ref, false, err
+	}
+
+	if n.leaf {
+		i := sort.SearchStrings(n.keys, key)
+		if i == len(n.keys) || n.keys[i] != key {
+			return ref, false, nil
+		}
+		tx.touch(n)
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.values = append(n.values[:i], n.values[i+1:]...)
+
+		return btreeRef{node: n}, true, nil
+	}
+
+	if len(n.children) == 0 {
+		return ref, false, nil
+	}
+	i := childIndex(n.keys, key)
+	child, removed, err := tx.deleteFrom(n.children[i], key)
+	if err != nil || !removed {
+		return ref, removed, err
+	}
+
+	tx.touch(n)
+	if len(child.node.keys) == 0 {
+		tx.touch(child.node)
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.children = append(n.children[:i], n.children[i+1:]...)
+	} else {
+		n.keys[i] = child.node.keys[0]
+		n.children[i] = child
+	}
+
+	return btreeRef{node: n}, true, nil
+}
+
+func (tx *btreeTx) deleteFolder(folder string) error {
+	prefix := folderPrefix(folder)
+	keys := []string{}
+	start := prefix
+	for {
+		key, found, err := tx.seek(tx.root, start)
+		if err != nil {
+			return err
+		}
+		if !found || !strings.HasPrefix(key, prefix) {
+			break
+		}
+		keys = append(keys, key)
+		start = key + "\x00"
+	}
+
+	for _, key := range keys {
+		_, err := tx.delete(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// load returns the node of the reference, reading it from its page when it
+// isn't in memory.
+func (tx *btreeTx) load(ref btreeRef) (*btreeNode, error) {
+	if ref.node != nil {
+		return ref.node, nil
+	}
+
+	return tx.readNode(ref.pgid)
+}
+
+// touch marks the node as modified, releasing its pages once committed.
+func (tx *btreeTx) touch(n *btreeNode) {
+	if n.pgid == 0 {
+		return
+	}
+	for i := uint64(0); i <= uint64(n.overflow); i++ {
+		tx.pending = append(tx.pending, n.pgid+i)
+	}
+	n.pgid = 0
+}
+
+func (tx *btreeTx) commit() error {
+	root, err := tx.write(tx.root)
+	if err != nil {
+		return err
+	}
+
+	if tx.meta.freelist != 0 {
+		old_freelist, err := tx.readNode(tx.meta.freelist)
+		if err != nil {
+			return err
+		}
+		tx.touch(old_freelist)
+	}
+
+	// the pages of the freelist are taken before listing the free ones, which
+	// can only make the list shorter than the room reserved for it
+	reserved_size := btreeHeaderSize + 8*(len(tx.free)+len(tx.pending))
+	freelist_pgid := tx.allocate(pageCount(reserved_size))
+	free := append(append([]uint64{}, tx.free...), tx.pending...)
+	sort.Slice(free, func(i, j int) bool {
+		return free[i] < free[j]
+	})
+	_, err = tx.bs.file.WriteAt(encodeFreelist(free, pageCount(reserved_size)), int64(freelist_pgid)*btreePageSize)
+	if err != nil {
+		return err
+	}
+
+	err = tx.sync()
+	if err != nil {
+		return err
+	}
+
+	tx.meta.txid++
+	tx.meta.root = root
+	tx.meta.freelist = freelist_pgid
+	err = tx.writeMeta()
+	if err != nil {
+		return err
+	}
+
+	tx.bs.meta = tx.meta
+	tx.bs.free = free
+
+	return nil
+}
+
+func (tx *btreeTx) writeMeta() error {
+	_, err := tx.bs.file.WriteAt(encodeMeta(tx.meta), int64(tx.meta.txid%2)*btreePageSize)
+	if err != nil {
+		return err
+	}
+
+	return tx.sync()
+}
+
+func (tx *btreeTx) sync() error {
+	if tx.bs.Durability == DurabilityNone {
+		return nil
+	}
+
+	return tx.bs.file.Sync()
+}
+
+// write stores the modified nodes of the subtree in new pages, returning the
+// page of its root.
+func (tx *btreeTx) write(ref btreeRef) (uint64, error) {
+	if ref.node == nil || ref.node.pgid != 0 {
+		if ref.node != nil {
+			return ref.node.pgid, nil
+		}
+		return ref.pgid, nil
+	}
+
+	n := ref.node
+	for i, child := range n.children {
+		pgid, err := tx.write(child)
+		if err != nil {
+			return 0, err
+		}
+		n.children[i] = btreeRef{pgid: pgid}
+	}
+
+	data := n.encode()
+	pages := pageCount(len(data))
+	pgid := tx.allocate(pages)
+	_, err := tx.bs.file.WriteAt(data, int64(pgid)*btreePageSize)
+	if err != nil {
+		return 0, err
+	}
+	n.pgid = pgid
+	n.overflow = uint32(pages - 1)
+
+	return pgid, nil
+}
+
+// allocate returns the first page of a run of free contiguous pages, growing
+// the file when there's none.
+func (tx *btreeTx) allocate(pages uint64) uint64 {
+	run := uint64(0)
+	for i, pgid := range tx.free {
+		if i > 0 && tx.free[i-1]+1 == pgid {
+			run++
+		} else {
+			run = 1
+		}
+		if run == pages {
+			start := i + 1 - int(pages)
+			first := tx.free[start]
+			tx.free = append(tx.free[:start], tx.free[i+1:]...)
+			return first
+		}
+	}
+
+	pgid := tx.meta.pageCount
+	tx.meta.pageCount += pages
+
+	return pgid
+}
+
+func (tx *btreeTx) readNode(pgid uint64) (*btreeNode, error) {
+	page := make([]byte, btreePageSize)
+	_, err := tx.bs.file.ReadAt(page, int64(pgid)*btreePageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	overflow := binary.BigEndian.Uint32(page[4:8])
+	if overflow > 0 {
+		page = make([]byte, btreePageSize*(1+int(overflow)))
+		_, err = tx.bs.file.ReadAt(page, int64(pgid)*btreePageSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	n, err := decodeNode(page)
+	if err != nil {
+		return nil, err
+	}
+	n.pgid = pgid
+	n.overflow = overflow
+
+	return n, nil
+}
+
+// split divides the node in halves until each of them fits in a page, or
+// can't be divided anymore.
+func (n *btreeNode) split() []*btreeNode {
+	if len(n.keys) < 2 || n.size() <= btreePageSize {
+		return []*btreeNode{n}
+	}
+
+	middle := len(n.keys) / 2
+	left := &btreeNode{leaf: n.leaf, keys: n.keys[:middle:middle]}
+	right := &btreeNode{leaf: n.leaf, keys: append([]string{}, n.keys[middle:]...)}
+	if n.leaf {
+		left.values = n.values[:middle:middle]
+		right.values = append([][]byte{}, n.values[middle:]...)
+	} else {
+		left.children = n.children[:middle:middle]
+		right.children = append([]btreeRef{}, n.children[middle:]...)
+	}
+
+	return append(left.split(), right.split()...)
+}
+
+func (n *btreeNode) size() int {
+	size := btreeHeaderSize
+	for i, key := range n.keys {
+		if n.leaf {
+			size += 8 + len(key) + len(n.values[i])
+		} else {
+			size += 12 + len(key)
+		}
+	}
+
+	return size
+}
+
+func (n *btreeNode) encode() []byte {
+	data := make([]byte, pageCount(n.size())*btreePageSize)
+	data[0] = btreePageBranch
+	if n.leaf {
+		data[0] = btreePageLeaf
+	}
+	binary.BigEndian.PutUint32(data[4:8], uint32(pageCount(n.size())-1))
+	binary.BigEndian.PutUint32(data[8:12], uint32(len(n.keys)))
+
+	offset := btreeHeaderSize
+	for i, key := range n.keys {
+		binary.BigEndian.PutUint32(data[offset:], uint32(len(key)))
+		if n.leaf {
+			binary.BigEndian.PutUint32(data[offset+4:], uint32(len(n.values[i])))
+			offset += 8
+		} else {
+			binary.BigEndian.PutUint64(data[offset+4:], n.children[i].pgid)
+			offset += 12
+		}
+		offset += copy(data[offset:], key)
+		if n.leaf {
+			offset += copy(data[offset:], n.values[i])
+		}
+	}
+
+	return data
+}
+
+func encodeFreelist(free []uint64, pages uint64) []byte {
+	data := make([]byte, pages*btreePageSize)
+	data[0] = btreePageFreelist
+	binary.BigEndian.PutUint32(data[4:8], uint32(pages-1))
+	binary.BigEndian.PutUint32(data[8:12], uint32(len(free)))
+	for i, pgid := range free {
+		binary.BigEndian.PutUint64(data[btreeHeaderSize+8*i:], pgid)
+	}
+
+	return data
+}
+
+func decodeNode(data []byte) (*btreeNode, error) {
+	page_type := data[0]
+	count := int(binary.BigEndian.Uint32(data[8:12]))
+	n := &btreeNode{leaf: page_type == btreePageLeaf}
+
+	offset := btreeHeaderSize
+	for i := 0; i < count; i++ {
+		switch page_type {
+		case btreePageFreelist:
+			if offset+8 > len(data) {
+				return nil, ErrCorruptedFile
+			}
+			n.children = append(n.children, btreeRef{pgid: binary.BigEndian.Uint64(data[offset:])})
+			offset += 8
+		case btreePageLeaf:
+			if offset+8 > len(data) {
+				return nil, ErrCorruptedFile
+			}
+			key_length := int(binary.BigEndian.Uint32(data[offset:]))
+			value_length := int(binary.BigEndian.Uint32(data[offset+4:]))
+			offset += 8
+			if offset+key_length+value_length > len(data) {
+				return nil, ErrCorruptedFile
+			}
+			n.keys = append(n.keys, string(data[offset:offset+key_length]))
+			offset += key_length
+			n.values = append(n.values, append([]byte{}, data[offset:offset+value_length]...))
+			offset += value_length
+		case btreePageBranch:
+			if offset+12 > len(data) {
+				return nil, ErrCorruptedFile
+			}
+			key_length := int(binary.BigEndian.Uint32(data[offset:]))
+			pgid := binary.BigEndian.Uint64(data[offset+4:])
+			offset += 12
+			if offset+key_length > len(data) {
+				return nil, ErrCorruptedFile
+			}
+			n.keys = append(n.keys, string(data[offset:offset+key_length]))
+			n.children = append(n.children, btreeRef{pgid: pgid})
+			offset += key_length
+		default:
+			return nil, ErrCorruptedFile
+		}
+	}
+
+	return n, nil
+}
+
+func freelistPages(freelist *btreeNode) []uint64 {
+	free := []uint64{}
+	for _, ref := range freelist.children {
+		free = append(free, ref.pgid)
+	}
+
+	return free
+}
+
+func encodeMeta(meta btreeMeta) []byte {
+	data := make([]byte, btreePageSize)
+	binary.BigEndian.PutUint32(data[0:], btreeMagic)
+	binary.BigEndian.PutUint32(data[4:], btreeVersion)
+	binary.BigEndian.PutUint64(data[8:], meta.txid)
+	binary.BigEndian.PutUint64(data[16:], meta.root)
+	binary.BigEndian.PutUint64(data[24:], meta.freelist)
+	binary.BigEndian.PutUint64(data[32:], meta.pageCount)
+
+	hash := fnv.New64a()
+	hash.Write(data[:40])
+	binary.BigEndian.PutUint64(data[40:], hash.Sum64())
+
+	return data
+}
+
+func decodeMeta(data []byte) (btreeMeta, bool) {
+	meta := btreeMeta{}
+	if binary.BigEndian.Uint32(data[0:]) != btreeMagic || binary.BigEndian.Uint32(data[4:]) != btreeVersion {
+		return meta, false
+	}
+
+	hash := fnv.New64a()
+	hash.Write(data[:40])
+	if binary.BigEndian.Uint64(data[40:]) != hash.Sum64() {
+		return meta, false
+	}
+
+	meta.txid = binary.BigEndian.Uint64(data[8:])
+	meta.root = binary.BigEndian.Uint64(data[16:])
+	meta.freelist = binary.BigEndian.Uint64(data[24:])
+	meta.pageCount = binary.BigEndian.Uint64(data[32:])
+
+	return meta, true
+}
+
+// childIndex returns the child of a branch whose subtree would hold the key.
+func childIndex(keys []string, key string) int {
+	i := sort.Search(len(keys), func(i int) bool {
+		return keys[i] > key
+	})
+	if i > 0 {
+		i--
+	}
+
+	return i
+}
+
+func pageCount(size int) uint64 {
+	return uint64((size + btreePageSize - 1) / btreePageSize)
+}
+
+func folderPrefix(folder string) string {
+	folder = strings.Trim(folder, "/")
+	if folder == "" {
+		return ""
+	}
+
+	return folder + "/"
+}
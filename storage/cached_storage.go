@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+
+	c "godb/common"
+)
+
+const defaultCacheEntries = 1000
+
+// CachedStorage keeps the last read documents of Backend in a LRU cache,
+// bounded by MaxEntries and MaxBytes (of the serialized documents). Writes
+// made through it invalidate the cached documents they touch; writes made
+// directly to Backend aren't seen.
+type CachedStorage struct {
+	Storage
+	Backend    Storage
+	MaxEntries int
+	MaxBytes   int64
+
+	mutex      sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+	bytes      int64
+	generation uint64
+	stats      CacheStats
+}
+
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int64
+}
+
+type cacheEntry struct {
+	id       string
+	document c.Document
+	// size is the one of the serialized document, estimated when cached
+	size int64
+}
+
+func (cs *CachedStorage) Get(id string) (c.Document, error) {
+	return cs.GetContext(context.Background(), id)
+}
+
+func (cs *CachedStorage) GetContext(ctx context.Context, id string) (c.Document, error) {
+	cs.mutex.Lock()
+	cs.ensureCache()
+	element, found := cs.entries[id]
+	if found {
+		cs.lru.MoveToFront(element)
+		cs.stats.Hits++
+		document := element.Value.(*cacheEntry).document
+		cs.mutex.Unlock()
+
+		// the cached document is never modified, the callers get a copy
+		return document.Clone(), nil
+	}
+	cs.stats.Misses++
+	generation := cs.generation
+	cs.mutex.Unlock()
+
+	document, err := GetContext(ctx, cs.Backend, id)
+	if err != nil {
+		return nil, err
+	}
+
+	document_bytes, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	// a write after the read could have changed the document
+	if generation == cs.generation {
+		cs.add(id, document.Clone(), int64(len(document_bytes)))
+	}
+
+	return document, nil
+}
+
+func (cs *CachedStorage) Set(document c.Document) (c.Document, error) {
+	return cs.SetContext(context.Background(), document)
+}
+
+func (cs *CachedStorage) SetContext(ctx context.Context, document c.Document) (c.Document, error) {
+	document_id, err := document.GetId()
+	if err != nil {
+		return nil, err
+	}
+	defer cs.invalidate(document_id)
+
+	return SetContext(ctx, cs.Backend, document)
+}
+
+func (cs *CachedStorage) Patch(document c.Document) (c.Document, error) {
+	return cs.PatchContext(context.Background(), document)
+}
+
+func (cs *CachedStorage) PatchContext(ctx context.Context, document c.Document) (c.Document, error) {
+	document_id, err := document.GetId()
+	if err != nil {
+		return nil, err
+	}
+	defer cs.invalidate(document_id)
+
+	return PatchContext(ctx, cs.Backend, document)
+}
+
+func (cs *CachedStorage) Exists(id string) (bool, error) {
+	return cs.ExistsContext(context.Background(), id)
+}
+
+func (cs *CachedStorage) ExistsContext(ctx context.Context, id string) (bool, error) {
+	cs.mutex.Lock()
+	cs.ensureCache()
+	_, found := cs.entries[id]
+	cs.mutex.Unlock()
+	if found {
+		return true, nil
+	}
+
+	return ExistsContext(ctx, cs.Backend, id)
+}
+
+func (cs *CachedStorage) List(folder string) ([]string, error) {
+	return cs.ListContext(context.Background(), folder)
+}
+
+func (cs *CachedStorage) ListContext(ctx context.Context, folder string) ([]string, error) {
+	return ListContext(ctx, cs.Backend, folder)
+}
+
+func (cs *CachedStorage) Delete(id string) error {
+	return cs.DeleteContext(context.Background(), id)
+}
+
+func (cs *CachedStorage) DeleteContext(ctx context.Context, id string) error {
+	defer cs.invalidate(id)
+
+	return DeleteContext(ctx, cs.Backend, id)
+}
+
+func (cs *CachedStorage) DeleteFolder(folder string) error {
+	return cs.DeleteFolderContext(context.Background(), folder)
+}
+
+func (cs *CachedStorage) DeleteFolderContext(ctx context.Context, folder string) error {
+	defer cs.invalidateFolder(folder)
+
+	return DeleteFolderContext(ctx, cs.Backend, folder)
+}
+
+func (cs *CachedStorage) Commit(operations []Operation) error {
+	return cs.CommitContext(context.Background(), operations)
+}
+
+func (cs *CachedStorage) CommitContext(ctx context.Context, operations []Operation) error {
+	defer func() {
+		for _, operation := range operations {
+			switch operation.Type {
+			case OperationSet:
+				document_id, _ := operation.Document.GetId()
+				cs.invalidate(document_id)
+			case OperationDelete:
+				cs.invalidate(operation.Id)
+			case OperationDeleteFolder:
+				cs.invalidateFolder(operation.Id)
+			}
+		}
+	}()
+
+	return CommitContext(ctx, cs.Backend, operations)
+}
+
+// The attachments aren't cached, they go straight to Backend.
+
+func (cs *CachedStorage) PutAttachment(id, name string, content io.Reader) error {
+	return PutAttachment(cs.Backend, id, name, content)
+}
+
+func (cs *CachedStorage) StageAttachment(id, name string, content io.Reader) (string, error) {
+	return StageAttachment(cs.Backend, id, name, content)
+}
+
+func (cs *CachedStorage) CommitAttachment(id, name, staged string) error {
+	return CommitAttachment(cs.Backend, id, name, staged)
+}
+
+func (cs *CachedStorage) DiscardAttachment(id, staged string) error {
+	return DiscardAttachment(cs.Backend, id, staged)
+}
+
+func (cs *CachedStorage) GetAttachment(id, name string) (io.ReadSeekCloser, error) {
+	return GetAttachment(cs.Backend, id, name)
+}
+
+func (cs *CachedStorage) DeleteAttachment(id, name string) error {
+	return DeleteAttachment(cs.Backend, id, name)
+}
+
+func (cs *CachedStorage) ListAttachments(id string) ([]string, error) {
+	return ListAttachments(cs.Backend, id)
+}
+
+// Check checks Backend. Repairing drops the whole cache, as the repairs are
+// made behind it.
+func (cs *CachedStorage) Check(repair bool) ([]Problem, error) {
+	problems, err := Check(cs.Backend, repair)
+	if repair {
+		cs.invalidateFolder("")
+	}
+
+	return problems, err
+}
+
+func (cs *CachedStorage) Stats() CacheStats {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	stats := cs.stats
+	stats.Entries = len(cs.entries)
+	stats.Bytes = cs.bytes
+
+	return stats
+}
+
+// add caches the document, evicting the least recently used ones to make
+// room for it. The caller must hold the lock.
+func (cs *CachedStorage) add(id string, document c.Document, size int64) {
+	cs.ensureCache()
+	cs.remove(id)
+
+	max_entries := cs.MaxEntries
+	if max_entries <= 0 && cs.MaxBytes <= 0 {
+		max_entries = defaultCacheEntries
+	}
+	if cs.MaxBytes > 0 && size > cs.MaxBytes {
+		return
+	}
+
+	for cs.lru.Len() > 0 {
+		too_many := max_entries > 0 && cs.lru.Len() >= max_entries
+		too_big := cs.MaxBytes > 0 && cs.bytes+size > cs.MaxBytes
+		if !too_many && !too_big {
+			break
+		}
+		cs.remove(cs.lru.Back().Value.(*cacheEntry).id)
+		cs.stats.Evictions++
+	}
+
+	cs.entries[id] = cs.lru.PushFront(&cacheEntry{id: id, document: document, size: size})
+	cs.bytes += size
+}
+
+// remove drops the document from the cache. The caller must hold the lock.
+func (cs *CachedStorage) remove(id string) {
+	element, found := cs.entries[id]
+	if !found {
+		return
+	}
+
+	cs.lru.Remove(element)
+	delete(cs.entries, id)
+	cs.bytes -= element.Value.(*cacheEntry).size
+}
+
+func (cs *CachedStorage) invalidate(id string) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.ensureCache()
+	cs.generation++
+	cs.remove(id)
+}
+
+func (cs *CachedStorage) invalidateFolder(folder string) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.ensureCache()
+	cs.generation++
+	folder = strings.Trim(folder, "/")
+	for id := range cs.entries {
+		if folder == "" || strings.HasPrefix(id, folder+"/") {
+			cs.remove(id)
+		}
+	}
+}
+
+func (cs *CachedStorage) ensureCache() {
+	if cs.entries == nil {
+		cs.entries = map[string]*list.Element{}
+		cs.lru = list.New()
+	}
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+
+	c "godb/common"
+)
+
+// Codec encodes the documents written by FileStorage. Its extension names the
+// files, so the documents of any codec can be read from the same root.
+type Codec interface {
+	Extension() string
+	Marshal(document c.Document) ([]byte, error)
+	Unmarshal(data []byte) (c.Document, error)
+}
+
+var (
+	// JSONCodec keeps the documents readable. It's the default.
+	JSONCodec Codec = jsonCodec{}
+	// MsgpackCodec and CBORCodec are more compact and keep integers as such,
+	// instead of turning them into float64.
+	MsgpackCodec Codec = msgpackCodec{}
+	CBORCodec    Codec = cborCodec{}
+)
+
+var codecs = []Codec{JSONCodec, MsgpackCodec, CBORCodec}
+
+// RegisterCodec makes the codec known to every FileStorage, so their files
+// can be read by roots using other codecs, and to the "codec" option of the
+// file uris, by its extension without the dot. Like Register, it panics on a
+// duplicate extension, and it must be called before using any storage, as
+// from an init function.
+func RegisterCodec(codec Codec) {
+	for _, known_codec := range codecs {
+		if known_codec.Extension() == codec.Extension() {
+			panic("storage: RegisterCodec called twice for extension " + codec.Extension())
+		}
+	}
+	codecs = append(codecs, codec)
+}
+
+// cborDecoder decodes the integers as int64, as msgpack does, instead of
+// uint64 for the positive ones.
+var cborDecoder, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}{}),
+	IntDec:         cbor.IntDecConvertSignedOrBigInt,
+}.DecMode()
+
+type jsonCodec struct{}
+
+func (jsonCodec) Extension() string {
+	return ".json"
+}
+
+func (jsonCodec) Marshal(document c.Document) ([]byte, error) {
+	return json.Marshal(document)
+}
+
+func (jsonCodec) Unmarshal(data []byte) (c.Document, error) {
+	document := c.Document{}
+	err := json.Unmarshal(data, &document)
+	if err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Extension() string {
+	return ".msgpack"
+}
+
+func (msgpackCodec) Marshal(document c.Document) ([]byte, error) {
+	return msgpack.Marshal(map[string]interface{}(document))
+}
+
+func (msgpackCodec) Unmarshal(data []byte) (c.Document, error) {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	// integers are decoded as int64 instead of the smallest type that fits
+	decoder.UseLooseInterfaceDecoding(true)
+
+	document := map[string]interface{}{}
+	err := decoder.Decode(&document)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Document(document), nil
+}
+
+type cborCodec struct{}
+
+func (cborCodec) Extension() string {
+	return ".cbor"
+}
+
+func (cborCodec) Marshal(document c.Document) ([]byte, error) {
+	return cbor.Marshal(map[string]interface{}(document))
+}
+
+func (cborCodec) Unmarshal(data []byte) (c.Document, error) {
+	document := map[string]interface{}{}
+	err := cborDecoder.Unmarshal(data, &document)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Document(document), nil
+}
+
+// trimExtension removes the extension of any of the codecs from the file
+// name, reporting whether it had one.
+func trimExtension(name string, codecs []Codec) (string, bool) {
+	for _, codec := range codecs {
+		trimmed_name, found := strings.CutSuffix(name, codec.Extension())
+		if found {
+			return trimmed_name, true
+		}
+	}
+
+	return name, false
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression tells FileStorage how to compress the documents it writes.
+// Reads detect it from the content, so files written with any compression can
+// live in the same root.
+type Compression string
+
+const (
+	// CompressionNone writes the documents as they are. It's the default.
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+var ErrInvalidCompression = errors.New("invalid compression")
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// compress compresses the data when it's at least threshold bytes long.
+func compress(compression Compression, threshold int, data []byte) ([]byte, error) {
+	if len(data) < threshold {
+		return data, nil
+	}
+
+	switch compression {
+	case "", CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		buffer := bytes.Buffer{}
+		writer := gzip.NewWriter(&buffer)
+		_, err := writer.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		err = writer.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	case CompressionZstd:
+		err := ensureZstd()
+		if err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+
+	return nil, compression.validate()
+}
+
+// validate fails with ErrInvalidCompression for unknown compressions. The
+// empty one is the default.
+func (compression Compression) validate() error {
+	switch compression {
+	case "", CompressionNone, CompressionGzip, CompressionZstd:
+		return nil
+	}
+
+	return fmt.Errorf("%w '%s'", ErrInvalidCompression, compression)
+}
+
+// decompress returns the data uncompressed, whatever compression it has.
+func decompress(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	case bytes.HasPrefix(data, zstdMagic):
+		err := ensureZstd()
+		if err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+
+	return data, nil
+}
+
+func ensureZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+
+	return zstdErr
+}
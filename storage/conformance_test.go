@@ -0,0 +1,16 @@
+package storage_test
+
+import (
+	"testing"
+
+	s "godb/storage"
+	"godb/storage/storagetest"
+)
+
+func Test_Conformance(t *testing.T) {
+	for storageName, newStorage := range s.StorageFactories {
+		t.Run(storageName, func(t *testing.T) {
+			storagetest.Run(t, newStorage)
+		})
+	}
+}
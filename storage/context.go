@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+
+	c "godb/common"
+)
+
+// ContextStorage is implemented by the storages that can stop their
+// operations when the context is done, like the network based ones. The
+// functions below use it when available and otherwise only check the context
+// before calling the plain operation.
+type ContextStorage interface {
+	GetContext(ctx context.Context, id string) (c.Document, error)
+	SetContext(ctx context.Context, document c.Document) (c.Document, error)
+	PatchContext(ctx context.Context, document c.Document) (c.Document, error)
+	ExistsContext(ctx context.Context, id string) (bool, error)
+	ListContext(ctx context.Context, folder string) ([]string, error)
+	DeleteContext(ctx context.Context, id string) error
+	DeleteFolderContext(ctx context.Context, folder string) error
+	CommitContext(ctx context.Context, operations []Operation) error
+}
+
+func GetContext(ctx context.Context, storage Storage, id string) (c.Document, error) {
+	if context_storage, ok := storage.(ContextStorage); ok {
+		return context_storage.GetContext(ctx, id)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return storage.Get(id)
+}
+
+func SetContext(ctx context.Context, storage Storage, document c.Document) (c.Document, error) {
+	if context_storage, ok := storage.(ContextStorage); ok {
+		return context_storage.SetContext(ctx, document)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return storage.Set(document)
+}
+
+func PatchContext(ctx context.Context, storage Storage, document c.Document) (c.Document, error) {
+	if context_storage, ok := storage.(ContextStorage); ok {
+		return context_storage.PatchContext(ctx, document)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return storage.Patch(document)
+}
+
+func ExistsContext(ctx context.Context, storage Storage, id string) (bool, error) {
+	if context_storage, ok := storage.(ContextStorage); ok {
+		return context_storage.ExistsContext(ctx, id)
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	return storage.Exists(id)
+}
+
+func ListContext(ctx context.Context, storage Storage, folder string) ([]string, error) {
+	if context_storage, ok := storage.(ContextStorage); ok {
+		return context_storage.ListContext(ctx, folder)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return storage.List(folder)
+}
+
+func DeleteContext(ctx context.Context, storage Storage, id string) error {
+	if context_storage, ok := storage.(ContextStorage); ok {
+		return context_storage.DeleteContext(ctx, id)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return storage.Delete(id)
+}
+
+func DeleteFolderContext(ctx context.Context, storage Storage, folder string) error {
+	if context_storage, ok := storage.(ContextStorage); ok {
+		return context_storage.DeleteFolderContext(ctx, folder)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return storage.DeleteFolder(folder)
+}
+
+func CommitContext(ctx context.Context, storage Storage, operations []Operation) error {
+	if context_storage, ok := storage.(ContextStorage); ok {
+		return context_storage.CommitContext(ctx, operations)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return storage.Commit(operations)
+}
+
+// IterateContext iterates the folder like Iterate, stopping with the
+// context's error once it's done.
+func IterateContext(ctx context.Context, storage Storage, folder string, options IterateOptions) Iterator {
+	return &contextIterator{Iterator: Iterate(storage, folder, options), ctx: ctx}
+}
+
+type contextIterator struct {
+	Iterator
+	ctx context.Context
+	err error
+}
+
+func (it *contextIterator) Next() bool {
+	if it.err == nil {
+		it.err = it.ctx.Err()
+	}
+	if it.err != nil {
+		return false
+	}
+
+	return it.Iterator.Next()
+}
+
+func (it *contextIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+
+	return it.Iterator.Err()
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrInvalidDurability = errors.New("invalid durability")
+
+// Durability tells the file based storages when to fsync the files they write.
+type Durability string
+
+const (
+	// DurabilityNone never syncs, leaving it to the OS.
+	DurabilityNone Durability = "none"
+	// DurabilityPerWrite syncs every write before returning. It's the default.
+	DurabilityPerWrite Durability = "per-write"
+	// DurabilityGroupCommit waits GroupCommitWindow to sync together the
+	// writes of concurrent writers.
+	DurabilityGroupCommit Durability = "group-commit"
+)
+
+const defaultGroupCommitWindow = 2 * time.Millisecond
+
+// validate fails with ErrInvalidDurability for unknown modes. The empty one
+// is the default.
+func (durability Durability) validate() error {
+	switch durability {
+	case "", DurabilityNone, DurabilityPerWrite, DurabilityGroupCommit:
+		return nil
+	}
+
+	return fmt.Errorf("%w '%s'", ErrInvalidDurability, durability)
+}
+
+type durabilitySyncer struct {
+	once  sync.Once
+	group *groupSyncer
+	// syncs counts the fsyncs made, which group commit shares between writes
+	syncs atomic.Uint64
+}
+
+// sync flushes the file or folder at path to disk as the durability mode
+// demands.
+func (ds *durabilitySyncer) sync(durability Durability, window time.Duration, path string) error {
+	err := durability.validate()
+	if err != nil {
+		return err
+	}
+
+	switch durability {
+	case DurabilityNone:
+		return nil
+	case DurabilityGroupCommit:
+		ds.once.Do(func() {
+			ds.group = newGroupSyncer(window, &ds.syncs)
+		})
+		return ds.group.sync(path)
+	default:
+		ds.syncs.Add(1)
+		return syncPath(path)
+	}
+}
+
+// groupSyncer batches the fsyncs requested during a time window, so writers
+// running concurrently share them instead of syncing one by one.
+type groupSyncer struct {
+	window time.Duration
+	syncs  *atomic.Uint64
+	mutex  sync.Mutex
+	batch  *syncBatch
+}
+
+type syncBatch struct {
+	paths map[string]bool
+	done  chan struct{}
+	err   error
+}
+
+func newGroupSyncer(window time.Duration, syncs *atomic.Uint64) *groupSyncer {
+	if window <= 0 {
+		window = defaultGroupCommitWindow
+	}
+
+	return &groupSyncer{window: window, syncs: syncs}
+}
+
+// sync blocks until the path has been synced along with the rest of its batch.
+func (gs *groupSyncer) sync(path string) error {
+	gs.mutex.Lock()
+	batch := gs.batch
+	if batch == nil {
+		batch = &syncBatch{
+			paths: map[string]bool{},
+			done:  make(chan struct{}),
+		}
+		gs.batch = batch
+		time.AfterFunc(gs.window, func() {
+			gs.flush(batch)
+		})
+	}
+	batch.paths[path] = true
+	gs.mutex.Unlock()
+
+	<-batch.done
+
+	return batch.err
+}
+
+func (gs *groupSyncer) flush(batch *syncBatch) {
+	gs.mutex.Lock()
+	if gs.batch == batch {
+		gs.batch = nil
+	}
+	gs.mutex.Unlock()
+
+	for path := range batch.paths {
+		gs.syncs.Add(1)
+		err := syncPath(path)
+		if err != nil && batch.err == nil {
+			batch.err = err
+		}
+	}
+	close(batch.done)
+}
+
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
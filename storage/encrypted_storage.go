@@ -0,0 +1,388 @@
+package storage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	c "godb/common"
+)
+
+const (
+	encryptedKeyIdField = "_kid"
+	encryptedDataField  = "_enc"
+)
+
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// EncryptedStorage encrypts the documents with AES-GCM before handing them to
+// Backend, which only sees {"id", "_kid", "_enc"} documents. New documents are
+// encrypted with the key CurrentKeyId of Keys; Rotate re-encrypts the older
+// ones so their keys can be dropped.
+//
+// With IdKey each segment of the ids is encrypted too, deterministically so
+// the folders still work. It leaks which segments are equal, but not their
+// names. IdKey can't be rotated.
+type EncryptedStorage struct {
+	Storage
+	Backend      Storage
+	Keys         map[string][]byte
+	CurrentKeyId string
+	IdKey        []byte
+
+	mutex sync.Mutex
+}
+
+func (es *EncryptedStorage) Get(id string) (c.Document, error) {
+	return es.GetContext(context.Background(), id)
+}
+
+func (es *EncryptedStorage) GetContext(ctx context.Context, id string) (c.Document, error) {
+	stored_id, err := es.encryptId(id)
+	if err != nil {
+		return nil, err
+	}
+
+	stored_document, err := GetContext(ctx, es.Backend, stored_id)
+	if err != nil {
+		return nil, err
+	}
+
+	return es.decrypt(stored_document)
+}
+
+func (es *EncryptedStorage) Set(document c.Document) (c.Document, error) {
+	return es.SetContext(context.Background(), document)
+}
+
+func (es *EncryptedStorage) SetContext(ctx context.Context, document c.Document) (c.Document, error) {
+	err := es.CommitContext(ctx, []Operation{{Type: OperationSet, Document: document}})
+	if err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+func (es *EncryptedStorage) Patch(document c.Document) (c.Document, error) {
+	return es.PatchContext(context.Background(), document)
+}
+
+func (es *EncryptedStorage) PatchContext(ctx context.Context, document c.Document) (c.Document, error) {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	document_id, err := document.GetId()
+	if err != nil {
+		return nil, err
+	}
+
+	patched_document := c.NewDocument(document_id)
+	existing_document, err := es.GetContext(ctx, document_id)
+	if err != nil {
+		if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+			return nil, err
+		}
+	} else {
+		patched_document.Patch(existing_document)
+	}
+	patched_document.Patch(document)
+
+	stored_document, err := es.encrypt(patched_document)
+	if err != nil {
+		return nil, err
+	}
+	_, err = SetContext(ctx, es.Backend, stored_document)
+	if err != nil {
+		return nil, err
+	}
+
+	return patched_document, nil
+}
+
+func (es *EncryptedStorage) Exists(id string) (bool, error) {
+	return es.ExistsContext(context.Background(), id)
+}
+
+func (es *EncryptedStorage) ExistsContext(ctx context.Context, id string) (bool, error) {
+	stored_id, err := es.encryptId(id)
+	if err != nil {
+		return false, err
+	}
+
+	return ExistsContext(ctx, es.Backend, stored_id)
+}
+
+func (es *EncryptedStorage) List(folder string) ([]string, error) {
+	return es.ListContext(context.Background(), folder)
+}
+
+func (es *EncryptedStorage) ListContext(ctx context.Context, folder string) ([]string, error) {
+	stored_folder, err := es.encryptId(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	stored_ids, err := ListContext(ctx, es.Backend, stored_folder)
+	if err != nil {
+		return nil, err
+	}
+	if es.IdKey == nil {
+		return stored_ids, nil
+	}
+
+	simple_ids := make([]string, 0, len(stored_ids))
+	for _, stored_id := range stored_ids {
+		simple_id, err := es.decryptSegment(strings.TrimSuffix(stored_id, "/"))
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(stored_id, "/") {
+			simple_id += "/"
+		}
+		simple_ids = append(simple_ids, simple_id)
+	}
+	sort.Strings(simple_ids)
+
+	return simple_ids, nil
+}
+
+func (es *EncryptedStorage) Delete(id string) error {
+	return es.DeleteContext(context.Background(), id)
+}
+
+func (es *EncryptedStorage) DeleteContext(ctx context.Context, id string) error {
+	stored_id, err := es.encryptId(id)
+	if err != nil {
+		return err
+	}
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	return DeleteContext(ctx, es.Backend, stored_id)
+}
+
+func (es *EncryptedStorage) DeleteFolder(folder string) error {
+	return es.DeleteFolderContext(context.Background(), folder)
+}
+
+func (es *EncryptedStorage) DeleteFolderContext(ctx context.Context, folder string) error {
+	return es.CommitContext(ctx, []Operation{{Type: OperationDeleteFolder, Id: folder}})
+}
+
+func (es *EncryptedStorage) Commit(operations []Operation) error {
+	return es.CommitContext(context.Background(), operations)
+}
+
+func (es *EncryptedStorage) CommitContext(ctx context.Context, operations []Operation) error {
+	stored_operations := make([]Operation, 0, len(operations))
+	for _, operation := range operations {
+		stored_operation := Operation{Type: operation.Type}
+		var err error
+		if operation.Type == OperationSet {
+			stored_operation.Document, err = es.encrypt(operation.Document)
+		} else {
+			stored_operation.Id, err = es.encryptId(operation.Id)
+		}
+		if err != nil {
+			return err
+		}
+		stored_operations = append(stored_operations, stored_operation)
+	}
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	return CommitContext(ctx, es.Backend, stored_operations)
+}
+
+// Rotate re-encrypts with CurrentKeyId the documents encrypted with other keys.
+func (es *EncryptedStorage) Rotate() error {
+	return Walk(es.Backend, "", func(stored_id string) error {
+		es.mutex.Lock()
+		defer es.mutex.Unlock()
+
+		stored_document, err := es.Backend.Get(stored_id)
+		if errors.Is(err, c.ErrDocumentDoestNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if stored_document[encryptedKeyIdField] == es.CurrentKeyId {
+			return nil
+		}
+
+		document, err := es.decrypt(stored_document)
+		if err != nil {
+			return err
+		}
+		stored_document, err = es.encrypt(document)
+		if err != nil {
+			return err
+		}
+		_, err = es.Backend.Set(stored_document)
+
+		return err
+	})
+}
+
+func (es *EncryptedStorage) encrypt(document c.Document) (c.Document, error) {
+	document_id, err := document.GetId()
+	if err != nil {
+		return nil, err
+	}
+	stored_id, err := es.encryptId(document_id)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := es.aead(es.CurrentKeyId)
+	if err != nil {
+		return nil, err
+	}
+	document_bytes, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	// the stored id is authenticated so documents can't be swapped
+	sealed := aead.Seal(nonce, nonce, document_bytes, []byte(stored_id))
+
+	return c.Document{
+		"id":                stored_id,
+		encryptedKeyIdField: es.CurrentKeyId,
+		encryptedDataField:  base64.StdEncoding.EncodeToString(sealed),
+	}, nil
+}
+
+func (es *EncryptedStorage) decrypt(stored_document c.Document) (c.Document, error) {
+	stored_id, err := stored_document.GetId()
+	if err != nil {
+		return nil, err
+	}
+	key_id, _ := stored_document[encryptedKeyIdField].(string)
+	data, _ := stored_document[encryptedDataField].(string)
+
+	aead, err := es.aead(key_id)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted document too short")
+	}
+
+	document_bytes, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(stored_id))
+	if err != nil {
+		return nil, err
+	}
+
+	document := c.Document{}
+	err = json.Unmarshal(document_bytes, &document)
+	if err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+func (es *EncryptedStorage) aead(key_id string) (cipher.AEAD, error) {
+	key, found := es.Keys[key_id]
+	if !found {
+		return nil, ErrUnknownKey
+	}
+
+	return newAEAD(key)
+}
+
+// encryptId encrypts each segment of the id when IdKey is set.
+func (es *EncryptedStorage) encryptId(id string) (string, error) {
+	id = strings.Trim(id, "/")
+	if es.IdKey == nil || id == "" {
+		return id, nil
+	}
+
+	segments := strings.Split(id, "/")
+	for i, segment := range segments {
+		encrypted_segment, err := es.encryptSegment(segment)
+		if err != nil {
+			return "", err
+		}
+		segments[i] = encrypted_segment
+	}
+
+	return strings.Join(segments, "/"), nil
+}
+
+// encryptSegment uses a nonce derived from the segment, so the same segment
+// is always encrypted the same way.
+func (es *EncryptedStorage) encryptSegment(segment string) (string, error) {
+	aead, err := newAEAD(deriveKey(es.IdKey, "id"))
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, deriveKey(es.IdKey, "nonce"))
+	mac.Write([]byte(segment))
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+	sealed := aead.Seal(nonce, nonce, []byte(segment), nil)
+
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (es *EncryptedStorage) decryptSegment(encrypted_segment string) (string, error) {
+	aead, err := newAEAD(deriveKey(es.IdKey, "id"))
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(encrypted_segment)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted id too short")
+	}
+
+	segment, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(segment), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+
+	return mac.Sum(nil)
+}
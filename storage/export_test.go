@@ -0,0 +1,5 @@
+package storage
+
+// StorageFactories lets the external tests run the conformance suite, which
+// imports this package, over every storage.
+var StorageFactories = storageFactories
@@ -0,0 +1,345 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	c "godb/common"
+)
+
+var (
+	ErrInjectedFault = errors.New("injected fault")
+	ErrCrashed       = errors.New("storage crashed")
+)
+
+// FaultStorage wraps Backend failing the calls that match its Rules, to test
+// how the code above behaves when the storage fails. The first matching rule
+// that fires is applied.
+type FaultStorage struct {
+	Storage
+	Backend Storage
+	Rules   []FaultRule
+	// Rand decides the rules with Probability. A random seed is used when nil.
+	Rand *rand.Rand
+
+	mutex   sync.Mutex
+	calls   map[int]int
+	crashed bool
+}
+
+// FaultRule matches the calls to Operations ("get", "set", "patch", "exists",
+// "list", "delete", "deleteFolder" and "commit", all when empty) over the ids
+// matching IdPattern (a path.Match pattern, any id when empty). It fires on
+// the Nth matching call only, when set, and with the given Probability, when
+// set.
+//
+// A rule with only Latency delays the call. Otherwise the call fails with Err,
+// or ErrInjectedFault, after writing part of the data when Partial. With Crash
+// every later call fails with ErrCrashed, as if the process had died, until
+// Recover.
+type FaultRule struct {
+	Operations  []string
+	IdPattern   string
+	Nth         int
+	Probability float64
+
+	Latency time.Duration
+	Err     error
+	Partial bool
+	Crash   bool
+}
+
+func (fs *FaultStorage) Get(id string) (c.Document, error) {
+	return fs.GetContext(context.Background(), id)
+}
+
+func (fs *FaultStorage) GetContext(ctx context.Context, id string) (c.Document, error) {
+	err := fs.inject(ctx, "get", id)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetContext(ctx, fs.Backend, id)
+}
+
+func (fs *FaultStorage) Set(document c.Document) (c.Document, error) {
+	return fs.SetContext(context.Background(), document)
+}
+
+func (fs *FaultStorage) SetContext(ctx context.Context, document c.Document) (c.Document, error) {
+	rule, err := fs.fire(ctx, "set", document.GetIdOrNil())
+	if err != nil {
+		return nil, err
+	}
+	if rule != nil {
+		if rule.Partial {
+			fs.Backend.Set(partialDocument(document))
+		}
+		return nil, fs.fail(rule)
+	}
+
+	return SetContext(ctx, fs.Backend, document)
+}
+
+func (fs *FaultStorage) Patch(document c.Document) (c.Document, error) {
+	return fs.PatchContext(context.Background(), document)
+}
+
+func (fs *FaultStorage) PatchContext(ctx context.Context, document c.Document) (c.Document, error) {
+	rule, err := fs.fire(ctx, "patch", document.GetIdOrNil())
+	if err != nil {
+		return nil, err
+	}
+	if rule != nil {
+		if rule.Partial {
+			fs.Backend.Patch(partialDocument(document))
+		}
+		return nil, fs.fail(rule)
+	}
+
+	return PatchContext(ctx, fs.Backend, document)
+}
+
+func (fs *FaultStorage) Exists(id string) (bool, error) {
+	return fs.ExistsContext(context.Background(), id)
+}
+
+func (fs *FaultStorage) ExistsContext(ctx context.Context, id string) (bool, error) {
+	err := fs.inject(ctx, "exists", id)
+	if err != nil {
+		return false, err
+	}
+
+	return ExistsContext(ctx, fs.Backend, id)
+}
+
+func (fs *FaultStorage) List(folder string) ([]string, error) {
+	return fs.ListContext(context.Background(), folder)
+}
+
+func (fs *FaultStorage) ListContext(ctx context.Context, folder string) ([]string, error) {
+	err := fs.inject(ctx, "list", folder)
+	if err != nil {
+		return nil, err
+	}
+
+	return ListContext(ctx, fs.Backend, folder)
+}
+
+func (fs *FaultStorage) Delete(id string) error {
+	return fs.DeleteContext(context.Background(), id)
+}
+
+func (fs *FaultStorage) DeleteContext(ctx context.Context, id string) error {
+	err := fs.inject(ctx, "delete", id)
+	if err != nil {
+		return err
+	}
+
+	return DeleteContext(ctx, fs.Backend, id)
+}
+
+func (fs *FaultStorage) DeleteFolder(folder string) error {
+	return fs.DeleteFolderContext(context.Background(), folder)
+}
+
+func (fs *FaultStorage) DeleteFolderContext(ctx context.Context, folder string) error {
+	rule, err := fs.fire(ctx, "deleteFolder", folder)
+	if err != nil {
+		return err
+	}
+	if rule != nil {
+		if rule.Partial {
+			// only the first half of the documents are deleted
+			ids := []string{}
+			Walk(fs.Backend, folder, func(id string) error {
+				ids = append(ids, id)
+				return nil
+			})
+			for _, id := range ids[:len(ids)/2] {
+				fs.Backend.Delete(id)
+			}
+		}
+		return fs.fail(rule)
+	}
+
+	return DeleteFolderContext(ctx, fs.Backend, folder)
+}
+
+func (fs *FaultStorage) Commit(operations []Operation) error {
+	return fs.CommitContext(context.Background(), operations)
+}
+
+func (fs *FaultStorage) CommitContext(ctx context.Context, operations []Operation) error {
+	ids := make([]string, 0, len(operations))
+	for _, operation := range operations {
+		if operation.Type == OperationSet {
+			ids = append(ids, operation.Document.GetIdOrNil())
+		} else {
+			ids = append(ids, operation.Id)
+		}
+	}
+
+	rule, err := fs.fire(ctx, "commit", ids...)
+	if err != nil {
+		return err
+	}
+	if rule != nil {
+		if rule.Partial {
+			// the commit isn't atomic anymore: only the first half of the
+			// operations, or part of the only document, are written
+			partial_operations := operations[:len(operations)/2]
+			if len(operations) == 1 && operations[0].Type == OperationSet {
+				partial_operations = []Operation{{Type: OperationSet, Document: partialDocument(operations[0].Document)}}
+			}
+			for _, operation := range partial_operations {
+				fs.Backend.Commit([]Operation{operation})
+			}
+		}
+		return fs.fail(rule)
+	}
+
+	return CommitContext(ctx, fs.Backend, operations)
+}
+
+// Recover makes the storage work again after a crash, keeping whatever was
+// written before it.
+func (fs *FaultStorage) Recover() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	fs.crashed = false
+}
+
+func (fs *FaultStorage) Crashed() bool {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	return fs.crashed
+}
+
+// inject applies the rule that fires, if any, to a call that doesn't write.
+func (fs *FaultStorage) inject(ctx context.Context, operation string, id string) error {
+	rule, err := fs.fire(ctx, operation, id)
+	if err != nil || rule == nil {
+		return err
+	}
+
+	return fs.fail(rule)
+}
+
+// fire returns the rule that fires for the call, after its latency, unless
+// it only adds latency. It fails when crashed or when the context is done
+// during the latency.
+func (fs *FaultStorage) fire(ctx context.Context, operation string, ids ...string) (*FaultRule, error) {
+	fs.mutex.Lock()
+	if fs.crashed {
+		fs.mutex.Unlock()
+		return nil, ErrCrashed
+	}
+	if fs.calls == nil {
+		fs.calls = map[int]int{}
+	}
+	if fs.Rand == nil {
+		fs.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	var fired *FaultRule
+	for i := range fs.Rules {
+		rule := &fs.Rules[i]
+		if !rule.matches(operation, ids) {
+			continue
+		}
+		fs.calls[i]++
+		if rule.Nth > 0 && fs.calls[i] != rule.Nth {
+			continue
+		}
+		if rule.Probability > 0 && fs.Rand.Float64() >= rule.Probability {
+			continue
+		}
+		fired = rule
+		break
+	}
+	fs.mutex.Unlock()
+
+	if fired == nil {
+		return nil, nil
+	}
+	timer := time.NewTimer(fired.Latency)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+	}
+	if fired.Latency > 0 && fired.Err == nil && !fired.Partial && !fired.Crash {
+		return nil, nil
+	}
+
+	return fired, nil
+}
+
+func (fs *FaultStorage) fail(rule *FaultRule) error {
+	if rule.Crash {
+		fs.mutex.Lock()
+		fs.crashed = true
+		fs.mutex.Unlock()
+	}
+	if rule.Err != nil {
+		return rule.Err
+	}
+
+	return ErrInjectedFault
+}
+
+func (rule *FaultRule) matches(operation string, ids []string) bool {
+	if len(rule.Operations) > 0 {
+		found := false
+		for _, rule_operation := range rule.Operations {
+			if rule_operation == operation {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if rule.IdPattern == "" {
+		return true
+	}
+
+	for _, id := range ids {
+		matched, _ := path.Match(rule.IdPattern, strings.Trim(id, "/"))
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// partialDocument keeps the id and the first half of the other fields, as a
+// torn write would.
+func partialDocument(document c.Document) c.Document {
+	keys := []string{}
+	for key := range document {
+		if key != "id" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	partial_document := c.Document{"id": document["id"]}
+	for _, key := range keys[:len(keys)/2] {
+		partial_document[key] = document[key]
+	}
+
+	return partial_document
+}
@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	c "godb/common"
+)
+
+const (
+	// attachmentsSuffix ends the hidden folder, next to the file of the
+	// document, keeping its attachments.
+	attachmentsSuffix = ".attachments"
+	// attachmentExtension ends the files of the attachments, so the names
+	// keep working with the temp files written next to them.
+	attachmentExtension = ".bin"
+)
+
+// PutAttachment streams the content to a temp file that replaces the
+// attachment once complete, so readers never see it half written.
+func (fs *FileStorage) PutAttachment(id, name string, content io.Reader) error {
+	err := validateAttachment(id, name)
+	if err != nil {
+		return err
+	}
+	exists, err := fs.Exists(id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return c.ErrDocumentDoestNotExist
+	}
+
+	staged, err := fs.StageAttachment(id, name, content)
+	if err != nil {
+		return err
+	}
+	err = fs.CommitAttachment(id, name, staged)
+	if err != nil {
+		fs.DiscardAttachment(id, staged)
+		return err
+	}
+
+	return nil
+}
+
+// StageAttachment streams the content to a temp file next to the
+// attachment, whose name is the staged one. Like any temp file it's removed
+// when the root is opened, if left behind.
+func (fs *FileStorage) StageAttachment(id, name string, content io.Reader) (string, error) {
+	err := validateAttachment(id, name)
+	if err != nil {
+		return "", err
+	}
+	err = fs.ensureOpen()
+	if err != nil {
+		return "", err
+	}
+
+	return fs.stageAttachment(id, name, content)
+}
+
+// CommitAttachment renames the staged file over the attachment.
+func (fs *FileStorage) CommitAttachment(id, name, staged string) error {
+	err := validateAttachment(id, name)
+	if err != nil {
+		return err
+	}
+	exists, err := fs.Exists(id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return c.ErrDocumentDoestNotExist
+	}
+
+	return fs.commitAttachment(id, name, staged)
+}
+
+func (fs *FileStorage) DiscardAttachment(id, staged string) error {
+	err := c.ValidateId(id)
+	if err != nil {
+		return err
+	}
+	err = fs.ensureOpen()
+	if err != nil {
+		return err
+	}
+
+	return fs.discardAttachment(id, staged)
+}
+
+func (fs *FileStorage) GetAttachment(id, name string) (io.ReadSeekCloser, error) {
+	err := validateAttachment(id, name)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.getAttachment(id, name)
+}
+
+func (fs *FileStorage) DeleteAttachment(id, name string) error {
+	err := validateAttachment(id, name)
+	if err != nil {
+		return err
+	}
+	err = fs.ensureOpen()
+	if err != nil {
+		return err
+	}
+
+	return fs.deleteAttachment(id, name)
+}
+
+func (fs *FileStorage) ListAttachments(id string) ([]string, error) {
+	err := c.ValidateId(id)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.listAttachments(id)
+}
+
+func (fs *FileStorage) stageAttachment(id, name string, content io.Reader) (string, error) {
+	path, err := fs.attachmentPath(id, name)
+	if err != nil {
+		return "", err
+	}
+	err = fs.ensureFolder(path)
+	if err != nil {
+		return "", err
+	}
+	staged_path, err := fs.writeTemp(path, content)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Base(staged_path), nil
+}
+
+func (fs *FileStorage) commitAttachment(id, name, staged string) error {
+	staged_path, err := fs.stagedPath(id, staged)
+	if err != nil {
+		return err
+	}
+	path, err := fs.attachmentPath(id, name)
+	if err != nil {
+		return err
+	}
+	err = fs.writeName(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(staged_path, path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrAttachmentNotStaged
+		}
+		return err
+	}
+
+	return fs.sync(filepath.Dir(path))
+}
+
+func (fs *FileStorage) discardAttachment(id, staged string) error {
+	staged_path, err := fs.stagedPath(id, staged)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(staged_path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return fs.removeEmptyPaths(filepath.Dir(staged_path))
+}
+
+// stagedPath returns the path of the staged name, which must be one of the
+// hidden temp files written by stageAttachment.
+func (fs *FileStorage) stagedPath(id, staged string) (string, error) {
+	if filepath.Base(staged) != staged || !strings.HasPrefix(staged, ".") || !strings.HasSuffix(staged, tempSuffix) {
+		return "", c.ErrInvalidId
+	}
+	folder, err := fs.attachmentsFolder(id)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(folder, staged), nil
+}
+
+func (fs *FileStorage) getAttachment(id, name string) (io.ReadSeekCloser, error) {
+	path, err := fs.attachmentPath(id, name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, c.ErrAttachmentDoesNotExist
+		}
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (fs *FileStorage) deleteAttachment(id, name string) error {
+	path, err := fs.attachmentPath(id, name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return c.ErrAttachmentDoesNotExist
+		}
+		return err
+	}
+	// only removed once it's empty
+	os.Remove(filepath.Dir(path))
+
+	return fs.sync(filepath.Dir(path))
+}
+
+func (fs *FileStorage) listAttachments(id string) ([]string, error) {
+	folder, err := fs.attachmentsFolder(id)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		file_name := entry.Name()
+		if strings.HasPrefix(file_name, ".") || !strings.HasSuffix(file_name, attachmentExtension) {
+			continue
+		}
+		names = append(names, fs.segment(strings.TrimSuffix(file_name, attachmentExtension)))
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// deleteAttachments removes all the attachments of the document.
+func (fs *FileStorage) deleteAttachments(id string) error {
+	folder, err := fs.attachmentsFolder(id)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(folder)
+}
+
+// attachmentsFolder returns the hidden folder of the attachments of the id,
+// next to its file, so it's skipped by List and deleted with its folder.
+func (fs *FileStorage) attachmentsFolder(id string) (string, error) {
+	path, err := fs.resolvePath(id)
+	if err != nil {
+		return "", err
+	}
+	if path == fs.Root {
+		return "", c.ErrInvalidId
+	}
+
+	folder, name := filepath.Split(path)
+
+	return filepath.Join(folder, "."+name+attachmentsSuffix), nil
+}
+
+func (fs *FileStorage) attachmentPath(id, name string) (string, error) {
+	folder, err := fs.attachmentsFolder(id)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(folder, fs.fileName(name)+attachmentExtension), nil
+}
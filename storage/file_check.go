@@ -0,0 +1,414 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	c "godb/common"
+)
+
+// quarantineName is the hidden folder, inside the root, where Check moves the
+// files it can't repair.
+const quarantineName = ".quarantine"
+
+var ErrNotCheckable = errors.New("storage can't be checked")
+
+type ProblemKind string
+
+const (
+	// ProblemTempFile is a write interrupted before its rename.
+	ProblemTempFile ProblemKind = "temp-file"
+	// ProblemBackup is a backup left by the previous write protocol.
+	ProblemBackup ProblemKind = "backup"
+	// ProblemCorrupted is a file that can't be decoded.
+	ProblemCorrupted ProblemKind = "corrupted"
+	// ProblemIdMismatch is a document whose id doesn't match its path.
+	ProblemIdMismatch ProblemKind = "id-mismatch"
+	// ProblemEmptyFolder is a folder left without documents, like by a delete
+	// interrupted before removing it.
+	ProblemEmptyFolder ProblemKind = "empty-folder"
+	// ProblemLegacyName is a document written before the ids were escaped,
+	// which is still read from its legacy path.
+	ProblemLegacyName ProblemKind = "legacy-name"
+	// ProblemJournal is a commit that wasn't completed.
+	ProblemJournal ProblemKind = "journal"
+)
+
+// Problem is an inconsistency found by a check. Path is relative to the root
+// of the storage, when the problem is about a file. Repair tells what
+// repairing it does, and Repaired whether it was done.
+type Problem struct {
+	Kind     ProblemKind `json:"kind"`
+	Id       string      `json:"id,omitempty"`
+	Path     string      `json:"path,omitempty"`
+	Detail   string      `json:"detail"`
+	Repair   string      `json:"repair"`
+	Repaired bool        `json:"repaired"`
+}
+
+// CheckableStorage is implemented by the storages that can look for the
+// inconsistencies left by crashes, and repair them.
+type CheckableStorage interface {
+	Check(repair bool) ([]Problem, error)
+}
+
+// Check checks the storage when it's checkable, and fails with
+// ErrNotCheckable otherwise.
+func Check(storage Storage, repair bool) ([]Problem, error) {
+	checkable_storage, ok := storage.(CheckableStorage)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrNotCheckable, storage)
+	}
+
+	return checkable_storage.Check(repair)
+}
+
+// Check scans the root for the leftovers of crashes and documents that can't
+// be read back, without opening it, as that would repair some of them
+// silently. With repair, backups are restored, the files that can't be fixed
+// are moved to the ".quarantine" folder, the legacy names are renamed to
+// their escaped ones and the pending commit is completed.
+// The root shouldn't be in use meanwhile. The FanOut kept in the root is used,
+// as with Open.
+func (fs *FileStorage) Check(repair bool) ([]Problem, error) {
+	err := fs.loadFanOut()
+	if err != nil {
+		return nil, err
+	}
+
+	problems := []Problem{}
+	folders := []string{}
+	files := []string{}
+	err = filepath.WalkDir(fs.Root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if path == fs.Root {
+			return nil
+		}
+		if entry.IsDir() {
+			if strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			folders = append(folders, path)
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	backups := map[string]string{}
+	for _, path := range files {
+		if strings.HasSuffix(path, backupSuffix) {
+			backups[strings.TrimSuffix(path, backupSuffix)] = path
+		}
+	}
+
+	for _, path := range files {
+		var problem *Problem
+		switch {
+		case path == filepath.Join(fs.Root, journalName) || strings.HasSuffix(path, backupSuffix):
+			continue
+		case strings.HasSuffix(path, tempSuffix):
+			problem = &Problem{Kind: ProblemTempFile, Detail: "unfinished write", Repair: "remove"}
+			if repair {
+				err = os.Remove(path)
+			}
+		default:
+			problem, err = fs.checkDocument(path, backups, repair)
+		}
+		if err != nil {
+			return problems, err
+		}
+		if problem != nil {
+			problem.Path = fs.relativePath(path)
+			problem.Repaired = repair
+			problems = append(problems, *problem)
+		}
+	}
+
+	backup_paths := []string{}
+	for _, backup_path := range backups {
+		backup_paths = append(backup_paths, backup_path)
+	}
+	sort.Strings(backup_paths)
+	for _, backup_path := range backup_paths {
+		problem, err := fs.checkBackup(backup_path, repair)
+		if err != nil {
+			return problems, err
+		}
+		problem.Path = fs.relativePath(backup_path)
+		problem.Repaired = repair
+		problems = append(problems, problem)
+	}
+
+	// the deepest folders first, so the folders holding only empty folders
+	// are empty too
+	empty_folders := map[string]bool{}
+	for i := len(folders) - 1; i >= 0; i-- {
+		folder := folders[i]
+		entries, err := os.ReadDir(folder)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return problems, err
+		}
+		empty := true
+		for _, entry := range entries {
+			if !empty_folders[filepath.Join(folder, entry.Name())] {
+				empty = false
+				break
+			}
+		}
+		if !empty {
+			continue
+		}
+		empty_folders[folder] = true
+		problems = append(problems, Problem{Kind: ProblemEmptyFolder, Path: fs.relativePath(folder), Detail: "empty folder", Repair: "remove", Repaired: repair})
+		if repair {
+			err = os.Remove(folder)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return problems, err
+			}
+		}
+	}
+
+	problem, err := fs.checkJournal(repair)
+	if err != nil {
+		return problems, err
+	}
+	if problem != nil {
+		problems = append(problems, *problem)
+	}
+
+	return problems, nil
+}
+
+// checkDocument decodes the document at path, restoring its backup or
+// quarantining it when it can't be, and fixes its id to match the path. The
+// backups used are removed from the map.
+func (fs *FileStorage) checkDocument(path string, backups map[string]string, repair bool) (*Problem, error) {
+	relative_path := fs.relativePath(path)
+	var codec Codec
+	for _, known_codec := range fs.codecs() {
+		if strings.HasSuffix(relative_path, known_codec.Extension()) {
+			codec = known_codec
+			break
+		}
+	}
+	if codec == nil || strings.HasPrefix(filepath.Base(path), ".") {
+		return nil, nil
+	}
+	document_id := fs.pathId(strings.TrimSuffix(relative_path, codec.Extension()))
+
+	document, err := fs.fileGet(path, codec)
+	if err == nil && document == nil {
+		// like a file with just "null"
+		err = ErrCorruptedFile
+	}
+	if err != nil && !errors.Is(err, c.ErrDocumentDoestNotExist) {
+		problem := &Problem{Kind: ProblemCorrupted, Id: document_id, Detail: err.Error(), Repair: "quarantine"}
+		backup_path, found := backups[path]
+		if found {
+			delete(backups, path)
+			if _, backup_err := fs.fileGet(backup_path, codec); backup_err == nil {
+				problem.Repair = "restore from backup"
+				if repair {
+					return problem, os.Rename(backup_path, path)
+				}
+				return problem, nil
+			}
+		}
+		if repair {
+			if found {
+				err = fs.quarantine(backup_path)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return problem, fs.quarantine(path)
+		}
+		return problem, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stored_id, _ := document["id"].(string)
+	if stored_id != document_id && fs.legacyPath(stored_id)+codec.Extension() == path {
+		// like "x%25y", which reads as the escape of "x%y"
+		document_id = stored_id
+	}
+	if stored_id == document_id {
+		return fs.checkName(path, document_id, codec, repair)
+	}
+	problem := &Problem{
+		Kind:   ProblemIdMismatch,
+		Id:     document_id,
+		Detail: c.S("stored id is '%s'", stored_id),
+		Repair: "fix the stored id",
+	}
+	if repair {
+		document["id"] = document_id
+		document_bytes, err := codec.Marshal(document)
+		if err != nil {
+			return nil, err
+		}
+		document_bytes, err = compress(fs.Compression, fs.CompressionThreshold, document_bytes)
+		if err != nil {
+			return nil, err
+		}
+		err = fs.writeFile(path, document_bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return problem, nil
+}
+
+// checkName renames the document at a legacy path to its escaped path. The
+// legacy file is quarantined when both exist, as the escaped one was written
+// later.
+func (fs *FileStorage) checkName(path string, document_id string, codec Codec, repair bool) (*Problem, error) {
+	escaped_path, err := fs.documentPath(document_id, codec)
+	if err != nil || escaped_path == path {
+		return nil, err
+	}
+
+	exists, err := fs.fileExists(escaped_path)
+	if err != nil {
+		return nil, err
+	}
+	problem := &Problem{
+		Kind:   ProblemLegacyName,
+		Id:     document_id,
+		Detail: "written before the ids were escaped",
+		Repair: "rename to " + fs.relativePath(escaped_path),
+	}
+	if exists {
+		problem.Detail = "written before the ids were escaped, and again after"
+		problem.Repair = "quarantine"
+	}
+	if !repair {
+		return problem, nil
+	}
+	if exists {
+		return problem, fs.quarantine(path)
+	}
+
+	err = fs.writeNames(document_id)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.ensureFolder(escaped_path)
+	if err != nil {
+		return nil, err
+	}
+
+	return problem, os.Rename(path, escaped_path)
+}
+
+// checkBackup handles a backup whose document wasn't corrupted: it's
+// discarded when the document exists and restored otherwise.
+func (fs *FileStorage) checkBackup(backup_path string, repair bool) (Problem, error) {
+	document_path := strings.TrimSuffix(backup_path, backupSuffix)
+	exists, err := fs.fileExists(document_path)
+	if err != nil {
+		return Problem{}, err
+	}
+	if exists {
+		problem := Problem{Kind: ProblemBackup, Detail: "stale backup", Repair: "remove"}
+		if repair {
+			return problem, os.Remove(backup_path)
+		}
+		return problem, nil
+	}
+
+	problem := Problem{Kind: ProblemBackup, Detail: "document missing", Repair: "restore from backup"}
+	for _, codec := range fs.codecs() {
+		if !strings.HasSuffix(document_path, codec.Extension()) {
+			continue
+		}
+		problem.Id = fs.pathId(strings.TrimSuffix(fs.relativePath(document_path), codec.Extension()))
+		_, err = fs.fileGet(backup_path, codec)
+		if err != nil {
+			problem.Detail = c.S("document missing and backup corrupted: %s", err)
+			problem.Repair = "quarantine"
+			if repair {
+				return problem, fs.quarantine(backup_path)
+			}
+			return problem, nil
+		}
+		break
+	}
+	if repair {
+		return problem, os.Rename(backup_path, document_path)
+	}
+
+	return problem, nil
+}
+
+// checkJournal completes the pending commit, or quarantines it when it can't
+// be decoded.
+func (fs *FileStorage) checkJournal(repair bool) (*Problem, error) {
+	journal_path := filepath.Join(fs.Root, journalName)
+	journal_bytes, err := os.ReadFile(journal_path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var operations []Operation
+	err = json.Unmarshal(journal_bytes, &operations)
+	if err != nil {
+		problem := &Problem{Kind: ProblemJournal, Path: journalName, Detail: c.S("corrupted journal: %s", err), Repair: "quarantine", Repaired: repair}
+		if repair {
+			return problem, fs.quarantine(journal_path)
+		}
+		return problem, nil
+	}
+
+	problem := &Problem{Kind: ProblemJournal, Path: journalName, Detail: c.S("pending commit of %d operations", len(operations)), Repair: "complete the commit", Repaired: repair}
+	if repair {
+		err = fs.applyOperations(operations)
+		if err != nil {
+			return nil, err
+		}
+		return problem, os.Remove(journal_path)
+	}
+
+	return problem, nil
+}
+
+// quarantine moves the file to the same path inside the quarantine folder,
+// out of the documents.
+func (fs *FileStorage) quarantine(path string) error {
+	quarantine_path := filepath.Join(fs.Root, quarantineName, fs.relativePath(path))
+	err := os.MkdirAll(filepath.Dir(quarantine_path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path, quarantine_path)
+}
+
+func (fs *FileStorage) relativePath(path string) string {
+	relative_path, err := filepath.Rel(fs.Root, path)
+	if err != nil {
+		return path
+	}
+
+	return filepath.ToSlash(relative_path)
+}
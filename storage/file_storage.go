@@ -1,28 +1,109 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	c "godb/common"
 )
 
+// journalName is the file, inside the root, where the pending commit is kept
+// until all its operations have been applied.
+const journalName = ".journal"
+
+const (
+	tempSuffix   = ".tmp"
+	backupSuffix = ".backup"
+)
+
+// maxNameLength keeps the file names, with the extensions and the temp
+// suffixes added to them, under the 255 bytes most filesystems allow.
+const maxNameLength = 200
+
+// maxFileNameLength is the longest file name most filesystems allow.
+const maxFileNameLength = 255
+
+// bucketPrefix starts the names of the bucket folders of FanOut. It's
+// escaped in the names of the documents and folders.
+const bucketPrefix = "@"
+
+// maxFanOut is the most levels of buckets, one per byte of the hash.
+const maxFanOut = 4
+
+// fanOutName is the file, inside the root, keeping the FanOut its documents
+// were written with. Roots written without FanOut have none.
+const fanOutName = ".fanout"
+
+var ErrFanOutMismatch = errors.New("fan out doesn't match the root's")
+
+// namesFolder is the hidden folder, inside the root, keeping the segments
+// too long to be file names by their hash.
+const namesFolder = ".names"
+
+// FileStorage keeps each document in its own file, inside folders following
+// its id, encoded with Codec (JSON by default). With Compression the files of
+// at least CompressionThreshold bytes are compressed.
 type FileStorage struct {
 	Storage
-	Root string
+	Root                 string
+	Durability           Durability
+	GroupCommitWindow    time.Duration
+	Compression          Compression
+	CompressionThreshold int
+	Codec                Codec
+	// FanOut spreads the documents and folders of every folder in that many
+	// levels of hashed buckets, of 256 folders each, for folders too big for
+	// a single directory. Ids and List stay the same. It's kept in the root
+	// on the first write and can't be changed once the root has data:
+	// opening it with another FanOut fails with ErrFanOutMismatch, migrate it
+	// to a new root instead. Without FanOut the root's one is used.
+	FanOut int
+
+	openOnce      sync.Once
+	openErr       error
+	fanOutOnce    sync.Once
+	fanOutErr     error
+	fanOutLevels  int
+	fanOutWritten atomic.Bool
+	commitMutex   sync.Mutex
+	syncer        durabilitySyncer
 }
 
 func (fs *FileStorage) Get(id string) (c.Document, error) {
-	path := fs.resolvePath(id + ".json")
+	err := fs.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
 
-	return fs.fileGet(path)
+	return fs.get(id)
 }
 
 func (fs *FileStorage) Set(document c.Document) (c.Document, error) {
+	err := fs.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.set(document)
+}
+
+func (fs *FileStorage) set(document c.Document) (c.Document, error) {
 	document_id, err := document.GetId()
 	if err != nil {
 		return nil, err
@@ -31,19 +112,38 @@ func (fs *FileStorage) Set(document c.Document) (c.Document, error) {
 		return nil, c.ErrInvalidId
 	}
 
-	path := fs.resolvePath(document_id + ".json")
+	path, err := fs.documentPath(document_id, fs.codec())
+	if err != nil {
+		return nil, err
+	}
+	err = fs.writeFanOut()
+	if err != nil {
+		return nil, err
+	}
+	err = fs.writeNames(document_id)
+	if err != nil {
+		return nil, err
+	}
+	document, err = fs.fileSet(path, document)
+	if err != nil {
+		return nil, err
+	}
 
-	return fs.fileSet(path, document)
+	return document, fs.removeLegacy(document_id)
 }
 
 func (fs *FileStorage) Patch(document c.Document) (c.Document, error) {
+	err := fs.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+
 	document_id, err := document.GetId()
 	if err != nil {
 		return nil, err
 	}
-	path := fs.resolvePath(document_id + ".json")
 
-	existing_document, err := fs.fileGet(path)
+	existing_document, err := fs.get(document_id)
 	if err != nil {
 		if !errors.Is(err, c.ErrDocumentDoestNotExist) {
 			return nil, err
@@ -55,53 +155,193 @@ func (fs *FileStorage) Patch(document c.Document) (c.Document, error) {
 
 	existing_document.Patch(document)
 
-	return fs.fileSet(path, existing_document)
+	return fs.set(existing_document)
 }
 
 func (fs *FileStorage) Exists(id string) (bool, error) {
-	path := fs.resolvePath(id + ".json")
+	err := fs.ensureOpen()
+	if err != nil {
+		return false, err
+	}
 
-	return fs.fileExists(path)
+	for _, codec := range fs.codecs() {
+		paths, err := fs.documentPaths(id, codec)
+		if err != nil {
+			return false, err
+		}
+		for _, path := range paths {
+			exists, err := fs.fileExists(path)
+			if err != nil || exists {
+				return exists, err
+			}
+		}
+	}
+
+	return false, nil
 }
 
 func (fs *FileStorage) List(folder string) ([]string, error) {
-	path := fs.resolvePath(folder)
+	err := fs.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.list(folder)
+}
 
-	files, err := ioutil.ReadDir(path)
+// Iterate reads the folders as they're reached, so big roots are walked
+// without listing them whole. Each folder is streamed from the directory,
+// keeping only the ids after StartAfter and, when not recursive, the first
+// Limit of them.
+func (fs *FileStorage) Iterate(folder string, options IterateOptions) Iterator {
+	err := fs.ensureOpen()
+	if err != nil {
+		return &sliceIterator{err: err}
+	}
+
+	iterator := newListIterator(fs.list, fs.get, folder, options)
+	iterator.listAfter = fs.listAfter
+
+	return iterator
+}
+
+func (fs *FileStorage) list(folder string) ([]string, error) {
+	return fs.listAfter(folder, "", 0)
+}
+
+// listAfter returns the sorted simple ids of the folder after the given one,
+// or whose folder holds it, at most limit of them when positive.
+func (fs *FileStorage) listAfter(folder string, after string, limit int) ([]string, error) {
+	path, err := fs.resolvePath(folder)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return []string{}, nil
-		}
 		return nil, err
 	}
+	paths := []string{path}
+	if legacy_path := fs.legacyPath(folder); legacy_path != "" && legacy_path != path {
+		paths = append(paths, legacy_path)
+	}
 
+	seen := map[string]bool{}
 	simple_ids := []string{}
-	for _, f := range files {
-		simple_id := f.Name()
-		if strings.HasSuffix(f.Name(), ".json") {
-			simple_id = strings.TrimSuffix(simple_id, ".json")
-		} else {
+	add := func(entry os.DirEntry) {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			return
+		}
+		if !entry.IsDir() {
+			var found bool
+			name, found = trimExtension(name, fs.codecs())
+			if !found {
+				return
+			}
+		}
+		simple_id := fs.segment(name)
+		if entry.IsDir() {
 			simple_id += "/"
 		}
+		if after != "" && simple_id <= after && !(entry.IsDir() && strings.HasPrefix(after, simple_id)) {
+			return
+		}
+		// a document can be in two codecs if the root's codec changed and
+		// the write was interrupted
+		if seen[simple_id] {
+			return
+		}
+		seen[simple_id] = true
 		simple_ids = append(simple_ids, simple_id)
+
+		if limit > 0 && len(simple_ids) >= 2*limit {
+			sort.Strings(simple_ids)
+			simple_ids = simple_ids[:limit]
+		}
+	}
+	for _, path := range paths {
+		err = fs.readEntries(path, fs.fanOut(), add)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(simple_ids)
+	if limit > 0 && len(simple_ids) > limit {
+		simple_ids = simple_ids[:limit]
 	}
 
 	return simple_ids, nil
 }
 
-func (fs *FileStorage) Delete(id string) error {
-	path := fs.resolvePath(id + ".json")
+// dirBatch is how many entries of a folder are read at a time.
+const dirBatch = 256
 
-	err := fs.ensureFolder(path)
+// readEntries calls f with the entries of the folder, read in batches and
+// without stat'ing them, or with those of its buckets down to the given
+// levels. A missing folder has no entries.
+func (fs *FileStorage) readEntries(path string, levels int, f func(entry os.DirEntry)) error {
+	dir, err := os.Open(path)
 	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
 		return err
 	}
+	defer dir.Close()
+
+	for {
+		entries, err := dir.ReadDir(dirBatch)
+		for _, entry := range entries {
+			if levels == 0 {
+				f(entry)
+				continue
+			}
+			if !entry.IsDir() || !strings.HasPrefix(entry.Name(), bucketPrefix) {
+				continue
+			}
+			err := fs.readEntries(filepath.Join(path, entry.Name()), levels-1, f)
+			if err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
 
-	err = os.Remove(path)
+func (fs *FileStorage) Delete(id string) error {
+	err := fs.ensureOpen()
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return c.ErrDocumentDoestNotExist
+		return err
+	}
+
+	return fs.delete(id)
+}
+
+func (fs *FileStorage) delete(id string) error {
+	deleted := false
+	for _, codec := range fs.codecs() {
+		paths, err := fs.documentPaths(id, codec)
+		if err != nil {
+			return err
 		}
+		for _, path := range paths {
+			err = os.Remove(path)
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				return err
+			}
+			deleted = true
+		}
+	}
+	if !deleted {
+		return c.ErrDocumentDoestNotExist
+	}
+	err := fs.deleteAttachments(id)
+	if err != nil {
 		return err
 	}
 
@@ -109,90 +349,350 @@ func (fs *FileStorage) Delete(id string) error {
 }
 
 func (fs *FileStorage) DeleteFolder(folder string) error {
-	path := fs.resolvePath(folder)
+	err := fs.ensureOpen()
+	if err != nil {
+		return err
+	}
+
+	return fs.deleteFolder(folder)
+}
+
+func (fs *FileStorage) deleteFolder(folder string) error {
+	folder = strings.Trim(folder, "/")
+	if folder == "" {
+		return fs.deleteRoot()
+	}
 
-	err := os.RemoveAll(path)
+	path, err := fs.resolvePath(folder)
 	if err != nil {
 		return err
 	}
 
+	err = os.RemoveAll(path)
+	if err != nil {
+		return err
+	}
+	if legacy_path := fs.legacyPath(folder); legacy_path != "" && legacy_path != path {
+		err = os.RemoveAll(legacy_path)
+		if err != nil {
+			return err
+		}
+	}
+
 	return fs.removeEmptyFolders(folder)
 }
 
-func (fs *FileStorage) fileGet(path string) (c.Document, error) {
-	err := fs.ensureFolder(path)
+// Commit writes the operations to the journal before applying them, so a
+// crash in the middle of the commit is completed the next time the root is
+// opened. A commit that failed while applying is completed before the next
+// one, and commits are serialized, so the journal is never overwritten while
+// pending.
+func (fs *FileStorage) Commit(operations []Operation) error {
+	err := fs.ensureOpen()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	document_bytes, err := os.ReadFile(path)
+	fs.commitMutex.Lock()
+	defer fs.commitMutex.Unlock()
+
+	for _, operation := range operations {
+		id := operation.Id
+		if operation.Type == OperationSet {
+			id, err = operation.Document.GetId()
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fs.resolvePath(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = fs.replayJournal()
+	if err != nil {
+		return err
+	}
+
+	journal_path := filepath.Join(fs.Root, journalName)
+	err = fs.writeJournal(journal_path, operations)
+	if err != nil {
+		return err
+	}
+
+	err = fs.applyOperations(operations)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(journal_path)
+}
+
+func (fs *FileStorage) ensureOpen() error {
+	fs.openOnce.Do(func() {
+		fs.openErr = fs.loadFanOut()
+		if fs.openErr == nil {
+			fs.openErr = fs.recover()
+		}
+	})
+
+	return fs.openErr
+}
+
+// recover cleans up the writes interrupted by a crash and finishes the
+// commit left in the journal, if any.
+func (fs *FileStorage) recover() error {
+	err := fs.recoverFiles()
+	if err != nil {
+		return err
+	}
+
+	return fs.replayJournal()
+}
+
+// replayJournal applies the pending commit, if any, and removes the journal.
+func (fs *FileStorage) replayJournal() error {
+	journal_path := filepath.Join(fs.Root, journalName)
+	journal_bytes, err := os.ReadFile(journal_path)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			return nil, c.ErrDocumentDoestNotExist
+			return nil
 		}
-		return nil, err
+		return err
 	}
 
-	document := c.Document{}
-	err = json.Unmarshal(document_bytes, &document)
+	var operations []Operation
+	err = json.Unmarshal(journal_bytes, &operations)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	err = fs.applyOperations(operations)
+	if err != nil {
+		return err
 	}
 
-	return document, err
+	return os.Remove(journal_path)
 }
 
-func (fs *FileStorage) fileCreate(path string, document c.Document) error {
-	err := fs.ensureFolder(path)
+// recoverFiles removes the temp files of unfinished writes and resolves the
+// backups left by the previous write protocol: a backup whose document is
+// missing was about to be renamed into place, otherwise it's discarded.
+func (fs *FileStorage) recoverFiles() error {
+	err := filepath.WalkDir(fs.Root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
 
-	// open file for creation
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.ModePerm)
+		if strings.HasSuffix(path, tempSuffix) {
+			return os.Remove(path)
+		}
+		if strings.HasSuffix(path, backupSuffix) {
+			document_path := strings.TrimSuffix(path, backupSuffix)
+			exists, err := fs.fileExists(document_path)
+			if err != nil {
+				return err
+			}
+			if exists {
+				return os.Remove(path)
+			}
+			return os.Rename(path, document_path)
+		}
+
+		return nil
+	})
 	if err != nil {
-		if errors.Is(err, os.ErrExist) {
-			return c.ErrDocumentAlreadyExists
+		return err
+	}
+
+	return fs.sync(fs.Root)
+}
+
+func (fs *FileStorage) applyOperations(operations []Operation) error {
+	for _, operation := range operations {
+		var err error
+		switch operation.Type {
+		case OperationSet:
+			_, err = fs.set(operation.Document)
+		case OperationDelete:
+			err = fs.delete(operation.Id)
+			if errors.Is(err, c.ErrDocumentDoestNotExist) {
+				err = nil
+			}
+		case OperationDeleteFolder:
+			err = fs.deleteFolder(operation.Id)
+		}
+		if err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
+
+func (fs *FileStorage) writeJournal(path string, operations []Operation) error {
+	journal_bytes, err := json.Marshal(operations)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(fs.Root, os.ModePerm)
+	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	// serialize
-	document_bytes, err := json.Marshal(document)
+	return fs.writeFile(path, journal_bytes)
+}
+
+// deleteRoot removes every document of the root but keeps the journal.
+func (fs *FileStorage) deleteRoot() error {
+	files, err := ioutil.ReadDir(fs.Root)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
 		return err
 	}
 
-	// write
-	_, err = file.Write(document_bytes)
+	for _, f := range files {
+		if f.Name() == journalName || f.Name() == fanOutName {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(fs.Root, f.Name()))
+		if err != nil {
+			return err
+		}
+	}
 
-	return err
+	return nil
 }
 
-func (fs *FileStorage) fileSet(path string, document c.Document) (c.Document, error) {
-	backup_path := path + ".backup"
+// get reads the document from the file of the root's codec or, when missing,
+// of any other codec.
+func (fs *FileStorage) get(id string) (c.Document, error) {
+	for _, codec := range fs.codecs() {
+		paths, err := fs.documentPaths(id, codec)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			document, err := fs.fileGet(path, codec)
+			if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+				return document, err
+			}
+		}
+	}
 
+	return nil, c.ErrDocumentDoestNotExist
+}
+
+func (fs *FileStorage) fileGet(path string, codec Codec) (c.Document, error) {
+	document_bytes, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, c.ErrDocumentDoestNotExist
+		}
+		return nil, err
+	}
+	document_bytes, err = decompress(document_bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return codec.Unmarshal(document_bytes)
+}
+
+func (fs *FileStorage) fileSet(path string, document c.Document) (c.Document, error) {
 	err := fs.ensureFolder(path)
 	if err != nil {
 		return nil, err
 	}
 
-	err = fs.fileCreate(backup_path, document)
+	document_bytes, err := fs.codec().Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	document_bytes, err = compress(fs.Compression, fs.CompressionThreshold, document_bytes)
 	if err != nil {
 		return nil, err
 	}
 
-	err = os.Remove(path)
+	err = fs.writeFile(path, document_bytes)
 	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// the document could have been written before with another codec
+	document_path := strings.TrimSuffix(path, fs.codec().Extension())
+	for _, codec := range fs.codecs()[1:] {
+		err = os.Remove(document_path + codec.Extension())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
 			return nil, err
 		}
 	}
 
-	err = os.Rename(backup_path, path)
+	return document, nil
+}
+
+// writeFile atomically replaces the file at path: the data is written and
+// synced to a hidden temp file in the same folder that is then renamed over
+// the destination. Leftover temp files are removed when the root is opened.
+func (fs *FileStorage) writeFile(path string, data []byte) error {
+	return fs.writeStream(path, bytes.NewReader(data))
+}
+
+// writeStream is writeFile for content read as it's written.
+func (fs *FileStorage) writeStream(path string, content io.Reader) error {
+	temp_path, err := fs.writeTemp(path, content)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	err = os.Rename(temp_path, path)
+	if err != nil {
+		os.Remove(temp_path)
+		return err
 	}
 
-	return document, nil
+	return fs.sync(filepath.Dir(path))
+}
+
+// writeTemp writes and syncs the content to a hidden temp file next to path,
+// returning its path.
+func (fs *FileStorage) writeTemp(path string, content io.Reader) (string, error) {
+	folder, name := filepath.Split(path)
+	file, err := os.CreateTemp(folder, "."+name+".*"+tempSuffix)
+	if err != nil {
+		return "", err
+	}
+	temp_path := file.Name()
+
+	_, err = io.Copy(file, content)
+	close_err := file.Close()
+	if err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = fs.sync(temp_path)
+	}
+	if err != nil {
+		os.Remove(temp_path)
+		return "", err
+	}
+
+	return temp_path, nil
+}
+
+// sync flushes the file or folder at path to disk as the durability mode
+// demands.
+func (fs *FileStorage) sync(path string) error {
+	return fs.syncer.sync(fs.Durability, fs.GroupCommitWindow, path)
 }
 
 func (fs *FileStorage) fileExists(path string) (bool, error) {
@@ -207,42 +707,354 @@ func (fs *FileStorage) fileExists(path string) (bool, error) {
 	return true, nil
 }
 
-func (fs *FileStorage) resolvePath(relative_path string) string {
-	if strings.Contains(relative_path, "..") {
-		panic("NO!! '" + relative_path + "'")
+func (fs *FileStorage) documentPath(id string, codec Codec) (string, error) {
+	path, err := fs.resolvePath(id)
+	if err != nil {
+		return "", err
+	}
+	if path == fs.Root {
+		return "", c.ErrInvalidId
 	}
-	return filepath.Join(fs.Root, relative_path)
+
+	return path + codec.Extension(), nil
 }
 
-func (fs *FileStorage) ensureFolder(path string) error {
-	folder := c.Folder(path)
+// documentPaths returns the path of the id followed, when it differs, by its
+// legacy path.
+func (fs *FileStorage) documentPaths(id string, codec Codec) ([]string, error) {
+	path, err := fs.documentPath(id, codec)
+	if err != nil {
+		return nil, err
+	}
+	legacy_path := fs.legacyPath(id)
+	if legacy_path == "" || legacy_path+codec.Extension() == path || len(filepath.Base(legacy_path)+codec.Extension()) > maxFileNameLength {
+		return []string{path}, nil
+	}
 
-	return os.MkdirAll(folder, os.ModePerm)
+	return []string{path, legacy_path + codec.Extension()}, nil
 }
 
-func (fs *FileStorage) removeEmptyFolders(id string) error {
+// legacyPath returns the path the id had before its segments were escaped,
+// so the roots written back then can still be read, or "" when it couldn't
+// have been written. FanOut came later, so its roots have no legacy paths.
+// Check renames the legacy files to their escaped paths.
+func (fs *FileStorage) legacyPath(id string) string {
+	id = strings.Trim(id, "/")
+	if fs.fanOut() > 0 || id == "" {
+		return ""
+	}
+	for _, segment := range strings.Split(id, "/") {
+		if segment == "" || len(segment) > maxFileNameLength || strings.HasPrefix(segment, ".") || strings.ContainsAny(segment, "\\\x00") {
+			return ""
+		}
+	}
+
+	return filepath.Join(fs.Root, filepath.FromSlash(id))
+}
+
+// removeLegacy removes the legacy files of the id, once it has been written
+// to its escaped path.
+func (fs *FileStorage) removeLegacy(id string) error {
+	removed := false
+	for _, codec := range fs.codecs() {
+		paths, err := fs.documentPaths(id, codec)
+		if err != nil {
+			return err
+		}
+		for _, path := range paths[1:] {
+			err = os.Remove(path)
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				return err
+			}
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+
+	return fs.removeEmptyPaths(filepath.Dir(fs.legacyPath(id)))
+}
+
+func (fs *FileStorage) codec() Codec {
+	if fs.Codec == nil {
+		return JSONCodec
+	}
+
+	return fs.Codec
+}
+
+// codecs returns the codec of the root, which can be a custom one, followed
+// by the rest of the known codecs.
+func (fs *FileStorage) codecs() []Codec {
+	root_codecs := []Codec{fs.codec()}
+	for _, codec := range codecs {
+		if codec.Extension() != fs.codec().Extension() {
+			root_codecs = append(root_codecs, codec)
+		}
+	}
+
+	return root_codecs
+}
+
+// resolvePath returns the path of the id inside the root, escaping each of
+// its segments, so any id is a valid path and can't go out of the root.
+func (fs *FileStorage) resolvePath(id string) (string, error) {
+	id = strings.Trim(id, "/")
+	if len(id) > c.MaxIdLength {
+		return "", c.ErrInvalidId
+	}
 	if id == "" {
+		return fs.Root, nil
+	}
+
+	elements := []string{fs.Root}
+	for _, segment := range strings.Split(id, "/") {
+		elements = append(elements, fs.buckets(segment)...)
+		elements = append(elements, fs.fileName(segment))
+	}
+
+	return filepath.Join(elements...), nil
+}
+
+// buckets returns the folders the segment goes in with FanOut: "@" and a
+// byte of its hash in hex for each level.
+func (fs *FileStorage) buckets(segment string) []string {
+	levels := fs.fanOut()
+	if levels == 0 {
 		return nil
 	}
 
-	path := fs.resolvePath(id)
-	files, err := ioutil.ReadDir(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			parentFolder := c.Folder(id)
-			return fs.removeEmptyFolders(parentFolder)
+	hash := fnv.New32a()
+	hash.Write([]byte(segment))
+	sum := hash.Sum(nil)
+
+	buckets := make([]string, levels)
+	for i := range buckets {
+		buckets[i] = bucketPrefix + hex.EncodeToString(sum[i:i+1])
+	}
+
+	return buckets
+}
+
+// fanOut returns the levels of buckets of the root, once loaded.
+func (fs *FileStorage) fanOut() int {
+	return fs.fanOutLevels
+}
+
+// loadFanOut reads the FanOut kept in the root, failing with
+// ErrFanOutMismatch when FanOut is set to another one, or set on a root
+// that has data written without it.
+func (fs *FileStorage) loadFanOut() error {
+	fs.fanOutOnce.Do(func() {
+		fs.fanOutLevels, fs.fanOutErr = fs.readFanOut()
+	})
+
+	return fs.fanOutErr
+}
+
+func (fs *FileStorage) readFanOut() (int, error) {
+	levels := fs.FanOut
+	if levels > maxFanOut {
+		levels = maxFanOut
+	}
+	if levels < 0 {
+		levels = 0
+	}
+
+	fan_out_bytes, err := os.ReadFile(filepath.Join(fs.Root, fanOutName))
+	if err == nil {
+		root_levels, err := strconv.Atoi(strings.TrimSpace(string(fan_out_bytes)))
+		if err != nil || root_levels < 0 || root_levels > maxFanOut {
+			return 0, fmt.Errorf("%w '%s'", ErrCorruptedFile, fanOutName)
 		}
+		if levels != 0 && levels != root_levels {
+			return 0, fmt.Errorf("%w: it has %d levels of buckets, not %d", ErrFanOutMismatch, root_levels, levels)
+		}
+		fs.fanOutWritten.Store(true)
+		return root_levels, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	if levels == 0 {
+		return 0, nil
+	}
+
+	entries, err := os.ReadDir(fs.Root)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") {
+			return 0, fmt.Errorf("%w: it has documents written without buckets", ErrFanOutMismatch)
+		}
+	}
+
+	return levels, nil
+}
+
+// writeFanOut keeps the FanOut in the root before its first document is
+// written.
+func (fs *FileStorage) writeFanOut() error {
+	if fs.fanOut() == 0 || fs.fanOutWritten.Load() {
+		return nil
+	}
+
+	path := filepath.Join(fs.Root, fanOutName)
+	err := fs.ensureFolder(path)
+	if err != nil {
+		return err
+	}
+	err = fs.writeFile(path, []byte(strconv.Itoa(fs.fanOut())))
+	if err != nil {
 		return err
 	}
-	if len(files) != 0 {
+	fs.fanOutWritten.Store(true)
+
+	return nil
+}
+
+// fileName escapes the segment with c.EscapeSegment, and its leading "@"
+// with FanOut so it can't be taken for a bucket. The names too long for
+// the filesystems are cut and suffixed with "%%" and the hash of the
+// segment, which is kept in the names folder to list it back.
+func (fs *FileStorage) fileName(segment string) string {
+	name := c.EscapeSegment(segment)
+	if fs.fanOut() > 0 && strings.HasPrefix(name, bucketPrefix) {
+		name = "%40" + name[len(bucketPrefix):]
+	}
+	if len(name) <= maxNameLength {
+		return name
+	}
+
+	// without splitting an escape or a rune
+	cut := maxNameLength / 2
+	for cut > 2 && (!utf8.RuneStart(name[cut]) || strings.IndexByte(name[cut-2:cut], '%') >= 0) {
+		cut--
+	}
+
+	return name[:cut] + "%%" + segmentHash(segment)
+}
+
+func segmentHash(segment string) string {
+	hash := sha256.Sum256([]byte(segment))
+
+	return hex.EncodeToString(hash[:16])
+}
+
+// segment reverses fileName. Names that fileName wouldn't have written, like
+// "100%" or "a%20b", are legacy names written before the escaping, and are
+// kept as they are.
+func (fs *FileStorage) segment(name string) string {
+	if i := strings.Index(name, "%%"); i >= 0 {
+		segment_bytes, err := os.ReadFile(filepath.Join(fs.Root, namesFolder, name[i+2:]))
+		if err == nil {
+			return string(segment_bytes)
+		}
+		return name
+	}
+
+	segment, err := c.UnescapeSegment(name)
+	if err != nil || fs.fileName(segment) != name {
+		return name
+	}
+
+	return segment
+}
+
+// pathId returns the id of the path, relative to the root, without the
+// extension.
+func (fs *FileStorage) pathId(relative_path string) string {
+	segments := []string{}
+	for _, name := range strings.Split(filepath.ToSlash(relative_path), "/") {
+		if fs.fanOut() > 0 && strings.HasPrefix(name, bucketPrefix) {
+			continue
+		}
+		segments = append(segments, fs.segment(name))
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// writeNames keeps the segments of the id too long to be file names.
+func (fs *FileStorage) writeNames(id string) error {
+	for _, segment := range strings.Split(strings.Trim(id, "/"), "/") {
+		err := fs.writeName(segment)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fs *FileStorage) writeName(segment string) error {
+	if !strings.Contains(fs.fileName(segment), "%%") {
 		return nil
 	}
 
-	err = os.Remove(path)
+	path := filepath.Join(fs.Root, namesFolder, segmentHash(segment))
+	exists, err := fs.fileExists(path)
+	if err != nil || exists {
+		return err
+	}
+	err = fs.ensureFolder(path)
+	if err != nil {
+		return err
+	}
+
+	return fs.writeFile(path, []byte(segment))
+}
+
+func (fs *FileStorage) ensureFolder(path string) error {
+	folder := c.Folder(path)
+
+	return os.MkdirAll(folder, os.ModePerm)
+}
+
+// removeEmptyFolders removes the folder of the id, if empty, and then its
+// parents, buckets included, up to the root.
+func (fs *FileStorage) removeEmptyFolders(id string) error {
+	path, err := fs.resolvePath(id)
 	if err != nil {
 		return err
 	}
+	if legacy_path := fs.legacyPath(id); legacy_path != "" && legacy_path != path {
+		err = fs.removeEmptyPaths(legacy_path)
+		if err != nil {
+			return err
+		}
+	}
 
-	parentFolder := c.Folder(id)
-	return fs.removeEmptyFolders(parentFolder)
+	return fs.removeEmptyPaths(path)
+}
+
+// removeEmptyPaths removes the folder at path, if empty, and then its
+// parents up to the root.
+func (fs *FileStorage) removeEmptyPaths(path string) error {
+	for {
+		relative_path, err := filepath.Rel(fs.Root, path)
+		if err != nil || relative_path == "." || strings.HasPrefix(relative_path, "..") {
+			return nil
+		}
+
+		files, err := ioutil.ReadDir(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(files) != 0 {
+			return nil
+		}
+		if err == nil {
+			err = os.Remove(path)
+			if err != nil {
+				return err
+			}
+		}
+		path = filepath.Dir(path)
+	}
 }
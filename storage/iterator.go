@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	c "godb/common"
+)
+
+// IterateOptions tunes Iterate. Ids are relative to the iterated folder and
+// come in lexical order, so the last one seen can be used as StartAfter to
+// get the next page.
+type IterateOptions struct {
+	// Recursive yields the documents of the subfolders too, instead of the
+	// subfolders themselves ("name/", as List does).
+	Recursive bool
+	// StartAfter skips the ids up to this one, included.
+	StartAfter string
+	// Limit stops after this many ids. Zero means no limit.
+	Limit int
+	// IncludeDocuments reads the documents along with their ids.
+	IncludeDocuments bool
+}
+
+type Iterator interface {
+	Next() bool
+	Id() string
+	// Document is only set with IncludeDocuments, and nil for folders.
+	Document() c.Document
+	Err() error
+	Close() error
+}
+
+// IterableStorage is implemented by the storages that can iterate a folder
+// better than listing it.
+type IterableStorage interface {
+	Iterate(folder string, options IterateOptions) Iterator
+}
+
+// Iterate iterates the folder natively when the storage supports it, or on
+// top of List and Get otherwise.
+func Iterate(storage Storage, folder string, options IterateOptions) Iterator {
+	iterable, ok := storage.(IterableStorage)
+	if ok {
+		return iterable.Iterate(folder, options)
+	}
+
+	return newListIterator(storage.List, storage.Get, folder, options)
+}
+
+// listIterator lists the folders lazily, one at a time, going down the
+// subfolders as they're found when recursive.
+type listIterator struct {
+	list func(folder string) ([]string, error)
+	// listAfter, when set, lists only the ids after the given one, and at
+	// most limit of them, instead of the whole folder.
+	listAfter func(folder string, after string, limit int) ([]string, error)
+	get       func(id string) (c.Document, error)
+	folder    string
+	options   IterateOptions
+
+	started  bool
+	frames   []listFrame
+	count    int
+	id       string
+	document c.Document
+	err      error
+}
+
+type listFrame struct {
+	prefix     string
+	simple_ids []string
+	next       int
+}
+
+func newListIterator(
+	list func(folder string) ([]string, error),
+	get func(id string) (c.Document, error),
+	folder string,
+	options IterateOptions,
+) *listIterator {
+	return &listIterator{
+		list:    list,
+		get:     get,
+		folder:  strings.Trim(folder, "/"),
+		options: options,
+	}
+}
+
+func (it *listIterator) Next() bool {
+	it.id = ""
+	it.document = nil
+	if it.err != nil || (it.options.Limit > 0 && it.count >= it.options.Limit) {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		it.push("")
+	}
+
+	for it.err == nil && len(it.frames) > 0 {
+		frame := &it.frames[len(it.frames)-1]
+		if frame.next >= len(frame.simple_ids) {
+			it.frames = it.frames[:len(it.frames)-1]
+			continue
+		}
+		id := frame.prefix + frame.simple_ids[frame.next]
+		frame.next++
+
+		is_folder := strings.HasSuffix(id, "/")
+		if is_folder && it.options.Recursive {
+			// all the ids inside the folder start with it
+			if it.options.StartAfter <= id || strings.HasPrefix(it.options.StartAfter, id) {
+				it.push(id)
+			}
+			continue
+		}
+		if it.options.StartAfter != "" && id <= it.options.StartAfter {
+			continue
+		}
+
+		if it.options.IncludeDocuments && !is_folder {
+			document, err := it.get(it.join(id))
+			if errors.Is(err, c.ErrDocumentDoestNotExist) {
+				// deleted while iterating
+				continue
+			}
+			if err != nil {
+				it.err = err
+				return false
+			}
+			it.document = document
+		}
+
+		it.id = id
+		it.count++
+		return true
+	}
+
+	return false
+}
+
+func (it *listIterator) Id() string {
+	return it.id
+}
+
+func (it *listIterator) Document() c.Document {
+	return it.document
+}
+
+func (it *listIterator) Err() error {
+	return it.err
+}
+
+func (it *listIterator) Close() error {
+	it.started = true
+	it.frames = nil
+
+	return nil
+}
+
+// push lists the folder, relative to the iterated one, skipping the ids up to
+// StartAfter.
+func (it *listIterator) push(prefix string) {
+	relative_start := ""
+	if strings.HasPrefix(it.options.StartAfter, prefix) {
+		relative_start = strings.TrimPrefix(it.options.StartAfter, prefix)
+	}
+
+	var simple_ids []string
+	var err error
+	if it.listAfter != nil {
+		// without recursion every id listed is yielded
+		limit := 0
+		if !it.options.Recursive && it.options.Limit > 0 {
+			limit = it.options.Limit
+		}
+		simple_ids, err = it.listAfter(it.join(prefix), relative_start, limit)
+	} else {
+		simple_ids, err = it.list(it.join(prefix))
+	}
+	if err != nil {
+		it.err = err
+		return
+	}
+	sort.Strings(simple_ids)
+
+	next := 0
+	if it.options.StartAfter != "" {
+		if strings.HasPrefix(it.options.StartAfter, prefix) {
+			// the subfolder holding StartAfter still has to be visited
+			next = sort.Search(len(simple_ids), func(i int) bool {
+				simple_id := simple_ids[i]
+				return simple_id > relative_start ||
+					(strings.HasSuffix(simple_id, "/") && strings.HasPrefix(relative_start, simple_id))
+			})
+		}
+	}
+
+	it.frames = append(it.frames, listFrame{prefix: prefix, simple_ids: simple_ids, next: next})
+}
+
+func (it *listIterator) join(id string) string {
+	id = strings.TrimSuffix(id, "/")
+	if it.folder == "" {
+		return id
+	}
+	if id == "" {
+		return it.folder
+	}
+
+	return it.folder + "/" + id
+}
+
+// sliceIterator iterates ids already collected and sorted.
+type sliceIterator struct {
+	ids       []string
+	documents []c.Document
+	next      int
+	err       error
+}
+
+func newSliceIterator(ids []string, documents []c.Document, options IterateOptions) *sliceIterator {
+	start := 0
+	if options.StartAfter != "" {
+		start = sort.Search(len(ids), func(i int) bool {
+			return ids[i] > options.StartAfter
+		})
+	}
+	end := len(ids)
+	if options.Limit > 0 && start+options.Limit < end {
+		end = start + options.Limit
+	}
+
+	iterator := &sliceIterator{ids: ids[start:end], next: -1}
+	if documents != nil {
+		iterator.documents = documents[start:end]
+	}
+
+	return iterator
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.err != nil || it.next+1 >= len(it.ids) {
+		it.next = len(it.ids)
+		return false
+	}
+	it.next++
+
+	return true
+}
+
+func (it *sliceIterator) Id() string {
+	if it.next < 0 || it.next >= len(it.ids) {
+		return ""
+	}
+
+	return it.ids[it.next]
+}
+
+func (it *sliceIterator) Document() c.Document {
+	if it.documents == nil || it.next < 0 || it.next >= len(it.ids) {
+		return nil
+	}
+
+	return it.documents[it.next]
+}
+
+func (it *sliceIterator) Err() error {
+	return it.err
+}
+
+func (it *sliceIterator) Close() error {
+	it.ids = nil
+	it.documents = nil
+
+	return nil
+}
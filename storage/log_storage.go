@@ -0,0 +1,744 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	c "godb/common"
+)
+
+const (
+	defaultSegmentSize     = 64 << 20
+	defaultCompactionRatio = 0.5
+	segmentSuffix          = ".log"
+	recordHeaderSize       = 8
+)
+
+// LogStorage appends every write as a record to segment files and keeps in
+// memory a key directory pointing to the last record of each document.
+// Segments are compacted in the background once dead records take more than
+// CompactionRatio of them, and replayed when the root is opened.
+//
+// Record layout: crc32 (4 bytes) + payload length (4 bytes) + JSON payload.
+type LogStorage struct {
+	Storage
+	Root string
+	// SegmentSize is the size after which a new segment is started.
+	SegmentSize int64
+	// CompactionRatio of dead bytes that triggers a compaction. Values above 1
+	// disable background compactions.
+	CompactionRatio   float64
+	Durability        Durability
+	GroupCommitWindow time.Duration
+
+	mutex        sync.RWMutex
+	compactMutex sync.Mutex
+	compactions  sync.WaitGroup
+	compacting   bool
+	openOnce     sync.Once
+	openErr      error
+	syncer       durabilitySyncer
+
+	keydir        map[string]logEntry
+	segments      map[int]*os.File
+	activeSegment int
+	activeSize    int64
+	lastSegment   int
+	totalBytes    int64
+	liveBytes     int64
+	seq           uint64
+}
+
+type logEntry struct {
+	segment int
+	offset  int64
+	size    int64
+}
+
+type logRecord struct {
+	Seq       uint64    `json:"seq"`
+	Operation Operation `json:"op"`
+	// Pending marks the records of a batch that aren't the last one, so an
+	// incomplete batch can be discarded on replay.
+	Pending bool `json:"pending,omitempty"`
+}
+
+type scannedRecord struct {
+	seq       uint64
+	operation Operation
+	entry     logEntry
+}
+
+func (ls *LogStorage) Get(id string) (c.Document, error) {
+	err := ls.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	ls.mutex.RLock()
+	defer ls.mutex.RUnlock()
+
+	return ls.get(id)
+}
+
+func (ls *LogStorage) Set(document c.Document) (c.Document, error) {
+	err := ls.Commit([]Operation{{Type: OperationSet, Document: document}})
+	if err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+func (ls *LogStorage) Patch(document c.Document) (c.Document, error) {
+	err := ls.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	document_id, err := document.GetId()
+	if err != nil {
+		return nil, err
+	}
+
+	existing_document, err := ls.get(document_id)
+	if err != nil {
+		if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+			return nil, err
+		}
+		existing_document = c.NewDocument(document_id)
+	}
+
+	existing_document.Patch(document)
+
+	err = ls.write([]Operation{{Type: OperationSet, Id: document_id, Document: existing_document}})
+	if err != nil {
+		return nil, err
+	}
+
+	return existing_document, nil
+}
+
+func (ls *LogStorage) Exists(id string) (bool, error) {
+	err := ls.ensureOpen()
+	if err != nil {
+		return false, err
+	}
+
+	ls.mutex.RLock()
+	defer ls.mutex.RUnlock()
+
+	_, exists := ls.keydir[id]
+
+	return exists, nil
+}
+
+func (ls *LogStorage) List(folder string) ([]string, error) {
+	err := ls.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	ls.mutex.RLock()
+	defer ls.mutex.RUnlock()
+
+	folder = strings.Trim(folder, "/")
+	seen := map[string]bool{}
+	simple_ids := []string{}
+	for document_id := range ls.keydir {
+		if folder != "" && !strings.HasPrefix(document_id, folder+"/") {
+			continue
+		}
+		relative_id := strings.Trim(strings.TrimPrefix(document_id, folder), "/")
+		relative_id_parts := strings.Split(relative_id, "/")
+
+		simple_id := relative_id_parts[0]
+		if len(relative_id_parts) > 1 {
+			simple_id += "/"
+		}
+		if !seen[simple_id] {
+			seen[simple_id] = true
+			simple_ids = append(simple_ids, simple_id)
+		}
+	}
+	sort.Strings(simple_ids)
+
+	return simple_ids, nil
+}
+
+func (ls *LogStorage) Delete(id string) error {
+	err := ls.ensureOpen()
+	if err != nil {
+		return err
+	}
+
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	if _, exists := ls.keydir[id]; !exists {
+		return c.ErrDocumentDoestNotExist
+	}
+
+	return ls.write([]Operation{{Type: OperationDelete, Id: id}})
+}
+
+func (ls *LogStorage) DeleteFolder(folder string) error {
+	return ls.Commit([]Operation{{Type: OperationDeleteFolder, Id: strings.Trim(folder, "/")}})
+}
+
+func (ls *LogStorage) Commit(operations []Operation) error {
+	err := ls.ensureOpen()
+	if err != nil {
+		return err
+	}
+
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	return ls.write(operations)
+}
+
+// Compact rewrites the live records of all the segments but the active one
+// into new segments, and removes the old ones.
+func (ls *LogStorage) Compact() error {
+	err := ls.ensureOpen()
+	if err != nil {
+		return err
+	}
+
+	ls.compactMutex.Lock()
+	defer ls.compactMutex.Unlock()
+
+	// seal the active segment so writes don't go to the compacted ones
+	ls.mutex.Lock()
+	if ls.activeSize > 0 {
+		err = ls.rotate()
+		if err != nil {
+			ls.mutex.Unlock()
+			return err
+		}
+	}
+	sealed_segments := map[int]bool{}
+	for segment := range ls.segments {
+		if segment != ls.activeSegment {
+			sealed_segments[segment] = true
+		}
+	}
+	live_entries := map[string]logEntry{}
+	for id, entry := range ls.keydir {
+		if sealed_segments[entry.segment] {
+			live_entries[id] = entry
+		}
+	}
+	ls.mutex.Unlock()
+
+	if len(sealed_segments) == 0 {
+		return nil
+	}
+
+	compacted_entries, err := ls.copyRecords(live_entries)
+	if err != nil {
+		return err
+	}
+
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	for id, entry := range compacted_entries {
+		if ls.keydir[id] == live_entries[id] {
+			ls.setEntry(id, entry)
+		}
+	}
+	for segment := range sealed_segments {
+		file := ls.segments[segment]
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		file.Close()
+		delete(ls.segments, segment)
+		ls.totalBytes -= info.Size()
+
+		err = os.Remove(ls.segmentPath(segment))
+		if err != nil {
+			return err
+		}
+	}
+
+	return ls.sync(ls.Root)
+}
+
+// Close waits for the running compaction and closes the segment files.
+func (ls *LogStorage) Close() error {
+	ls.compactions.Wait()
+
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	for segment, file := range ls.segments {
+		file.Close()
+		delete(ls.segments, segment)
+	}
+	ls.openErr = errors.New("log storage closed")
+
+	return nil
+}
+
+func (ls *LogStorage) get(id string) (c.Document, error) {
+	entry, exists := ls.keydir[id]
+	if !exists {
+		return nil, c.ErrDocumentDoestNotExist
+	}
+
+	record, err := ls.readRecord(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return record.Operation.Document, nil
+}
+
+// write appends the operations as a single batch and applies them to the key
+// directory. The caller must hold the write lock.
+func (ls *LogStorage) write(operations []Operation) error {
+	if len(operations) == 0 {
+		return nil
+	}
+
+	operations = append([]Operation{}, operations...)
+	for i, operation := range operations {
+		if operation.Type == OperationSet {
+			document_id, err := operation.Document.GetId()
+			if err != nil {
+				return err
+			}
+			if document_id == "" {
+				return c.ErrInvalidId
+			}
+			operations[i].Id = document_id
+		}
+	}
+
+	if ls.activeSize >= ls.segmentSize() {
+		err := ls.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	buffer := bytes.Buffer{}
+	records := []scannedRecord{}
+	seq := ls.seq
+	for i, operation := range operations {
+		seq++
+		record := logRecord{
+			Seq:       seq,
+			Operation: operation,
+			Pending:   i < len(operations)-1,
+		}
+		record_bytes, err := encodeRecord(record)
+		if err != nil {
+			return err
+		}
+		entry := logEntry{
+			segment: ls.activeSegment,
+			offset:  ls.activeSize + int64(buffer.Len()),
+			size:    int64(len(record_bytes)),
+		}
+		records = append(records, scannedRecord{seq: seq, operation: operation, entry: entry})
+		buffer.Write(record_bytes)
+	}
+
+	active_file := ls.segments[ls.activeSegment]
+	_, err := active_file.WriteAt(buffer.Bytes(), ls.activeSize)
+	if err == nil {
+		err = ls.sync(active_file.Name())
+	}
+	if err != nil {
+		active_file.Truncate(ls.activeSize)
+		return err
+	}
+
+	ls.seq = seq
+	ls.activeSize += int64(buffer.Len())
+	ls.totalBytes += int64(buffer.Len())
+	for _, record := range records {
+		ls.apply(record)
+	}
+	ls.maybeCompact()
+
+	return nil
+}
+
+func (ls *LogStorage) apply(record scannedRecord) {
+	switch record.operation.Type {
+	case OperationSet:
+		ls.setEntry(record.operation.Id, record.entry)
+	case OperationDelete:
+		ls.removeEntry(record.operation.Id)
+	case OperationDeleteFolder:
+		folder := record.operation.Id
+		for id := range ls.keydir {
+			if folder == "" || strings.HasPrefix(id, folder+"/") {
+				ls.removeEntry(id)
+			}
+		}
+	}
+}
+
+// setEntry and removeEntry update the key directory along with the bytes of
+// its records. The caller must hold the write lock.
+func (ls *LogStorage) setEntry(id string, entry logEntry) {
+	ls.liveBytes += entry.size - ls.keydir[id].size
+	ls.keydir[id] = entry
+}
+
+func (ls *LogStorage) removeEntry(id string) {
+	ls.liveBytes -= ls.keydir[id].size
+	delete(ls.keydir, id)
+}
+
+// maybeCompact starts a background compaction when there are too many dead
+// bytes. The caller must hold the write lock.
+func (ls *LogStorage) maybeCompact() {
+	ratio := ls.CompactionRatio
+	if ratio <= 0 {
+		ratio = defaultCompactionRatio
+	}
+	if ls.compacting || len(ls.segments) < 2 {
+		return
+	}
+
+	dead_bytes := ls.totalBytes - ls.liveBytes
+	if float64(dead_bytes) <= ratio*float64(ls.totalBytes) {
+		return
+	}
+
+	ls.compacting = true
+	ls.compactions.Add(1)
+	go func() {
+		defer ls.compactions.Done()
+		ls.Compact()
+
+		ls.mutex.Lock()
+		ls.compacting = false
+		ls.mutex.Unlock()
+	}()
+}
+
+// copyRecords writes the records of the entries into new segments, returning
+// their new location.
+func (ls *LogStorage) copyRecords(entries map[string]logEntry) (map[string]logEntry, error) {
+	ids := []string{}
+	for id := range entries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	copied_entries := map[string]logEntry{}
+	var file *os.File
+	var segment int
+	var size int64
+	finish := func() error {
+		if file == nil {
+			return nil
+		}
+		err := ls.sync(file.Name())
+		if err != nil {
+			return err
+		}
+		err = os.Rename(file.Name(), ls.segmentPath(segment))
+		if err != nil {
+			return err
+		}
+		file.Close()
+
+		file, err = os.OpenFile(ls.segmentPath(segment), os.O_RDWR, os.ModePerm)
+		if err != nil {
+			return err
+		}
+
+		ls.mutex.Lock()
+		ls.segments[segment] = file
+		ls.totalBytes += size
+		ls.mutex.Unlock()
+		file = nil
+
+		return nil
+	}
+
+	for _, id := range ids {
+		ls.mutex.RLock()
+		record, err := ls.readRecord(entries[id])
+		ls.mutex.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		record.Pending = false
+		record_bytes, err := encodeRecord(record)
+		if err != nil {
+			return nil, err
+		}
+
+		if file != nil && size >= ls.segmentSize() {
+			err = finish()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if file == nil {
+			ls.mutex.Lock()
+			ls.lastSegment++
+			segment = ls.lastSegment
+			ls.mutex.Unlock()
+			file, err = os.Create(ls.segmentPath(segment) + tempSuffix)
+			if err != nil {
+				return nil, err
+			}
+			size = 0
+		}
+
+		_, err = file.Write(record_bytes)
+		if err != nil {
+			return nil, err
+		}
+		copied_entries[id] = logEntry{segment: segment, offset: size, size: int64(len(record_bytes))}
+		size += int64(len(record_bytes))
+	}
+
+	err := finish()
+	if err != nil {
+		return nil, err
+	}
+
+	return copied_entries, nil
+}
+
+// rotate starts a new active segment. The caller must hold the write lock.
+func (ls *LogStorage) rotate() error {
+	ls.lastSegment++
+	file, err := os.OpenFile(ls.segmentPath(ls.lastSegment), os.O_CREATE|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	ls.segments[ls.lastSegment] = file
+	ls.activeSegment = ls.lastSegment
+	ls.activeSize = 0
+
+	return ls.sync(ls.Root)
+}
+
+func (ls *LogStorage) readRecord(entry logEntry) (logRecord, error) {
+	record := logRecord{}
+	file := ls.segments[entry.segment]
+	if file == nil {
+		return record, errors.New("missing log segment")
+	}
+
+	payload := make([]byte, entry.size-recordHeaderSize)
+	_, err := file.ReadAt(payload, entry.offset+recordHeaderSize)
+	if err != nil {
+		return record, err
+	}
+
+	err = json.Unmarshal(payload, &record)
+
+	return record, err
+}
+
+func (ls *LogStorage) ensureOpen() error {
+	ls.openOnce.Do(func() {
+		ls.mutex.Lock()
+		defer ls.mutex.Unlock()
+
+		ls.openErr = ls.open()
+	})
+
+	return ls.openErr
+}
+
+// open replays all the segments, in sequence order, to build the key
+// directory. Torn records and incomplete batches at the end of a segment are
+// truncated.
+func (ls *LogStorage) open() error {
+	ls.keydir = map[string]logEntry{}
+	ls.liveBytes = 0
+	ls.segments = map[int]*os.File{}
+
+	err := os.MkdirAll(ls.Root, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	files, err := os.ReadDir(ls.Root)
+	if err != nil {
+		return err
+	}
+
+	segments := []int{}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), tempSuffix) {
+			err = os.Remove(filepath.Join(ls.Root, f.Name()))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		segment, err := strconv.Atoi(strings.TrimSuffix(f.Name(), segmentSuffix))
+		if err != nil || !strings.HasSuffix(f.Name(), segmentSuffix) {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Ints(segments)
+
+	records := []scannedRecord{}
+	for _, segment := range segments {
+		file, err := os.OpenFile(ls.segmentPath(segment), os.O_RDWR, os.ModePerm)
+		if err != nil {
+			return err
+		}
+		ls.segments[segment] = file
+
+		segment_records, size, err := scanSegment(file, segment)
+		if err != nil {
+			return err
+		}
+		records = append(records, segment_records...)
+		ls.totalBytes += size
+		ls.lastSegment = segment
+		ls.activeSegment = segment
+		ls.activeSize = size
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].seq < records[j].seq
+	})
+	for _, record := range records {
+		ls.apply(record)
+		if record.seq > ls.seq {
+			ls.seq = record.seq
+		}
+	}
+
+	if len(segments) == 0 {
+		return ls.rotate()
+	}
+
+	return nil
+}
+
+func (ls *LogStorage) segmentPath(segment int) string {
+	return filepath.Join(ls.Root, c.S("%08d%s", segment, segmentSuffix))
+}
+
+func (ls *LogStorage) segmentSize() int64 {
+	if ls.SegmentSize <= 0 {
+		return defaultSegmentSize
+	}
+
+	return ls.SegmentSize
+}
+
+func (ls *LogStorage) sync(path string) error {
+	return ls.syncer.sync(ls.Durability, ls.GroupCommitWindow, path)
+}
+
+// scanSegment reads all the complete records of the segment, truncating it
+// after the last one.
+func scanSegment(file *os.File, segment int) ([]scannedRecord, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	records := []scannedRecord{}
+	batch := []scannedRecord{}
+	batch_offset := int64(0)
+	offset := int64(0)
+	header := make([]byte, recordHeaderSize)
+
+	for {
+		_, err := file.ReadAt(header, offset)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, 0, err
+		}
+		checksum := binary.BigEndian.Uint32(header[0:4])
+		length := int64(binary.BigEndian.Uint32(header[4:8]))
+		if offset+recordHeaderSize+length > info.Size() {
+			break
+		}
+
+		payload := make([]byte, length)
+		_, err = file.ReadAt(payload, offset+recordHeaderSize)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, 0, err
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+
+		record := logRecord{}
+		err = json.Unmarshal(payload, &record)
+		if err != nil {
+			break
+		}
+
+		size := recordHeaderSize + length
+		batch = append(batch, scannedRecord{
+			seq:       record.Seq,
+			operation: record.Operation,
+			entry:     logEntry{segment: segment, offset: offset, size: size},
+		})
+		offset += size
+		if !record.Pending {
+			records = append(records, batch...)
+			batch = []scannedRecord{}
+			batch_offset = offset
+		}
+	}
+
+	if info.Size() != batch_offset {
+		err = file.Truncate(batch_offset)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return records, batch_offset, nil
+}
+
+func encodeRecord(record logRecord) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	record_bytes := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record_bytes[0:4], crc32.ChecksumIEEE(payload))
+	binary.BigEndian.PutUint32(record_bytes[4:8], uint32(len(payload)))
+	copy(record_bytes[recordHeaderSize:], payload)
+
+	return record_bytes, nil
+}
@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	c "godb/common"
+)
+
+func (ms *MemoryStorage) PutAttachment(id, name string, content io.Reader) error {
+	staged, err := ms.StageAttachment(id, name, content)
+	if err != nil {
+		return err
+	}
+	err = ms.CommitAttachment(id, name, staged)
+	if err != nil {
+		ms.DiscardAttachment(id, staged)
+		return err
+	}
+
+	return nil
+}
+
+// StageAttachment reads the content, without holding the lock, and keeps it
+// apart until it's committed. With Dir it's streamed to its folder instead.
+func (ms *MemoryStorage) StageAttachment(id, name string, content io.Reader) (string, error) {
+	err := validateAttachment(id, name)
+	if err != nil {
+		return "", err
+	}
+	err = ms.ensureOpen()
+	if err != nil {
+		return "", err
+	}
+	if ms.files != nil {
+		return ms.files.stageAttachment(id, name, content)
+	}
+
+	content_bytes, err := io.ReadAll(content)
+	if err != nil {
+		return "", err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if ms.staged == nil {
+		ms.staged = map[string][]byte{}
+	}
+	ms.lastStaged++
+	staged := strconv.Itoa(ms.lastStaged)
+	ms.staged[staged] = content_bytes
+
+	return staged, nil
+}
+
+func (ms *MemoryStorage) CommitAttachment(id, name, staged string) error {
+	err := validateAttachment(id, name)
+	if err != nil {
+		return err
+	}
+	err = ms.ensureOpen()
+	if err != nil {
+		return err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, exists := ms.data[id]; !exists {
+		return c.ErrDocumentDoestNotExist
+	}
+	if ms.files != nil {
+		return ms.files.commitAttachment(id, name, staged)
+	}
+
+	content_bytes, exists := ms.staged[staged]
+	if !exists {
+		return ErrAttachmentNotStaged
+	}
+	delete(ms.staged, staged)
+	if ms.attachments == nil {
+		ms.attachments = map[string]map[string][]byte{}
+	}
+	if ms.attachments[id] == nil {
+		ms.attachments[id] = map[string][]byte{}
+	}
+	ms.attachments[id][name] = content_bytes
+
+	return nil
+}
+
+func (ms *MemoryStorage) DiscardAttachment(id, staged string) error {
+	err := c.ValidateId(id)
+	if err != nil {
+		return err
+	}
+	err = ms.ensureOpen()
+	if err != nil {
+		return err
+	}
+	if ms.files != nil {
+		return ms.files.discardAttachment(id, staged)
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	delete(ms.staged, staged)
+
+	return nil
+}
+
+func (ms *MemoryStorage) GetAttachment(id, name string) (io.ReadSeekCloser, error) {
+	err := validateAttachment(id, name)
+	if err != nil {
+		return nil, err
+	}
+	err = ms.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+	if ms.files != nil {
+		return ms.files.getAttachment(id, name)
+	}
+
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	// the content is replaced, never modified, so it can be read unlocked
+	content_bytes, exists := ms.attachments[id][name]
+	if !exists {
+		return nil, c.ErrAttachmentDoesNotExist
+	}
+
+	return nopCloser{bytes.NewReader(content_bytes)}, nil
+}
+
+func (ms *MemoryStorage) DeleteAttachment(id, name string) error {
+	err := validateAttachment(id, name)
+	if err != nil {
+		return err
+	}
+	err = ms.ensureOpen()
+	if err != nil {
+		return err
+	}
+	if ms.files != nil {
+		return ms.files.deleteAttachment(id, name)
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, exists := ms.attachments[id][name]; !exists {
+		return c.ErrAttachmentDoesNotExist
+	}
+	delete(ms.attachments[id], name)
+	if len(ms.attachments[id]) == 0 {
+		delete(ms.attachments, id)
+	}
+
+	return nil
+}
+
+func (ms *MemoryStorage) ListAttachments(id string) ([]string, error) {
+	err := c.ValidateId(id)
+	if err != nil {
+		return nil, err
+	}
+	err = ms.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+	if ms.files != nil {
+		return ms.files.listAttachments(id)
+	}
+
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	names := []string{}
+	for name := range ms.attachments[id] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// deleteAttachments removes the attachments of the documents deleted by the
+// operations. It's left out of apply, as replaying the operations file would
+// delete the attachments put after them. The caller must hold the write
+// lock.
+func (ms *MemoryStorage) deleteAttachments(operations []Operation) error {
+	for _, operation := range operations {
+		var err error
+		switch operation.Type {
+		case OperationDelete:
+			if ms.files != nil {
+				err = ms.files.deleteAttachments(operation.Id)
+				if err == nil {
+					err = ms.files.removeEmptyFolders(operation.Id)
+				}
+			}
+			delete(ms.attachments, operation.Id)
+		case OperationDeleteFolder:
+			if ms.files != nil {
+				err = ms.files.deleteFolder(operation.Id)
+			}
+			folder := strings.Trim(operation.Id, "/")
+			for id := range ms.attachments {
+				if folder == "" || strings.HasPrefix(id, folder+"/") {
+					delete(ms.attachments, id)
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -1,46 +1,90 @@
 package storage
 
 import (
+	"bufio"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	c "godb/common"
 )
 
+const (
+	memoryAppendOnlyName  = "appendonly.aof"
+	memorySnapshotName    = "snapshot.json"
+	memoryAttachmentsName = "attachments"
+)
+
+// MemoryStorage keeps the documents in memory. Setting Dir makes it
+// persistent: every write is appended to an operations file that is replayed,
+// on top of the last snapshot, when the storage is opened. Snapshots are
+// taken with Snapshot, or every SnapshotInterval, and truncate the operations
+// file. The attachments of a persistent storage are kept as files, in the
+// "attachments" folder of Dir.
 type MemoryStorage struct {
 	Storage
-	data map[string]c.Document
+	Dir               string
+	SnapshotInterval  time.Duration
+	Durability        Durability
+	GroupCommitWindow time.Duration
+
+	data        map[string]c.Document
+	attachments map[string]map[string][]byte
+	staged      map[string][]byte
+	lastStaged  int
+	files       *FileStorage
+	mutex       sync.RWMutex
+	openOnce    sync.Once
+	openErr     error
+	aof         *os.File
+	syncer      durabilitySyncer
+	stop        chan struct{}
+	stopped     sync.WaitGroup
 }
 
 func (ms *MemoryStorage) Get(id string) (c.Document, error) {
-	ms.ensureData()
-	document := ms.data[id]
-	if document == nil {
-		return nil, c.ErrDocumentDoestNotExist
+	err := ms.ensureOpen()
+	if err != nil {
+		return nil, err
 	}
 
-	return document, nil
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	return ms.get(id)
 }
 
 func (ms *MemoryStorage) Set(document c.Document) (c.Document, error) {
-	ms.ensureData()
-	document_id, err := document.GetId()
+	err := ms.Commit([]Operation{{Type: OperationSet, Document: document}})
 	if err != nil {
 		return nil, err
 	}
-	ms.data[document_id] = document
 
 	return document, nil
 }
 
 func (ms *MemoryStorage) Patch(document c.Document) (c.Document, error) {
-	ms.ensureData()
+	err := ms.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
 	document_id, err := document.GetId()
 	if err != nil {
 		return nil, err
 	}
 
-	existing_document, err := ms.Get(document_id)
+	existing_document, err := ms.get(document_id)
 	if err != nil {
 		if !errors.Is(err, c.ErrDocumentDoestNotExist) {
 			return nil, err
@@ -54,47 +98,399 @@ func (ms *MemoryStorage) Patch(document c.Document) (c.Document, error) {
 
 	existing_document.Patch(document)
 
-	return ms.Set(existing_document)
+	err = ms.commit([]Operation{{Type: OperationSet, Document: existing_document}})
+	if err != nil {
+		return nil, err
+	}
+
+	return existing_document, nil
 }
 
 func (ms *MemoryStorage) Exists(id string) (bool, error) {
-	ms.ensureData()
+	err := ms.ensureOpen()
+	if err != nil {
+		return false, err
+	}
+
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
 	_, exists := ms.data[id]
 
 	return exists, nil
 }
 
 func (ms *MemoryStorage) List(folder string) ([]string, error) {
-	ms.ensureData()
+	err := ms.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
 
 	folder = strings.Trim(folder, "/")
+	seen := map[string]bool{}
 	simple_ids := []string{}
 	for document_id := range ms.data {
-		if folder != "" && !strings.HasPrefix(document_id, folder) {
+		if folder != "" && !strings.HasPrefix(document_id, folder+"/") {
 			continue
 		}
 		relative_id := strings.TrimPrefix(document_id, folder)
 		relative_id = strings.Trim(relative_id, "/")
 		relative_id_parts := strings.Split(relative_id, "/")
 
-		if len(relative_id_parts) == 1 {
-			simple_ids = append(simple_ids, relative_id_parts[0])
-		} else {
-			simple_ids = append(simple_ids, relative_id_parts[0]+"/")
+		simple_id := relative_id_parts[0]
+		if len(relative_id_parts) > 1 {
+			simple_id += "/"
+		}
+		if !seen[simple_id] {
+			seen[simple_id] = true
+			simple_ids = append(simple_ids, simple_id)
 		}
 	}
+	sort.Strings(simple_ids)
 
 	return simple_ids, nil
 }
 
+// Iterate collects the matching ids, and documents, at once, so later writes
+// aren't seen.
+func (ms *MemoryStorage) Iterate(folder string, options IterateOptions) Iterator {
+	err := ms.ensureOpen()
+	if err != nil {
+		return &sliceIterator{err: err}
+	}
+
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	prefix := folderPrefix(folder)
+	seen := map[string]bool{}
+	ids := []string{}
+	for document_id := range ms.data {
+		if !strings.HasPrefix(document_id, prefix) {
+			continue
+		}
+		relative_id := strings.TrimPrefix(document_id, prefix)
+		if !options.Recursive {
+			i := strings.Index(relative_id, "/")
+			if i >= 0 {
+				relative_id = relative_id[:i+1]
+			}
+		}
+		if !seen[relative_id] {
+			seen[relative_id] = true
+			ids = append(ids, relative_id)
+		}
+	}
+	sort.Strings(ids)
+
+	var documents []c.Document
+	if options.IncludeDocuments {
+		documents = make([]c.Document, len(ids))
+		for i, id := range ids {
+			documents[i] = ms.data[prefix+id]
+		}
+	}
+
+	return newSliceIterator(ids, documents, options)
+}
+
 func (ms *MemoryStorage) Delete(id string) error {
-	ms.ensureData()
+	err := ms.ensureOpen()
+	if err != nil {
+		return err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, exists := ms.data[id]; !exists {
+		return c.ErrDocumentDoestNotExist
+	}
+
+	return ms.commit([]Operation{{Type: OperationDelete, Id: id}})
+}
+
+func (ms *MemoryStorage) DeleteFolder(folder string) error {
+	return ms.Commit([]Operation{{Type: OperationDeleteFolder, Id: folder}})
+}
+
+func (ms *MemoryStorage) Commit(operations []Operation) error {
+	err := ms.ensureOpen()
+	if err != nil {
+		return err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	return ms.commit(operations)
+}
+
+// Snapshot writes all the documents to the snapshot file and empties the
+// operations file. It does nothing when the storage isn't persistent.
+func (ms *MemoryStorage) Snapshot() error {
+	err := ms.ensureOpen()
+	if err != nil {
+		return err
+	}
+	if ms.Dir == "" {
+		return nil
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	snapshot_bytes, err := json.Marshal(ms.data)
+	if err != nil {
+		return err
+	}
+
+	// replaying the operations file over the new snapshot, if the crash comes
+	// before truncating it, leads to the same documents
+	err = ms.writeSnapshot(snapshot_bytes)
+	if err != nil {
+		return err
+	}
+
+	err = ms.aof.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = ms.aof.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+
+	return ms.sync(ms.aof.Name())
+}
 
-	delete(ms.data, id)
+// Close stops the periodic snapshots and closes the operations file.
+func (ms *MemoryStorage) Close() error {
+	err := ms.ensureOpen()
+	if err != nil {
+		return err
+	}
+	if ms.stop != nil {
+		close(ms.stop)
+		ms.stopped.Wait()
+		ms.stop = nil
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.openErr = errors.New("memory storage closed")
+	if ms.aof != nil {
+		return ms.aof.Close()
+	}
 
 	return nil
 }
 
+// commit appends the operations to the operations file, when persistent, and
+// applies them. The caller must hold the write lock.
+func (ms *MemoryStorage) commit(operations []Operation) error {
+	if ms.openErr != nil {
+		return ms.openErr
+	}
+
+	for _, operation := range operations {
+		if operation.Type == OperationSet {
+			_, err := operation.Document.GetId()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if ms.aof != nil {
+		operations_bytes, err := json.Marshal(operations)
+		if err != nil {
+			return err
+		}
+		offset, err := ms.aof.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		_, err = ms.aof.Write(append(operations_bytes, '\n'))
+		if err == nil {
+			err = ms.sync(ms.aof.Name())
+		}
+		if err != nil {
+			// a failed write must neither be replayed nor hide the next ones
+			ms.rollback(offset)
+			return err
+		}
+	}
+
+	ms.apply(operations)
+
+	return ms.deleteAttachments(operations)
+}
+
+// rollback truncates the operations file back to offset. When it can't, the
+// storage is closed as the next writes would be lost on replay. The caller
+// must hold the write lock.
+func (ms *MemoryStorage) rollback(offset int64) {
+	err := ms.aof.Truncate(offset)
+	if err == nil {
+		_, err = ms.aof.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		ms.openErr = fmt.Errorf("memory storage closed, the operations file can't be rolled back: %w", err)
+	}
+}
+
+func (ms *MemoryStorage) apply(operations []Operation) {
+	ms.ensureData()
+	for _, operation := range operations {
+		switch operation.Type {
+		case OperationSet:
+			document_id, _ := operation.Document.GetId()
+			ms.data[document_id] = operation.Document
+		case OperationDelete:
+			delete(ms.data, operation.Id)
+		case OperationDeleteFolder:
+			folder := strings.Trim(operation.Id, "/")
+			for document_id := range ms.data {
+				if folder == "" || strings.HasPrefix(document_id, folder+"/") {
+					delete(ms.data, document_id)
+				}
+			}
+		}
+	}
+}
+
+func (ms *MemoryStorage) get(id string) (c.Document, error) {
+	document := ms.data[id]
+	if document == nil {
+		return nil, c.ErrDocumentDoestNotExist
+	}
+
+	return document, nil
+}
+
+func (ms *MemoryStorage) ensureOpen() error {
+	ms.openOnce.Do(func() {
+		if ms.Dir == "" {
+			return
+		}
+
+		ms.mutex.Lock()
+		defer ms.mutex.Unlock()
+
+		ms.openErr = ms.load()
+		if ms.openErr == nil && ms.SnapshotInterval > 0 {
+			ms.startSnapshots()
+		}
+	})
+
+	return ms.openErr
+}
+
+// load reads the snapshot and replays the operations file. A torn last line,
+// left by a crash while appending, is discarded.
+func (ms *MemoryStorage) load() error {
+	ms.ensureData()
+	ms.files = &FileStorage{
+		Root:              filepath.Join(ms.Dir, memoryAttachmentsName),
+		Durability:        ms.Durability,
+		GroupCommitWindow: ms.GroupCommitWindow,
+	}
+
+	err := os.MkdirAll(ms.Dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	snapshot_bytes, err := os.ReadFile(filepath.Join(ms.Dir, memorySnapshotName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		err = json.Unmarshal(snapshot_bytes, &ms.data)
+		if err != nil {
+			return err
+		}
+	}
+
+	ms.aof, err = os.OpenFile(filepath.Join(ms.Dir, memoryAppendOnlyName), os.O_CREATE|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	valid_size := int64(0)
+	reader := bufio.NewReader(ms.aof)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		var operations []Operation
+		err = json.Unmarshal(line, &operations)
+		if err != nil {
+			break
+		}
+		ms.apply(operations)
+		valid_size += int64(len(line))
+	}
+
+	err = ms.aof.Truncate(valid_size)
+	if err != nil {
+		return err
+	}
+	_, err = ms.aof.Seek(valid_size, 0)
+
+	return err
+}
+
+func (ms *MemoryStorage) startSnapshots() {
+	ms.stop = make(chan struct{})
+	ms.stopped.Add(1)
+
+	go func() {
+		defer ms.stopped.Done()
+
+		ticker := time.NewTicker(ms.SnapshotInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ms.stop:
+				return
+			case <-ticker.C:
+				ms.Snapshot()
+			}
+		}
+	}()
+}
+
+func (ms *MemoryStorage) writeSnapshot(snapshot_bytes []byte) error {
+	path := filepath.Join(ms.Dir, memorySnapshotName)
+	temp_path := path + tempSuffix
+
+	err := os.WriteFile(temp_path, snapshot_bytes, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = ms.sync(temp_path)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(temp_path, path)
+	if err != nil {
+		return err
+	}
+
+	return ms.sync(ms.Dir)
+}
+
+func (ms *MemoryStorage) sync(path string) error {
+	return ms.syncer.sync(ms.Durability, ms.GroupCommitWindow, path)
+}
+
 func (ms *MemoryStorage) ensureData() {
 	if ms.data == nil {
 		ms.data = map[string]c.Document{}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	c "godb/common"
+)
+
+// OverlayStorage buffers writes on top of a base storage without touching it,
+// so they can be committed later to the base as a single batch.
+type OverlayStorage struct {
+	Storage
+	ctx        context.Context
+	base       Storage
+	documents  map[string]c.Document
+	folders    []string
+	operations []Operation
+}
+
+func NewOverlayStorage(base Storage) *OverlayStorage {
+	return NewOverlayStorageContext(context.Background(), base)
+}
+
+// NewOverlayStorageContext creates an overlay whose reads of the base storage
+// use the context.
+func NewOverlayStorageContext(ctx context.Context, base Storage) *OverlayStorage {
+	return &OverlayStorage{
+		ctx:       ctx,
+		base:      base,
+		documents: map[string]c.Document{},
+	}
+}
+
+// reader returns a view of the overlay whose reads of the base storage use
+// the context. It must not be written to.
+func (ovs *OverlayStorage) reader(ctx context.Context) *OverlayStorage {
+	reader := *ovs
+	reader.ctx = ctx
+
+	return &reader
+}
+
+func (ovs *OverlayStorage) Operations() []Operation {
+	return ovs.operations
+}
+
+func (ovs *OverlayStorage) Get(id string) (c.Document, error) {
+	document, found := ovs.documents[id]
+	if found {
+		if document == nil {
+			return nil, c.ErrDocumentDoestNotExist
+		}
+		return document, nil
+	}
+	if ovs.folderDeleted(c.Folder(id)) {
+		return nil, c.ErrDocumentDoestNotExist
+	}
+
+	return GetContext(ovs.ctx, ovs.base, id)
+}
+
+func (ovs *OverlayStorage) Set(document c.Document) (c.Document, error) {
+	document_id, err := document.GetId()
+	if err != nil {
+		return nil, err
+	}
+	if document_id == "" {
+		return nil, c.ErrInvalidId
+	}
+
+	ovs.documents[document_id] = document
+	ovs.operations = append(ovs.operations, Operation{Type: OperationSet, Id: document_id, Document: document})
+
+	return document, nil
+}
+
+func (ovs *OverlayStorage) Patch(document c.Document) (c.Document, error) {
+	document_id, err := document.GetId()
+	if err != nil {
+		return nil, err
+	}
+
+	patched_document := c.NewDocument(document_id)
+	existing_document, err := ovs.Get(document_id)
+	if err != nil {
+		if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+			return nil, err
+		}
+	} else {
+		patched_document.Patch(existing_document)
+	}
+
+	patched_document.Patch(document)
+
+	return ovs.Set(patched_document)
+}
+
+func (ovs *OverlayStorage) Exists(id string) (bool, error) {
+	_, err := ovs.Get(id)
+	if err != nil {
+		if errors.Is(err, c.ErrDocumentDoestNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (ovs *OverlayStorage) List(folder string) ([]string, error) {
+	folder = strings.Trim(folder, "/")
+	simple_ids := map[string]bool{}
+
+	if !ovs.folderDeleted(folder) {
+		base_simple_ids, err := ListContext(ovs.ctx, ovs.base, folder)
+		if err != nil {
+			return nil, err
+		}
+		for _, simple_id := range base_simple_ids {
+			id := c.J(folder, strings.TrimSuffix(simple_id, "/"))
+			if strings.HasSuffix(simple_id, "/") {
+				if ovs.folderDeleted(id) {
+					continue
+				}
+			} else if document, found := ovs.documents[id]; found && document == nil {
+				continue
+			}
+			simple_ids[simple_id] = true
+		}
+	}
+
+	for document_id, document := range ovs.documents {
+		if document == nil {
+			continue
+		}
+		if folder != "" && !strings.HasPrefix(document_id, folder+"/") {
+			continue
+		}
+		relative_id := strings.TrimPrefix(document_id, folder)
+		relative_id_parts := strings.Split(strings.Trim(relative_id, "/"), "/")
+		if len(relative_id_parts) == 1 {
+			simple_ids[relative_id_parts[0]] = true
+		} else {
+			simple_ids[relative_id_parts[0]+"/"] = true
+		}
+	}
+
+	result := []string{}
+	for simple_id := range simple_ids {
+		result = append(result, simple_id)
+	}
+	sort.Strings(result)
+
+	return result, nil
+}
+
+func (ovs *OverlayStorage) Delete(id string) error {
+	exists, err := ovs.Exists(id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return c.ErrDocumentDoestNotExist
+	}
+
+	ovs.documents[id] = nil
+	ovs.operations = append(ovs.operations, Operation{Type: OperationDelete, Id: id})
+
+	return nil
+}
+
+func (ovs *OverlayStorage) DeleteFolder(folder string) error {
+	folder = strings.Trim(folder, "/")
+
+	for document_id := range ovs.documents {
+		if folder == "" || strings.HasPrefix(document_id, folder+"/") {
+			delete(ovs.documents, document_id)
+		}
+	}
+	ovs.folders = append(ovs.folders, folder)
+	ovs.operations = append(ovs.operations, Operation{Type: OperationDeleteFolder, Id: folder})
+
+	return nil
+}
+
+func (ovs *OverlayStorage) Commit(operations []Operation) error {
+	for _, operation := range operations {
+		var err error
+		switch operation.Type {
+		case OperationSet:
+			_, err = ovs.Set(operation.Document)
+		case OperationDelete:
+			err = ovs.Delete(operation.Id)
+			if errors.Is(err, c.ErrDocumentDoestNotExist) {
+				err = nil
+			}
+		case OperationDeleteFolder:
+			err = ovs.DeleteFolder(operation.Id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// folderDeleted tells if the folder, or one of its parents, has been deleted
+// in this overlay.
+func (ovs *OverlayStorage) folderDeleted(folder string) bool {
+	for _, deleted_folder := range ovs.folders {
+		if deleted_folder == "" || folder == deleted_folder || strings.HasPrefix(folder, deleted_folder+"/") {
+			return true
+		}
+	}
+
+	return false
+}
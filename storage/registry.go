@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrInvalidURI = errors.New("invalid storage uri")
+
+// Opener builds the storage of a uri whose scheme it was registered under.
+// The decorator options, like cache, are already removed from the query.
+type Opener func(uri *url.URL) (Storage, error)
+
+var (
+	openersMutex sync.RWMutex
+	openers      = map[string]Opener{}
+)
+
+// Register makes a storage available to Open under the scheme. Like
+// database/sql drivers, registering the same scheme twice panics.
+func Register(scheme string, opener Opener) {
+	openersMutex.Lock()
+	defer openersMutex.Unlock()
+
+	if opener == nil {
+		panic("storage: Register opener is nil")
+	}
+	if _, ok := openers[scheme]; ok {
+		panic("storage: Register called twice for scheme " + scheme)
+	}
+	openers[scheme] = opener
+}
+
+// Schemes returns the registered schemes, sorted.
+func Schemes() []string {
+	openersMutex.RLock()
+	defer openersMutex.RUnlock()
+
+	schemes := make([]string, 0, len(openers))
+	for scheme := range openers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+
+	return schemes
+}
+
+// Open builds the storage of the uri, like "file:///var/godb",
+// "file:_data", "mem://" or "sqlite:///tmp/godb.db?cache=1000". The path
+// is the part after the scheme, relative when there's no leading slash.
+//
+// Besides the options of each storage, every one accepts the decorators:
+//   - cache=<entries> wraps it in a CachedStorage.
+func Open(uri string) (Storage, error) {
+	parsed_uri, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidURI, err)
+	}
+
+	openersMutex.RLock()
+	opener, ok := openers[parsed_uri.Scheme]
+	openersMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown scheme '%s'", ErrInvalidURI, parsed_uri.Scheme)
+	}
+
+	query := parsed_uri.Query()
+	cache := query.Get("cache")
+	query.Del("cache")
+	parsed_uri.RawQuery = query.Encode()
+
+	storage, err := opener(parsed_uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache != "" {
+		max_entries, err := strconv.Atoi(cache)
+		if err != nil || max_entries <= 0 {
+			return nil, fmt.Errorf("%w: invalid cache '%s'", ErrInvalidURI, cache)
+		}
+		storage = &CachedStorage{Backend: storage, MaxEntries: max_entries}
+	}
+
+	return storage, nil
+}
+
+func init() {
+	Register("file", openFileStorage)
+	Register("mem", openMemoryStorage)
+	Register("log", openLogStorage)
+	Register("btree", openBTreeStorage)
+	Register("sqlite", openSQLStorage)
+	Register("s3", openS3Storage)
+}
+
+// file:<root>?durability=&compression=&codec=json|msgpack|cbor&fanout=
+func openFileStorage(uri *url.URL) (Storage, error) {
+	query, err := uriQuery(uri, "durability", "compression", "codec", "fanout")
+	if err != nil {
+		return nil, err
+	}
+	root, err := uriPath(uri, true)
+	if err != nil {
+		return nil, err
+	}
+
+	durability, err := uriDurability(query)
+	if err != nil {
+		return nil, err
+	}
+	compression := Compression(query.Get("compression"))
+	err = compression.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidURI, err)
+	}
+
+	storage := &FileStorage{
+		Root:        root,
+		Durability:  durability,
+		Compression: compression,
+	}
+	if fan_out := query.Get("fanout"); fan_out != "" {
+		storage.FanOut, err = strconv.Atoi(fan_out)
+		if err != nil || storage.FanOut < 0 {
+			return nil, fmt.Errorf("%w: invalid fanout '%s'", ErrInvalidURI, fan_out)
+		}
+	}
+	if name := query.Get("codec"); name != "" {
+		for _, codec := range codecs {
+			if codec.Extension() == "."+name {
+				storage.Codec = codec
+			}
+		}
+		if storage.Codec == nil {
+			return nil, fmt.Errorf("%w: unknown codec '%s'", ErrInvalidURI, name)
+		}
+	}
+
+	return storage, nil
+}
+
+// mem:// keeps the documents only in memory, mem:<dir> persists them too.
+func openMemoryStorage(uri *url.URL) (Storage, error) {
+	query, err := uriQuery(uri, "durability")
+	if err != nil {
+		return nil, err
+	}
+	dir, err := uriPath(uri, false)
+	if err != nil {
+		return nil, err
+	}
+	durability, err := uriDurability(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MemoryStorage{Dir: dir, Durability: durability}, nil
+}
+
+func openLogStorage(uri *url.URL) (Storage, error) {
+	query, err := uriQuery(uri, "durability")
+	if err != nil {
+		return nil, err
+	}
+	root, err := uriPath(uri, true)
+	if err != nil {
+		return nil, err
+	}
+	durability, err := uriDurability(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LogStorage{Root: root, Durability: durability}, nil
+}
+
+func openBTreeStorage(uri *url.URL) (Storage, error) {
+	query, err := uriQuery(uri, "durability")
+	if err != nil {
+		return nil, err
+	}
+	path, err := uriPath(uri, true)
+	if err != nil {
+		return nil, err
+	}
+	durability, err := uriDurability(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BTreeStorage{Path: path, Durability: durability}, nil
+}
+
+// sqlite:<path>?table= needs a "sqlite" database/sql driver, like
+// modernc.org/sqlite, to be imported.
+func openSQLStorage(uri *url.URL) (Storage, error) {
+	query, err := uriQuery(uri, "table")
+	if err != nil {
+		return nil, err
+	}
+	path, err := uriPath(uri, true)
+	if err != nil {
+		return nil, err
+	}
+	table := query.Get("table")
+	if table != "" {
+		err = validateTable(table)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidURI, err)
+		}
+	}
+
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+
+	return &SQLStorage{DB: db, Table: table}, nil
+}
+
+// s3://<bucket>/<prefix>?endpoint=&region= takes the credentials from the
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables, to keep
+// them out of the configuration.
+func openS3Storage(uri *url.URL) (Storage, error) {
+	query, err := uriQuery(uri, "endpoint", "region")
+	if err != nil {
+		return nil, err
+	}
+	if uri.Host == "" {
+		return nil, fmt.Errorf("%w: missing bucket", ErrInvalidURI)
+	}
+	prefix := strings.TrimPrefix(uri.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	region := query.Get("region")
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := query.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+
+	return &S3Storage{
+		Endpoint:  endpoint,
+		Bucket:    uri.Host,
+		Prefix:    prefix,
+		Region:    region,
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}, nil
+}
+
+// uriPath returns the path of "scheme:relative", "scheme://relative" or
+// "scheme:///absolute" uris.
+func uriPath(uri *url.URL, required bool) (string, error) {
+	path := uri.Opaque
+	if path == "" {
+		path = uri.Host + uri.Path
+	}
+	if required && path == "" {
+		return "", fmt.Errorf("%w: missing path", ErrInvalidURI)
+	}
+
+	return path, nil
+}
+
+// uriDurability returns the durability option, failing for unknown modes.
+func uriDurability(query url.Values) (Durability, error) {
+	durability := Durability(query.Get("durability"))
+	err := durability.validate()
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidURI, err)
+	}
+
+	return durability, nil
+}
+
+// uriQuery fails with the first option the storage doesn't know about, so
+// typos don't go unnoticed.
+func uriQuery(uri *url.URL, options ...string) (url.Values, error) {
+	query := uri.Query()
+	for key := range query {
+		known := false
+		for _, option := range options {
+			known = known || option == key
+		}
+		if !known {
+			return nil, fmt.Errorf("%w: unknown option '%s' for %s", ErrInvalidURI, key, uri.Scheme)
+		}
+	}
+
+	return query, nil
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an in memory stand-in of the S3 API calls used by S3Storage.
+type fakeS3 struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+	maxKeys int
+	// deletes counts the batch delete requests
+	deletes int
+}
+
+type fakeS3Entry struct {
+	name      string
+	is_prefix bool
+}
+
+func newFakeS3Server(tb testing.TB) *httptest.Server {
+	fake := &fakeS3{objects: map[string][]byte{}, maxKeys: 1000}
+	server := httptest.NewServer(fake)
+	tb.Cleanup(server.Close)
+
+	return server
+}
+
+func (fake *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key, _ := strings.Cut(path, "/")
+	object_key := bucket + "/" + key
+	query := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		fake.list(w, bucket, query)
+	case key == "" && r.Method == http.MethodPost && query.Has("delete"):
+		request := s3DeleteRequest{}
+		err := xml.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(request.Objects) > s3DeleteBatch {
+			http.Error(w, "too many keys", http.StatusBadRequest)
+			return
+		}
+		fake.deletes++
+		for _, object := range request.Objects {
+			delete(fake.objects, bucket+"/"+object.Key)
+		}
+		w.Write([]byte("<DeleteResult></DeleteResult>"))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, found := fake.objects[object_key]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>"))
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fake.objects[object_key] = data
+	case r.Method == http.MethodDelete:
+		delete(fake.objects, object_key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	}
+}
+
+func (fake *fakeS3) list(w http.ResponseWriter, bucket string, query map[string][]string) {
+	values := func(key string) string {
+		if len(query[key]) == 0 {
+			return ""
+		}
+		return query[key][0]
+	}
+	prefix := values("prefix")
+	delimiter := values("delimiter")
+	token := values("continuation-token")
+	max_keys := fake.maxKeys
+	if value, err := strconv.Atoi(values("max-keys")); err == nil && value < max_keys {
+		max_keys = value
+	}
+
+	seen := map[string]bool{}
+	entries := []fakeS3Entry{}
+	for object_key := range fake.objects {
+		key := strings.TrimPrefix(object_key, bucket+"/")
+		if !strings.HasPrefix(object_key, bucket+"/") || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		entry := fakeS3Entry{name: key}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i != -1 {
+				entry = fakeS3Entry{name: key[:len(prefix)+i+len(delimiter)], is_prefix: true}
+			}
+		}
+		if !seen[entry.name] {
+			seen[entry.name] = true
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	result := s3ListResult{}
+	for _, entry := range entries {
+		if token != "" && entry.name <= token {
+			continue
+		}
+		if len(result.Contents)+len(result.CommonPrefixes) == max_keys {
+			result.IsTruncated = true
+			break
+		}
+		if entry.is_prefix {
+			result.CommonPrefixes = append(result.CommonPrefixes, struct {
+				Prefix string `xml:"Prefix"`
+			}{Prefix: entry.name})
+		} else {
+			result.Contents = append(result.Contents, struct {
+				Key string `xml:"Key"`
+			}{Key: entry.name})
+		}
+		result.NextContinuationToken = entry.name
+	}
+	if !result.IsTruncated {
+		result.NextContinuationToken = ""
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		s3ListResult
+	}{s3ListResult: result})
+}
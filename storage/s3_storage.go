@@ -0,0 +1,781 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	c "godb/common"
+)
+
+// s3DeleteBatch is the most keys S3 deletes in a single request. It's a var
+// so the tests can lower it.
+var s3DeleteBatch = 1000
+
+const (
+	defaultS3Region = "us-east-1"
+	// s3JournalFolder keeps the pending commits, hidden from List as the
+	// journal of FileStorage is.
+	s3JournalFolder = ".journal"
+	// defaultS3JournalTimeout is how long a commit may take to be applied
+	// before another instance replays its journal.
+	defaultS3JournalTimeout = 10 * time.Minute
+)
+
+// S3Storage keeps every document as a JSON object of an S3 compatible bucket,
+// under the key Prefix + id + ".json". Folders are listed with delimiter
+// based listings and deleted in batches.
+//
+// S3 has no multi-object transactions, so Commit stores the operations in a
+// journal object before applying them. Journals are named after the time,
+// the instance that wrote them and its sequence. The ones older than
+// JournalTimeout were left by a crash and are applied when the storage is
+// opened; the younger ones may still be applied by another instance. A
+// commit that fails once journaled is retried before the next write of the
+// same instance.
+//
+// Several instances may share a bucket but writes to the same documents are
+// last writer wins: a crashed commit replayed after JournalTimeout overwrites
+// whatever was written to its documents meanwhile. The clocks of the
+// instances must agree well within JournalTimeout.
+type S3Storage struct {
+	Storage
+	// Endpoint of the service, like "https://s3.eu-west-1.amazonaws.com".
+	// Buckets are addressed with path-style URLs.
+	Endpoint  string
+	Bucket    string
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+	// JournalTimeout is 10 minutes by default.
+	JournalTimeout time.Duration
+
+	openOnce sync.Once
+	openErr  error
+	instance string
+	mutex    sync.Mutex
+	seq      uint64
+	// failed are the journaled commits that couldn't be applied, in order.
+	failed []s3Journal
+}
+
+type s3Journal struct {
+	key        string
+	operations []Operation
+}
+
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+type s3DeleteRequest struct {
+	XMLName xml.Name `xml:"Delete"`
+	Quiet   bool     `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type s3DeleteResult struct {
+	Errors []struct {
+		Key     string `xml:"Key"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Error"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (s3 *S3Storage) Get(id string) (c.Document, error) {
+	return s3.GetContext(context.Background(), id)
+}
+
+func (s3 *S3Storage) GetContext(ctx context.Context, id string) (c.Document, error) {
+	err := s3.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	return s3.get(ctx, id)
+}
+
+func (s3 *S3Storage) Set(document c.Document) (c.Document, error) {
+	return s3.SetContext(context.Background(), document)
+}
+
+func (s3 *S3Storage) SetContext(ctx context.Context, document c.Document) (c.Document, error) {
+	err := s3.ensureWritable(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s3.set(ctx, document)
+	if err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+func (s3 *S3Storage) Patch(document c.Document) (c.Document, error) {
+	return s3.PatchContext(context.Background(), document)
+}
+
+func (s3 *S3Storage) PatchContext(ctx context.Context, document c.Document) (c.Document, error) {
+	err := s3.ensureWritable(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	document_id, err := document.GetId()
+	if err != nil {
+		return nil, err
+	}
+
+	existing_document, err := s3.get(ctx, document_id)
+	if err != nil {
+		if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+			return nil, err
+		}
+		existing_document = c.NewDocument(document_id)
+	}
+	existing_document.Patch(document)
+
+	err = s3.set(ctx, existing_document)
+	if err != nil {
+		return nil, err
+	}
+
+	return existing_document, nil
+}
+
+func (s3 *S3Storage) Exists(id string) (bool, error) {
+	return s3.ExistsContext(context.Background(), id)
+}
+
+func (s3 *S3Storage) ExistsContext(ctx context.Context, id string) (bool, error) {
+	err := s3.ensureOpen()
+	if err != nil {
+		return false, err
+	}
+
+	return s3.exists(ctx, id)
+}
+
+func (s3 *S3Storage) List(folder string) ([]string, error) {
+	return s3.ListContext(context.Background(), folder)
+}
+
+func (s3 *S3Storage) ListContext(ctx context.Context, folder string) ([]string, error) {
+	err := s3.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := s3.Prefix + folderPrefix(folder)
+	simple_ids := []string{}
+	err = s3.listObjects(ctx, prefix, "/", func(key string, is_folder bool) error {
+		name := strings.TrimPrefix(key, prefix)
+		if strings.HasPrefix(name, ".") {
+			return nil
+		}
+		if is_folder {
+			simple_ids = append(simple_ids, name)
+		} else if strings.HasSuffix(name, ".json") {
+			simple_ids = append(simple_ids, strings.TrimSuffix(name, ".json"))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(simple_ids)
+
+	return simple_ids, nil
+}
+
+func (s3 *S3Storage) Delete(id string) error {
+	return s3.DeleteContext(context.Background(), id)
+}
+
+func (s3 *S3Storage) DeleteContext(ctx context.Context, id string) error {
+	err := s3.ensureWritable(ctx)
+	if err != nil {
+		return err
+	}
+
+	exists, err := s3.exists(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return c.ErrDocumentDoestNotExist
+	}
+
+	return s3.deleteObject(ctx, s3.objectKey(id))
+}
+
+func (s3 *S3Storage) DeleteFolder(folder string) error {
+	return s3.DeleteFolderContext(context.Background(), folder)
+}
+
+func (s3 *S3Storage) DeleteFolderContext(ctx context.Context, folder string) error {
+	err := s3.ensureWritable(ctx)
+	if err != nil {
+		return err
+	}
+
+	return s3.deleteFolder(ctx, folder)
+}
+
+func (s3 *S3Storage) Commit(operations []Operation) error {
+	return s3.CommitContext(context.Background(), operations)
+}
+
+func (s3 *S3Storage) CommitContext(ctx context.Context, operations []Operation) error {
+	err := s3.ensureWritable(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, operation := range operations {
+		if operation.Type == OperationSet {
+			_, err := operation.Document.GetId()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	journal_bytes, err := json.Marshal(operations)
+	if err != nil {
+		return err
+	}
+	journal_key := s3.journalKey()
+	err = s3.putObject(ctx, journal_key, journal_bytes)
+	if err != nil {
+		return err
+	}
+
+	// once in the journal the commit is done, so it's applied even if the
+	// context is cancelled meanwhile
+	ctx = context.WithoutCancel(ctx)
+	err = s3.applyOperations(ctx, operations)
+	if err == nil {
+		err = s3.deleteObject(ctx, journal_key)
+	}
+	if err != nil {
+		// the later writes must not be overwritten by its replay
+		s3.mutex.Lock()
+		s3.failed = append(s3.failed, s3Journal{key: journal_key, operations: operations})
+		s3.mutex.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// journalKey names the journal of a commit after the time, so they're
+// replayed in order, and the instance and its sequence, so they're unique.
+func (s3 *S3Storage) journalKey() string {
+	s3.mutex.Lock()
+	defer s3.mutex.Unlock()
+
+	s3.seq++
+
+	return s3.Prefix + s3JournalFolder + "/" + c.S("%020d-%s-%010d", time.Now().UnixNano(), s3.instance, s3.seq)
+}
+
+func (s3 *S3Storage) get(ctx context.Context, id string) (c.Document, error) {
+	response, err := s3.request(ctx, http.MethodGet, s3.objectKey(id), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, c.ErrDocumentDoestNotExist
+	}
+	err = s3ResponseError(response)
+	if err != nil {
+		return nil, err
+	}
+
+	document := c.Document{}
+	err = json.NewDecoder(response.Body).Decode(&document)
+	if err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+func (s3 *S3Storage) set(ctx context.Context, document c.Document) error {
+	document_id, err := document.GetId()
+	if err != nil {
+		return err
+	}
+	if document_id == "" {
+		return c.ErrInvalidId
+	}
+
+	document_bytes, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+
+	return s3.putObject(ctx, s3.objectKey(document_id), document_bytes)
+}
+
+func (s3 *S3Storage) exists(ctx context.Context, id string) (bool, error) {
+	response, err := s3.request(ctx, http.MethodHead, s3.objectKey(id), nil, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	err = s3ResponseError(response)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s3 *S3Storage) deleteFolder(ctx context.Context, folder string) error {
+	keys := []string{}
+	err := s3.listObjects(ctx, s3.Prefix+folderPrefix(folder), "", func(key string, is_folder bool) error {
+		if strings.HasPrefix(strings.TrimPrefix(key, s3.Prefix), s3JournalFolder+"/") {
+			return nil
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(keys); start += s3DeleteBatch {
+		end := start + s3DeleteBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		err = s3.deleteObjects(ctx, keys[start:end])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s3 *S3Storage) applyOperations(ctx context.Context, operations []Operation) error {
+	for _, operation := range operations {
+		var err error
+		switch operation.Type {
+		case OperationSet:
+			err = s3.set(ctx, operation.Document)
+		case OperationDelete:
+			err = s3.deleteObject(ctx, s3.objectKey(operation.Id))
+		case OperationDeleteFolder:
+			err = s3.deleteFolder(ctx, operation.Id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s3 *S3Storage) ensureOpen() error {
+	s3.openOnce.Do(func() {
+		instance := make([]byte, 8)
+		_, s3.openErr = rand.Read(instance)
+		if s3.openErr != nil {
+			return
+		}
+		s3.instance = hex.EncodeToString(instance)
+
+		s3.openErr = s3.recover(context.Background())
+	})
+
+	return s3.openErr
+}
+
+// ensureWritable opens the storage and applies the commits of this instance
+// that failed once journaled, so the writes keep their order.
+func (s3 *S3Storage) ensureWritable(ctx context.Context) error {
+	err := s3.ensureOpen()
+	if err != nil {
+		return err
+	}
+
+	s3.mutex.Lock()
+	defer s3.mutex.Unlock()
+
+	ctx = context.WithoutCancel(ctx)
+	for len(s3.failed) > 0 {
+		journal := s3.failed[0]
+		err = s3.applyOperations(ctx, journal.operations)
+		if err != nil {
+			return err
+		}
+		err = s3.deleteObject(ctx, journal.key)
+		if err != nil {
+			return err
+		}
+		s3.failed = s3.failed[1:]
+	}
+
+	return nil
+}
+
+// recover applies, in order, the commits left in the journal by crashed
+// instances, those older than JournalTimeout.
+func (s3 *S3Storage) recover(ctx context.Context) error {
+	journal_timeout := s3.JournalTimeout
+	if journal_timeout <= 0 {
+		journal_timeout = defaultS3JournalTimeout
+	}
+	journal_prefix := s3.Prefix + s3JournalFolder + "/"
+
+	journal_keys := []string{}
+	err := s3.listObjects(ctx, journal_prefix, "", func(key string, is_folder bool) error {
+		// journals from before the instances were named only have the time
+		timestamp, _, _ := strings.Cut(strings.TrimPrefix(key, journal_prefix), "-")
+		nanoseconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err == nil && time.Since(time.Unix(0, nanoseconds)) < journal_timeout {
+			return nil
+		}
+		journal_keys = append(journal_keys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(journal_keys)
+
+	for _, journal_key := range journal_keys {
+		response, err := s3.request(ctx, http.MethodGet, journal_key, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		var operations []Operation
+		err = s3ResponseError(response)
+		if err == nil {
+			err = json.NewDecoder(response.Body).Decode(&operations)
+		}
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		err = s3.applyOperations(ctx, operations)
+		if err != nil {
+			return err
+		}
+		err = s3.deleteObject(ctx, journal_key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s3 *S3Storage) putObject(ctx context.Context, key string, data []byte) error {
+	header := http.Header{"Content-Type": {"application/json"}}
+	response, err := s3.request(ctx, http.MethodPut, key, nil, header, data)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	return s3ResponseError(response)
+}
+
+func (s3 *S3Storage) deleteObject(ctx context.Context, key string) error {
+	response, err := s3.request(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	return s3ResponseError(response)
+}
+
+func (s3 *S3Storage) deleteObjects(ctx context.Context, keys []string) error {
+	delete_request := s3DeleteRequest{Quiet: true}
+	for _, key := range keys {
+		delete_request.Objects = append(delete_request.Objects, struct {
+			Key string `xml:"Key"`
+		}{Key: key})
+	}
+	body, err := xml.Marshal(delete_request)
+	if err != nil {
+		return err
+	}
+
+	checksum := md5.Sum(body)
+	header := http.Header{
+		"Content-Type": {"application/xml"},
+		"Content-MD5":  {base64.StdEncoding.EncodeToString(checksum[:])},
+	}
+	response, err := s3.request(ctx, http.MethodPost, "", url.Values{"delete": {""}}, header, body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	err = s3ResponseError(response)
+	if err != nil {
+		return err
+	}
+
+	result := s3DeleteResult{}
+	err = xml.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		return err
+	}
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("s3: deleting %s: %s: %s", result.Errors[0].Key, result.Errors[0].Code, result.Errors[0].Message)
+	}
+
+	return nil
+}
+
+// listObjects calls f with every object, and common prefix when a delimiter
+// is given, under the prefix.
+func (s3 *S3Storage) listObjects(ctx context.Context, prefix string, delimiter string, f func(key string, is_folder bool) error) error {
+	continuation_token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if continuation_token != "" {
+			query.Set("continuation-token", continuation_token)
+		}
+
+		response, err := s3.request(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		result := s3ListResult{}
+		err = s3ResponseError(response)
+		if err == nil {
+			err = xml.NewDecoder(response.Body).Decode(&result)
+		}
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, content := range result.Contents {
+			err = f(content.Key, false)
+			if err != nil {
+				return err
+			}
+		}
+		for _, common_prefix := range result.CommonPrefixes {
+			err = f(common_prefix.Prefix, true)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		continuation_token = result.NextContinuationToken
+	}
+}
+
+func (s3 *S3Storage) objectKey(id string) string {
+	return s3.Prefix + strings.Trim(id, "/") + ".json"
+}
+
+// request sends a request to the bucket, or to one of its objects when key
+// isn't empty, signed with AWS signature version 4.
+func (s3 *S3Storage) request(ctx context.Context, method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	endpoint, err := url.Parse(s3.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	path := "/" + s3.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+	endpoint.Path = path
+	endpoint.RawPath = s3EncodePath(path)
+	endpoint.RawQuery = s3EncodeQuery(query)
+
+	request, err := http.NewRequestWithContext(ctx, method, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	s3.sign(request, body)
+
+	client := s3.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return client.Do(request)
+}
+
+func (s3 *S3Storage) sign(request *http.Request, body []byte) {
+	now := time.Now().UTC()
+	amz_date := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payload_hash := sha256Hex(body)
+
+	request.Header.Set("X-Amz-Date", amz_date)
+	request.Header.Set("X-Amz-Content-Sha256", payload_hash)
+	if s3.AccessKey == "" {
+		return
+	}
+
+	region := s3.Region
+	if region == "" {
+		region = defaultS3Region
+	}
+
+	signed_headers := "host;x-amz-content-sha256;x-amz-date"
+	canonical_request := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		"host:" + request.URL.Host,
+		"x-amz-content-sha256:" + payload_hash,
+		"x-amz-date:" + amz_date,
+		"",
+		signed_headers,
+		payload_hash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	string_to_sign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amz_date,
+		scope,
+		sha256Hex([]byte(canonical_request)),
+	}, "\n")
+
+	signing_key := hmacSHA256([]byte("AWS4"+s3.SecretKey), date)
+	signing_key = hmacSHA256(signing_key, region)
+	signing_key = hmacSHA256(signing_key, "s3")
+	signing_key = hmacSHA256(signing_key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signing_key, string_to_sign))
+
+	request.Header.Set("Authorization", c.S(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3.AccessKey, scope, signed_headers, signature,
+	))
+}
+
+func s3ResponseError(response *http.Response) error {
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+
+	body, _ := io.ReadAll(response.Body)
+	s3_error := s3Error{}
+	xml.Unmarshal(body, &s3_error)
+	if s3_error.Code == "" {
+		return fmt.Errorf("s3: unexpected status %d", response.StatusCode)
+	}
+
+	return fmt.Errorf("s3: %s: %s", s3_error.Code, s3_error.Message)
+}
+
+// s3EncodePath escapes everything but the unreserved characters and the
+// slashes, as the signature expects.
+func s3EncodePath(path string) string {
+	encoded := strings.Builder{}
+	for _, b := range []byte(path) {
+		if b == '/' || isUnreserved(b) {
+			encoded.WriteByte(b)
+		} else {
+			encoded.WriteString(c.S("%%%02X", b))
+		}
+	}
+
+	return encoded.String()
+}
+
+func s3EncodeQuery(query url.Values) string {
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, strings.TrimPrefix(s3EncodePath("/"+key), "/")+"="+strings.ReplaceAll(s3EncodePath(value), "/", "%2F"))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+func isUnreserved(b byte) bool {
+	return (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+		b == '-' || b == '_' || b == '.' || b == '~'
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
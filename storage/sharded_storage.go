@@ -0,0 +1,462 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	c "godb/common"
+)
+
+const defaultVirtualNodes = 64
+
+// rebalanceId is the document, in Metadata, recording the number of shards
+// before the last AddShard until Rebalance finishes, so a restart in the
+// middle still finds the documents not moved yet.
+const rebalanceId = "rebalance"
+
+var (
+	ErrRebalancing = errors.New("shards are being rebalanced")
+	ErrNoMetadata  = errors.New("no metadata storage to record the rebalance")
+)
+
+// ShardedStorage spreads the documents over Shards with a consistent hash
+// ring, by their full id or, with ByFolder, by their top-level folder. Commit
+// is only atomic within a shard, so ByFolder keeps the operations over a
+// single top-level folder atomic.
+//
+// AddShard changes the ring right away and Rebalance moves the documents to
+// their new shard while the storage is in use: until it finishes the documents
+// not found in their shard are looked up in the one they had before. The
+// rebalance in progress is recorded in Metadata, so a ShardedStorage created
+// over the same shards and Metadata resumes it.
+type ShardedStorage struct {
+	Storage
+	Shards       []Storage
+	ByFolder     bool
+	VirtualNodes int
+	// Metadata keeps the records of the storage itself, apart from the
+	// documents. AddShard fails with ErrNoMetadata without it.
+	Metadata Storage
+
+	mutex         sync.RWMutex
+	rebalanceLock sync.Mutex
+	ringOnce      sync.Once
+	ringErr       error
+	ring          []ringNode
+	previousRing  []ringNode
+}
+
+type ringNode struct {
+	hash  uint32
+	shard int
+}
+
+func (ss *ShardedStorage) Get(id string) (c.Document, error) {
+	return ss.GetContext(context.Background(), id)
+}
+
+func (ss *ShardedStorage) GetContext(ctx context.Context, id string) (c.Document, error) {
+	ss.mutex.RLock()
+	defer ss.mutex.RUnlock()
+
+	shard, previous_shard, err := ss.owners(id)
+	if err != nil {
+		return nil, err
+	}
+	document, err := GetContext(ctx, ss.Shards[shard], id)
+	if errors.Is(err, c.ErrDocumentDoestNotExist) && previous_shard != shard {
+		return GetContext(ctx, ss.Shards[previous_shard], id)
+	}
+
+	return document, err
+}
+
+func (ss *ShardedStorage) Set(document c.Document) (c.Document, error) {
+	return ss.SetContext(context.Background(), document)
+}
+
+func (ss *ShardedStorage) SetContext(ctx context.Context, document c.Document) (c.Document, error) {
+	document_id, err := document.GetId()
+	if err != nil {
+		return nil, err
+	}
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	shard, err := ss.settle(ctx, document_id)
+	if err != nil {
+		return nil, err
+	}
+
+	return SetContext(ctx, ss.Shards[shard], document)
+}
+
+func (ss *ShardedStorage) Patch(document c.Document) (c.Document, error) {
+	return ss.PatchContext(context.Background(), document)
+}
+
+func (ss *ShardedStorage) PatchContext(ctx context.Context, document c.Document) (c.Document, error) {
+	document_id, err := document.GetId()
+	if err != nil {
+		return nil, err
+	}
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	shard, err := ss.settle(ctx, document_id)
+	if err != nil {
+		return nil, err
+	}
+
+	return PatchContext(ctx, ss.Shards[shard], document)
+}
+
+func (ss *ShardedStorage) Exists(id string) (bool, error) {
+	return ss.ExistsContext(context.Background(), id)
+}
+
+func (ss *ShardedStorage) ExistsContext(ctx context.Context, id string) (bool, error) {
+	ss.mutex.RLock()
+	defer ss.mutex.RUnlock()
+
+	shard, previous_shard, err := ss.owners(id)
+	if err != nil {
+		return false, err
+	}
+	exists, err := ExistsContext(ctx, ss.Shards[shard], id)
+	if err != nil || exists || previous_shard == shard {
+		return exists, err
+	}
+
+	return ExistsContext(ctx, ss.Shards[previous_shard], id)
+}
+
+func (ss *ShardedStorage) List(folder string) ([]string, error) {
+	return ss.ListContext(context.Background(), folder)
+}
+
+func (ss *ShardedStorage) ListContext(ctx context.Context, folder string) ([]string, error) {
+	ss.mutex.RLock()
+	defer ss.mutex.RUnlock()
+
+	seen := map[string]bool{}
+	simple_ids := []string{}
+	for _, shard := range ss.Shards {
+		shard_ids, err := ListContext(ctx, shard, folder)
+		if err != nil {
+			return nil, err
+		}
+		for _, simple_id := range shard_ids {
+			if !seen[simple_id] {
+				seen[simple_id] = true
+				simple_ids = append(simple_ids, simple_id)
+			}
+		}
+	}
+	sort.Strings(simple_ids)
+
+	return simple_ids, nil
+}
+
+func (ss *ShardedStorage) Delete(id string) error {
+	return ss.DeleteContext(context.Background(), id)
+}
+
+func (ss *ShardedStorage) DeleteContext(ctx context.Context, id string) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	shard, err := ss.settle(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	return DeleteContext(ctx, ss.Shards[shard], id)
+}
+
+func (ss *ShardedStorage) DeleteFolder(folder string) error {
+	return ss.DeleteFolderContext(context.Background(), folder)
+}
+
+func (ss *ShardedStorage) DeleteFolderContext(ctx context.Context, folder string) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	for _, shard := range ss.Shards {
+		err := DeleteFolderContext(ctx, shard, folder)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ss *ShardedStorage) Commit(operations []Operation) error {
+	return ss.CommitContext(context.Background(), operations)
+}
+
+// CommitContext groups the operations by shard and commits each group.
+// Folder deletions go to every shard.
+func (ss *ShardedStorage) CommitContext(ctx context.Context, operations []Operation) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	shard_operations := make([][]Operation, len(ss.Shards))
+	for _, operation := range operations {
+		switch operation.Type {
+		case OperationSet:
+			document_id, err := operation.Document.GetId()
+			if err != nil {
+				return err
+			}
+			shard, err := ss.settle(ctx, document_id)
+			if err != nil {
+				return err
+			}
+			shard_operations[shard] = append(shard_operations[shard], operation)
+		case OperationDelete:
+			shard, err := ss.settle(ctx, operation.Id)
+			if err != nil {
+				return err
+			}
+			shard_operations[shard] = append(shard_operations[shard], operation)
+		case OperationDeleteFolder:
+			for shard := range ss.Shards {
+				shard_operations[shard] = append(shard_operations[shard], operation)
+			}
+		}
+	}
+
+	for shard, operations := range shard_operations {
+		if len(operations) == 0 {
+			continue
+		}
+		err := CommitContext(ctx, ss.Shards[shard], operations)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddShard adds the shard to the ring. Its documents have to be moved with
+// Rebalance before adding another one.
+func (ss *ShardedStorage) AddShard(shard Storage) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	err := ss.ensureRing()
+	if err != nil {
+		return err
+	}
+	if ss.previousRing != nil {
+		return ErrRebalancing
+	}
+	if ss.Metadata == nil {
+		return ErrNoMetadata
+	}
+
+	_, err = ss.Metadata.Set(c.NewDocument(rebalanceId, "previous_shards", len(ss.Shards)))
+	if err != nil {
+		return err
+	}
+	ss.previousRing = ss.ring
+	ss.Shards = append(ss.Shards, shard)
+	ss.ring = ss.buildRing(len(ss.Shards))
+
+	return nil
+}
+
+// Rebalance moves every document that isn't in its shard to it, one by one
+// so the storage can be used meanwhile.
+func (ss *ShardedStorage) Rebalance() error {
+	ss.rebalanceLock.Lock()
+	defer ss.rebalanceLock.Unlock()
+
+	ss.mutex.RLock()
+	shards := ss.Shards
+	ss.mutex.RUnlock()
+
+	for shard_index, shard := range shards {
+		ids := []string{}
+		err := Walk(shard, "", func(id string) error {
+			ids = append(ids, id)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			err = ss.move(shard_index, id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	if ss.previousRing == nil {
+		return nil
+	}
+	err := ss.Metadata.Delete(rebalanceId)
+	if err != nil && !errors.Is(err, c.ErrDocumentDoestNotExist) {
+		return err
+	}
+	ss.previousRing = nil
+
+	return nil
+}
+
+// move moves the document from the shard to the one it belongs to, unless it
+// has been written there meanwhile.
+func (ss *ShardedStorage) move(from int, id string) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	shard, _, err := ss.owners(id)
+	if err != nil || shard == from {
+		return err
+	}
+
+	return ss.relocate(context.Background(), from, shard, id)
+}
+
+// settle moves the document to its shard, when it's still in the previous one,
+// so it can be written there. The caller must hold the write lock.
+func (ss *ShardedStorage) settle(ctx context.Context, id string) (int, error) {
+	shard, previous_shard, err := ss.owners(id)
+	if err != nil || shard == previous_shard {
+		return shard, err
+	}
+
+	return shard, ss.relocate(ctx, previous_shard, shard, id)
+}
+
+// relocate copies the document between the shards, unless the destination
+// already has it, and removes it from the source. The caller must hold the
+// write lock.
+func (ss *ShardedStorage) relocate(ctx context.Context, from int, to int, id string) error {
+	document, err := GetContext(ctx, ss.Shards[from], id)
+	if errors.Is(err, c.ErrDocumentDoestNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	exists, err := ExistsContext(ctx, ss.Shards[to], id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = SetContext(ctx, ss.Shards[to], document)
+		if err != nil {
+			return err
+		}
+	}
+
+	return DeleteContext(ctx, ss.Shards[from], id)
+}
+
+// owners returns the shard of the document and the one it had before the
+// last AddShard, which is the same when not rebalancing.
+func (ss *ShardedStorage) owners(id string) (int, int, error) {
+	err := ss.ensureRing()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	key := id
+	if ss.ByFolder {
+		key = strings.SplitN(strings.Trim(id, "/"), "/", 2)[0]
+	}
+	hash := hashKey(key)
+
+	shard := lookupRing(ss.ring, hash)
+	if ss.previousRing == nil {
+		return shard, shard, nil
+	}
+
+	return shard, lookupRing(ss.previousRing, hash), nil
+}
+
+// ensureRing builds the ring, and the previous one when a rebalance was
+// recorded.
+func (ss *ShardedStorage) ensureRing() error {
+	ss.ringOnce.Do(func() {
+		ss.ring = ss.buildRing(len(ss.Shards))
+		if ss.Metadata == nil {
+			return
+		}
+
+		document, err := ss.Metadata.Get(rebalanceId)
+		if err != nil {
+			if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+				ss.ringErr = err
+			}
+			return
+		}
+		previous_shards, _ := c.Int(document["previous_shards"])
+		if previous_shards <= 0 || previous_shards >= len(ss.Shards) {
+			ss.ringErr = fmt.Errorf("invalid rebalance record %v", document)
+			return
+		}
+		ss.previousRing = ss.buildRing(previous_shards)
+	})
+
+	return ss.ringErr
+}
+
+// buildRing places the first shards in the ring.
+func (ss *ShardedStorage) buildRing(shards int) []ringNode {
+	virtual_nodes := ss.VirtualNodes
+	if virtual_nodes <= 0 {
+		virtual_nodes = defaultVirtualNodes
+	}
+
+	ring := make([]ringNode, 0, shards*virtual_nodes)
+	for shard := 0; shard < shards; shard++ {
+		for node := 0; node < virtual_nodes; node++ {
+			ring = append(ring, ringNode{
+				hash:  hashKey(strconv.Itoa(shard) + "#" + strconv.Itoa(node)),
+				shard: shard,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+
+	return ring
+}
+
+func lookupRing(ring []ringNode, hash uint32) int {
+	i := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= hash
+	})
+	if i == len(ring) {
+		i = 0
+	}
+
+	return ring[i].shard
+}
+
+func hashKey(key string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+
+	return hash.Sum32()
+}
@@ -0,0 +1,389 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	c "godb/common"
+)
+
+const defaultSQLTable = "documents"
+
+var ErrInvalidTable = errors.New("invalid table name")
+
+// tableNamePattern keeps the table names plain identifiers, as they can't be
+// passed as query parameters.
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SQLStorage keeps the documents in a table of a database/sql database, one
+// row per document with its folder in its own column so listing and deleting
+// folders don't need to scan all the ids. Documents are stored as JSON text,
+// so they can be queried with the JSON functions of the database.
+//
+// The queries use "?" placeholders and upserts with ON CONFLICT, as SQLite
+// does.
+type SQLStorage struct {
+	Storage
+	DB *sql.DB
+	// Table must be an identifier of letters, digits and underscores. It's
+	// "documents" by default.
+	Table string
+
+	openOnce sync.Once
+	openErr  error
+}
+
+// sqlQuerier is implemented by both *sql.DB and *sql.Tx.
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (ss *SQLStorage) Get(id string) (c.Document, error) {
+	return ss.GetContext(context.Background(), id)
+}
+
+func (ss *SQLStorage) GetContext(ctx context.Context, id string) (c.Document, error) {
+	err := ss.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	return ss.get(ctx, ss.DB, id)
+}
+
+func (ss *SQLStorage) Set(document c.Document) (c.Document, error) {
+	return ss.SetContext(context.Background(), document)
+}
+
+func (ss *SQLStorage) SetContext(ctx context.Context, document c.Document) (c.Document, error) {
+	err := ss.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ss.set(ctx, ss.DB, document)
+	if err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+func (ss *SQLStorage) Patch(document c.Document) (c.Document, error) {
+	return ss.PatchContext(context.Background(), document)
+}
+
+func (ss *SQLStorage) PatchContext(ctx context.Context, document c.Document) (c.Document, error) {
+	var patched_document c.Document
+	err := ss.transaction(ctx, func(tx *sql.Tx) error {
+		document_id, err := document.GetId()
+		if err != nil {
+			return err
+		}
+
+		existing_document, err := ss.get(ctx, tx, document_id)
+		if err != nil {
+			if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+				return err
+			}
+			existing_document = c.NewDocument(document_id)
+		}
+		existing_document.Patch(document)
+		patched_document = existing_document
+
+		return ss.set(ctx, tx, existing_document)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return patched_document, nil
+}
+
+func (ss *SQLStorage) Exists(id string) (bool, error) {
+	return ss.ExistsContext(context.Background(), id)
+}
+
+func (ss *SQLStorage) ExistsContext(ctx context.Context, id string) (bool, error) {
+	err := ss.ensureOpen()
+	if err != nil {
+		return false, err
+	}
+
+	var count int
+	err = ss.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+ss.table()+" WHERE id = ?", id).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (ss *SQLStorage) List(folder string) ([]string, error) {
+	return ss.ListContext(context.Background(), folder)
+}
+
+func (ss *SQLStorage) ListContext(ctx context.Context, folder string) ([]string, error) {
+	err := ss.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	folder = strings.Trim(folder, "/")
+	prefix := folderPrefix(folder)
+	simple_ids := []string{}
+
+	rows, err := ss.DB.QueryContext(ctx, "SELECT id FROM "+ss.table()+" WHERE folder = ?", folder)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		simple_ids = append(simple_ids, strings.TrimPrefix(id, prefix))
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	// LIKE ignores the case in SQLite, the prefix is compared as is
+	folder_rows, err := ss.DB.QueryContext(ctx, "SELECT DISTINCT folder FROM "+ss.table()+" WHERE substr(folder, 1, length(?)) = ? AND folder <> ''", prefix, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer folder_rows.Close()
+	seen := map[string]bool{}
+	for folder_rows.Next() {
+		var subfolder string
+		err = folder_rows.Scan(&subfolder)
+		if err != nil {
+			return nil, err
+		}
+		simple_id := strings.Split(strings.TrimPrefix(subfolder, prefix), "/")[0] + "/"
+		if !seen[simple_id] {
+			seen[simple_id] = true
+			simple_ids = append(simple_ids, simple_id)
+		}
+	}
+	err = folder_rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(simple_ids)
+
+	return simple_ids, nil
+}
+
+func (ss *SQLStorage) Delete(id string) error {
+	return ss.DeleteContext(context.Background(), id)
+}
+
+func (ss *SQLStorage) DeleteContext(ctx context.Context, id string) error {
+	err := ss.ensureOpen()
+	if err != nil {
+		return err
+	}
+
+	deleted, err := ss.delete(ctx, ss.DB, id)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return c.ErrDocumentDoestNotExist
+	}
+
+	return nil
+}
+
+func (ss *SQLStorage) DeleteFolder(folder string) error {
+	return ss.DeleteFolderContext(context.Background(), folder)
+}
+
+func (ss *SQLStorage) DeleteFolderContext(ctx context.Context, folder string) error {
+	err := ss.ensureOpen()
+	if err != nil {
+		return err
+	}
+
+	return ss.deleteFolder(ctx, ss.DB, folder)
+}
+
+func (ss *SQLStorage) Commit(operations []Operation) error {
+	return ss.CommitContext(context.Background(), operations)
+}
+
+func (ss *SQLStorage) CommitContext(ctx context.Context, operations []Operation) error {
+	return ss.transaction(ctx, func(tx *sql.Tx) error {
+		for _, operation := range operations {
+			var err error
+			switch operation.Type {
+			case OperationSet:
+				err = ss.set(ctx, tx, operation.Document)
+			case OperationDelete:
+				_, err = ss.delete(ctx, tx, operation.Id)
+			case OperationDeleteFolder:
+				err = ss.deleteFolder(ctx, tx, operation.Id)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (ss *SQLStorage) get(ctx context.Context, querier sqlQuerier, id string) (c.Document, error) {
+	var document_json string
+	err := querier.QueryRowContext(ctx, "SELECT document FROM "+ss.table()+" WHERE id = ?", id).Scan(&document_json)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, c.ErrDocumentDoestNotExist
+		}
+		return nil, err
+	}
+
+	document := c.Document{}
+	err = json.Unmarshal([]byte(document_json), &document)
+	if err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+func (ss *SQLStorage) set(ctx context.Context, querier sqlQuerier, document c.Document) error {
+	document_id, err := document.GetId()
+	if err != nil {
+		return err
+	}
+	if document_id == "" {
+		return c.ErrInvalidId
+	}
+
+	document_bytes, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+
+	_, err = querier.ExecContext(
+		ctx,
+		"INSERT INTO "+ss.table()+" (id, folder, document) VALUES (?, ?, ?) "+
+			"ON CONFLICT (id) DO UPDATE SET folder = excluded.folder, document = excluded.document",
+		document_id, c.Folder(document_id), string(document_bytes),
+	)
+
+	return err
+}
+
+func (ss *SQLStorage) delete(ctx context.Context, querier sqlQuerier, id string) (bool, error) {
+	result, err := querier.ExecContext(ctx, "DELETE FROM "+ss.table()+" WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return deleted > 0, nil
+}
+
+func (ss *SQLStorage) deleteFolder(ctx context.Context, querier sqlQuerier, folder string) error {
+	folder = strings.Trim(folder, "/")
+	if folder == "" {
+		_, err := querier.ExecContext(ctx, "DELETE FROM "+ss.table())
+		return err
+	}
+
+	_, err := querier.ExecContext(
+		ctx,
+		"DELETE FROM "+ss.table()+" WHERE folder = ? OR substr(folder, 1, length(?)) = ?",
+		folder, folderPrefix(folder), folderPrefix(folder),
+	)
+
+	return err
+}
+
+func (ss *SQLStorage) transaction(ctx context.Context, f func(tx *sql.Tx) error) error {
+	err := ss.ensureOpen()
+	if err != nil {
+		return err
+	}
+
+	tx, err := ss.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = f(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ensureOpen creates the table and its folder index when they don't exist.
+func (ss *SQLStorage) ensureOpen() error {
+	ss.openOnce.Do(func() {
+		ss.openErr = validateTable(ss.tableName())
+		if ss.openErr != nil {
+			return
+		}
+
+		ctx := context.Background()
+		_, ss.openErr = ss.DB.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+ss.table()+" ("+
+			"id TEXT PRIMARY KEY, "+
+			"folder TEXT NOT NULL, "+
+			"document TEXT NOT NULL)")
+		if ss.openErr != nil {
+			return
+		}
+		_, ss.openErr = ss.DB.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS "+quoteIdentifier(ss.tableName()+"_folder")+" ON "+ss.table()+" (folder)")
+	})
+
+	return ss.openErr
+}
+
+// table returns the quoted name of the table, to be used in the queries.
+func (ss *SQLStorage) table() string {
+	return quoteIdentifier(ss.tableName())
+}
+
+func (ss *SQLStorage) tableName() string {
+	if ss.Table == "" {
+		return defaultSQLTable
+	}
+
+	return ss.Table
+}
+
+func validateTable(table string) error {
+	if !tableNamePattern.MatchString(table) {
+		return fmt.Errorf("%w '%s'", ErrInvalidTable, table)
+	}
+
+	return nil
+}
+
+func quoteIdentifier(identifier string) string {
+	return `"` + identifier + `"`
+}
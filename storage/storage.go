@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"strings"
+
 	c "godb/common"
 )
 
@@ -12,4 +14,48 @@ type Storage interface {
 	List(folder string) ([]string, error)
 	Delete(id string) error
 	DeleteFolder(folder string) error
+	// Commit applies all the operations atomically: either all of them are
+	// visible afterwards or none is.
+	Commit(operations []Operation) error
+}
+
+type OperationType string
+
+const (
+	OperationSet          OperationType = "set"
+	OperationDelete       OperationType = "delete"
+	OperationDeleteFolder OperationType = "deleteFolder"
+)
+
+type Operation struct {
+	Type     OperationType `json:"type"`
+	Id       string        `json:"id"`
+	Document c.Document    `json:"document,omitempty"`
+}
+
+// Walk calls f with the id of every document inside the folder, recursively.
+func Walk(storage Storage, folder string, f func(id string) error) error {
+	folder = strings.Trim(folder, "/")
+	simple_ids, err := storage.List(folder)
+	if err != nil {
+		return err
+	}
+
+	for _, simple_id := range simple_ids {
+		id := simple_id
+		if folder != "" {
+			id = folder + "/" + simple_id
+		}
+
+		if strings.HasSuffix(simple_id, "/") {
+			err = Walk(storage, id, f)
+		} else {
+			err = f(id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
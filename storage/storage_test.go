@@ -1,238 +1,2002 @@
 package storage
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
 	"errors"
+	"io"
+	"math/rand"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	c "godb/common"
+
+	_ "modernc.org/sqlite"
 )
 
-func getStorages(tempDir string) map[string]Storage {
-	return map[string]Storage{
-		"FileStorage":   &FileStorage{Root: tempDir},
-		"MemoryStorage": &MemoryStorage{},
+// storageFactories builds every storage, empty, for the conformance suite
+// and the benchmarks.
+var storageFactories = map[string]func(tb testing.TB) Storage{
+	"FileStorage": func(tb testing.TB) Storage {
+		return &FileStorage{Root: tb.TempDir()}
+	},
+	"FileStorage (zstd)": func(tb testing.TB) Storage {
+		return &FileStorage{Root: tb.TempDir(), Compression: CompressionZstd}
+	},
+	"FileStorage (msgpack)": func(tb testing.TB) Storage {
+		return &FileStorage{Root: tb.TempDir(), Codec: MsgpackCodec}
+	},
+	"FileStorage (fan-out)": func(tb testing.TB) Storage {
+		return &FileStorage{Root: tb.TempDir(), FanOut: 2}
+	},
+	"FileStorage (cbor)": func(tb testing.TB) Storage {
+		return &FileStorage{Root: tb.TempDir(), Codec: CBORCodec}
+	},
+	"MemoryStorage": func(tb testing.TB) Storage {
+		return &MemoryStorage{}
+	},
+	"MemoryStorage (persistent)": func(tb testing.TB) Storage {
+		return &MemoryStorage{Dir: tb.TempDir()}
+	},
+	"LogStorage": func(tb testing.TB) Storage {
+		return &LogStorage{Root: tb.TempDir()}
+	},
+	"BTreeStorage": func(tb testing.TB) Storage {
+		return &BTreeStorage{Path: filepath.Join(tb.TempDir(), "godb.db")}
+	},
+	"SQLStorage": func(tb testing.TB) Storage {
+		return &SQLStorage{DB: openSQLite(filepath.Join(tb.TempDir(), "sqlite.db"))}
+	},
+	"CachedStorage": func(tb testing.TB) Storage {
+		return &CachedStorage{Backend: &FileStorage{Root: tb.TempDir()}, MaxEntries: 2}
+	},
+	"TieredStorage": func(tb testing.TB) Storage {
+		return &TieredStorage{Hot: &MemoryStorage{}, Cold: &FileStorage{Root: tb.TempDir()}, MaxHotDocuments: 2}
+	},
+	"TieredStorage (write-back)": func(tb testing.TB) Storage {
+		return &TieredStorage{Hot: &MemoryStorage{}, Cold: &FileStorage{Root: tb.TempDir()}, WriteBack: true, MaxHotDocuments: 2}
+	},
+	"ShardedStorage": func(tb testing.TB) Storage {
+		return &ShardedStorage{Shards: []Storage{
+			&FileStorage{Root: tb.TempDir()},
+			&FileStorage{Root: tb.TempDir()},
+			&MemoryStorage{},
+		}}
+	},
+	"EncryptedStorage": func(tb testing.TB) Storage {
+		return &EncryptedStorage{
+			Backend:      &FileStorage{Root: tb.TempDir()},
+			Keys:         map[string][]byte{"2024": []byte("0123456789abcdef0123456789abcdef")},
+			CurrentKeyId: "2024",
+			IdKey:        []byte("fedcba9876543210"),
+		}
+	},
+	"FaultStorage": func(tb testing.TB) Storage {
+		return &FaultStorage{
+			Backend: &FileStorage{Root: tb.TempDir()},
+			Rules:   []FaultRule{{Operations: []string{"get", "list"}, Latency: time.Microsecond}},
+		}
+	},
+	"S3Storage": func(tb testing.TB) Storage {
+		s3_server := newFakeS3Server(tb)
+		return &S3Storage{Endpoint: s3_server.URL, Bucket: "godb", Prefix: "data/", AccessKey: "key", SecretKey: "secret"}
+	},
+}
+
+func openSQLite(path string) *sql.DB {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		panic(err)
+	}
+
+	return db
+}
+
+func Test_FileStorageRecoversJournal(t *testing.T) {
+	root := t.TempDir()
+	storage := &FileStorage{Root: root}
+
+	operations := []Operation{
+		{Type: OperationSet, Id: "movies/matrix", Document: c.NewDocument("movies/matrix", "name", "Matrix")},
+	}
+	err := storage.writeJournal(filepath.Join(root, journalName), operations)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	document, err := (&FileStorage{Root: root}).Get("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := c.NewDocument("movies/matrix", "name", "Matrix")
+	if !objectsDeepEqual(document, expected) {
+		t.Fatalf("expected 'movies/matrix' document to equal %v but got %v", expected, document)
+	}
+}
+
+func Test_FileStorageCompletesFailedCommits(t *testing.T) {
+	root := t.TempDir()
+	storage := &FileStorage{Root: root}
+
+	// "movies.json/alien" can't be written while the "movies" document exists
+	_, err := storage.Set(c.NewDocument("movies", "name", "Movies"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	err = storage.Commit([]Operation{
+		{Type: OperationSet, Document: c.NewDocument("matrix", "name", "Matrix")},
+		{Type: OperationSet, Document: c.NewDocument("movies.json/alien", "name", "Alien")},
+	})
+	if err == nil {
+		t.Fatalf("expected the commit to fail")
+	}
+
+	err = storage.Delete("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	err = storage.Commit([]Operation{
+		{Type: OperationSet, Document: c.NewDocument("superman", "name", "Superman")},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	// the failed commit is completed before the next one
+	for _, id := range []string{"matrix", "movies.json/alien", "superman"} {
+		_, err := storage.Get(id)
+		if err != nil {
+			t.Fatalf("unexpected error '%s' getting %s", err, id)
+		}
+	}
+	_, err = os.Stat(filepath.Join(root, journalName))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the journal to be removed but got '%v'", err)
+	}
+}
+
+func Test_FileStorageRecoversInterruptedWrites(t *testing.T) {
+	root := t.TempDir()
+	movies := filepath.Join(root, "movies")
+	err := os.MkdirAll(movies, os.ModePerm)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	files := map[string]string{
+		// crashed after removing the document, before renaming the backup
+		"matrix.json.backup": `{"id":"movies/matrix","name":"Matrix"}`,
+		// crashed before removing the document
+		"alien.json":        `{"id":"movies/alien","name":"Alien"}`,
+		"alien.json.backup": `{"id":"movies/alien","name":"Alien 2"}`,
+		// crashed before renaming the temp file
+		".superman.json.123.tmp": `{"id":"movies/superman"`,
+	}
+	for name, content := range files {
+		err = os.WriteFile(filepath.Join(movies, name), []byte(content), os.ModePerm)
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+
+	storage := &FileStorage{Root: root}
+	ids, err := storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := []string{"alien", "matrix"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+
+	document, err := storage.Get("movies/alien")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected_document := c.NewDocument("movies/alien", "name", "Alien")
+	if !objectsDeepEqual(document, expected_document) {
+		t.Fatalf("expected 'movies/alien' document to equal %v but got %v", expected_document, document)
+	}
+
+	_, err = storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	entries, err := os.ReadDir(movies)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected only the 2 documents to be left but got %v", entries)
+	}
+}
+
+func Test_FileStorageDurabilityModes(t *testing.T) {
+	for _, durability := range []Durability{DurabilityNone, DurabilityPerWrite, DurabilityGroupCommit} {
+		t.Run(string(durability), func(t *testing.T) {
+			storage := &FileStorage{Root: t.TempDir(), Durability: durability}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 10)
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, err := storage.Set(c.NewDocument(c.S("movies/%d", i), "name", "Matrix"))
+					errs <- err
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Fatalf("unexpected error '%s'", err)
+				}
+			}
+
+			ids, err := storage.List("movies")
+			if err != nil {
+				t.Fatalf("unexpected error '%s'", err)
+			}
+			if len(ids) != 10 {
+				t.Fatalf("expected 10 documents but got %v", ids)
+			}
+		})
+	}
+
+	_, err := (&FileStorage{Root: t.TempDir(), Durability: "grup"}).Set(c.NewDocument("movies/matrix"))
+	if !errors.Is(err, ErrInvalidDurability) {
+		t.Fatalf("expected error '%s' but got '%v'", ErrInvalidDurability, err)
+	}
+}
+
+func Test_FileStorageGroupCommitSharesSyncs(t *testing.T) {
+	syncs := map[Durability]uint64{}
+	for _, durability := range []Durability{DurabilityNone, DurabilityPerWrite, DurabilityGroupCommit} {
+		storage := &FileStorage{Root: t.TempDir(), Durability: durability, GroupCommitWindow: 50 * time.Millisecond}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := storage.Set(c.NewDocument(c.S("movies/%d", i), "name", "Matrix"))
+				if err != nil {
+					t.Errorf("unexpected error '%s'", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		syncs[durability] = storage.syncer.syncs.Load()
+	}
+
+	// a temp file and the folder per write, the folder shared by the group
+	if syncs[DurabilityNone] != 0 || syncs[DurabilityPerWrite] < 20 || syncs[DurabilityGroupCommit] >= syncs[DurabilityPerWrite] {
+		t.Fatalf("expected the group commit to share the fsyncs but got %v", syncs)
+	}
+}
+
+func Test_FileStorageCompressesDocuments(t *testing.T) {
+	root := t.TempDir()
+	long_name := strings.Repeat("Matrix ", 100)
+
+	for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		storage := &FileStorage{Root: root, Compression: compression, CompressionThreshold: 100}
+		_, err := storage.Set(c.NewDocument("movies/"+string(compression), "name", long_name))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+		_, err = storage.Set(c.NewDocument("short/"+string(compression), "name", "Matrix"))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+
+	for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		file_bytes, err := os.ReadFile(filepath.Join(root, "movies", string(compression)+".json"))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+		compressed := len(file_bytes) < len(long_name)
+		if compressed != (compression != CompressionNone) {
+			t.Fatalf("expected the %s document to be compressed only when compression is enabled, got %d bytes", compression, len(file_bytes))
+		}
+		file_bytes, err = os.ReadFile(filepath.Join(root, "short", string(compression)+".json"))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+		if !strings.HasPrefix(string(file_bytes), "{") {
+			t.Fatalf("expected documents under the threshold to not be compressed but got %q", file_bytes)
+		}
+	}
+
+	// a single storage reads all of them
+	storage := &FileStorage{Root: root}
+	for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		document, err := storage.Get("movies/" + string(compression))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+		if document["name"] != long_name {
+			t.Fatalf("expected the %s document to be read back but got %v", compression, document)
+		}
+	}
+}
+
+func Test_FileStorageCodecs(t *testing.T) {
+	root := t.TempDir()
+
+	storage := &FileStorage{Root: root}
+	_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix", "year", 1999))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	storage = &FileStorage{Root: root, Codec: CBORCodec}
+	_, err = storage.Set(c.NewDocument("movies/alien", "name", "Alien", "year", 1979))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	document, err := storage.Get("movies/alien")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if _, ok := document["year"].(int64); !ok {
+		t.Fatalf("expected integers to be kept as int64 but got %T", document["year"])
+	}
+	_, err = storage.Set(c.NewDocument("movies/alien", "_rev", 2))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	document, err = storage.Get("movies/alien")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if document.GetRev() != 2 {
+		t.Fatalf("expected rev to be 2 but got %d", document.GetRev())
+	}
+
+	ids, err := storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !objectsDeepEqual(ids, []string{"alien", "matrix"}) {
+		t.Fatalf("expected to list the documents of both codecs but got %v", ids)
+	}
+
+	_, err = storage.Patch(c.NewDocument("movies/matrix", "director", "Wachowski"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	_, err = os.Stat(filepath.Join(root, "movies", "matrix.json"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the JSON file to be replaced but got '%v'", err)
+	}
+	document, err = storage.Get("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := c.NewDocument("movies/matrix", "name", "Matrix", "year", 1999, "director", "Wachowski")
+	if !objectsDeepEqual(document, expected) {
+		t.Fatalf("expected 'movies/matrix' document to equal %v but got %v", expected, document)
+	}
+	_, err = os.Stat(filepath.Join(root, "movies", "matrix.cbor"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	// a custom codec, not registered
+	storage = &FileStorage{Root: t.TempDir(), Codec: customCodec{JSONCodec}}
+	_, err = storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	ids, err = storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	exists, err := storage.Exists("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !objectsDeepEqual(ids, []string{"matrix"}) || !exists {
+		t.Fatalf("expected the document of the custom codec to be listed and to exist but got %v, %v", ids, exists)
+	}
+	problems, err := storage.Check(false)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("expected no problems but got %+v", problems)
+	}
+	err = storage.Delete("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+}
+
+type customCodec struct {
+	Codec
+}
+
+func (customCodec) Extension() string {
+	return ".custom"
+}
+
+func Test_LogStorageReplaysAndCompacts(t *testing.T) {
+	root := t.TempDir()
+	storage := &LogStorage{Root: root, SegmentSize: 256, CompactionRatio: 2}
+
+	for i := 0; i < 20; i++ {
+		_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix", "version", i))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+	_, err := storage.Set(c.NewDocument("movies/alien", "name", "Alien"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	err = storage.Delete("movies/alien")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	err = storage.Compact()
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	segments, err := filepath.Glob(filepath.Join(root, "*"+segmentSuffix))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(segments) != 2 {
+		t.Fatalf("expected the compacted and the active segments but got %v", segments)
+	}
+	live_bytes := int64(0)
+	for _, entry := range storage.keydir {
+		live_bytes += entry.size
+	}
+	if storage.liveBytes != live_bytes {
+		t.Fatalf("expected %d live bytes but got %d", live_bytes, storage.liveBytes)
+	}
+
+	// a torn record at the end must be ignored
+	file, err := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	file.Write([]byte{1, 2, 3, 4, 0, 0, 0, 200, '{'})
+	file.Close()
+	storage.Close()
+
+	storage = &LogStorage{Root: root}
+	document, err := storage.Get("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := c.NewDocument("movies/matrix", "name", "Matrix", "version", 19)
+	if !objectsDeepEqual(document, expected) {
+		t.Fatalf("expected 'movies/matrix' document to equal %v but got %v", expected, document)
+	}
+
+	ids, err := storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected_ids := []string{"matrix"}
+	if !objectsDeepEqual(ids, expected_ids) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected_ids, ids)
+	}
+	storage.Close()
+}
+
+func Test_BTreeStorageKeepsOrderAndReopens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godb.db")
+	storage := &BTreeStorage{Path: path, Durability: DurabilityNone}
+
+	// enough documents to split the tree in several levels
+	big := strings.Repeat("x", 300)
+	for i := 0; i < 2000; i++ {
+		_, err := storage.Set(c.NewDocument(c.S("movies/%04d", i), "name", big))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+	_, err := storage.Set(c.NewDocument("movies/sequels/matrix", "name", strings.Repeat("y", 3*btreePageSize)))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	for i := 0; i < 2000; i += 2 {
+		err := storage.Delete(c.S("movies/%04d", i))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+	storage.Close()
+
+	storage = &BTreeStorage{Path: path}
+	ids, err := storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(ids) != 1001 || ids[0] != "0001" || ids[999] != "1999" || ids[1000] != "sequels/" {
+		t.Fatalf("expected 1000 ordered ids and a folder but got %d: %v", len(ids), ids[:3])
+	}
+
+	document, err := storage.Get("movies/sequels/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(document["name"].(string)) != 3*btreePageSize {
+		t.Fatalf("expected the overflowing document to be read back")
+	}
+
+	err = storage.DeleteFolder("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	ids, err = storage.List("")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("expected no ids but got %v", ids)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if info.Size() > 2<<20 {
+		t.Fatalf("expected freed pages to be reused but the file has %d bytes", info.Size())
+	}
+	storage.Close()
+}
+
+func Test_BTreeStorageFallsBackToPreviousCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godb.db")
+	storage := &BTreeStorage{Path: path}
+
+	_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	_, err = storage.Set(c.NewDocument("movies/alien", "name", "Alien"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	last_txid := storage.meta.txid
+	storage.Close()
+
+	// tear the meta page of the last commit
+	file, err := os.OpenFile(path, os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	file.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(last_txid%2)*btreePageSize+16)
+	file.Close()
+
+	storage = &BTreeStorage{Path: path}
+	ids, err := storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := []string{"matrix"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+	storage.Close()
+}
+
+func Test_SQLStorageIsInspectable(t *testing.T) {
+	db := openSQLite(filepath.Join(t.TempDir(), "sqlite.db"))
+	defer db.Close()
+	storage := &SQLStorage{DB: db}
+
+	_, err := storage.Set(c.NewDocument("movies/action/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	var folder, name string
+	err = db.QueryRow("SELECT folder, json_extract(document, '$.name') FROM documents WHERE id = ?", "movies/action/matrix").Scan(&folder, &name)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if folder != "movies/action" || name != "Matrix" {
+		t.Fatalf("expected row to have folder 'movies/action' and name 'Matrix' but got '%s' and '%s'", folder, name)
+	}
+
+	_, err = (&SQLStorage{DB: db, Table: "documents; DROP TABLE documents"}).Get("movies/action/matrix")
+	if !errors.Is(err, ErrInvalidTable) {
+		t.Fatalf("expected error '%s' but got '%v'", ErrInvalidTable, err)
+	}
+	_, err = storage.Get("movies/action/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+}
+
+func Test_SQLStorageMatchesFoldersByCase(t *testing.T) {
+	db := openSQLite(filepath.Join(t.TempDir(), "sqlite.db"))
+	defer db.Close()
+	storage := &SQLStorage{DB: db}
+
+	for _, id := range []string{"movies/2024/matrix", "Movies/2024/dune", "movies_old/alien"} {
+		_, err := storage.Set(c.NewDocument(id, "name", id))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+
+	ids, err := storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := []string{"2024/"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+
+	err = storage.DeleteFolder("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	ids, err = storage.List("")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected = []string{"Movies/", "movies_old/"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+}
+
+func Test_S3StoragePaginatesAndBatchesDeletes(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}, maxKeys: 3}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	storage := &S3Storage{Endpoint: server.URL, Bucket: "godb"}
+	s3DeleteBatch = 4
+	defer func() { s3DeleteBatch = 1000 }()
+
+	for i := 0; i < 10; i++ {
+		_, err := storage.Set(c.NewDocument(c.S("movies/%02d", i), "name", "Matrix"))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+	_, err := storage.Set(c.NewDocument("movies/sequels/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	ids, err := storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(ids) != 11 || ids[10] != "sequels/" {
+		t.Fatalf("expected 10 documents and a folder but got %v", ids)
+	}
+
+	err = storage.DeleteFolder("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(fake.objects) != 0 {
+		t.Fatalf("expected the bucket to be empty but has %d objects", len(fake.objects))
+	}
+	if fake.deletes != 3 {
+		t.Fatalf("expected the 11 objects to be deleted in 3 batches but got %d", fake.deletes)
+	}
+}
+
+func Test_MemoryStorageRollsBackFailedWrites(t *testing.T) {
+	dir := t.TempDir()
+	storage := &MemoryStorage{Dir: dir}
+
+	_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	// the sync fails once the operations are written
+	storage.Durability = "broken"
+	_, err = storage.Set(c.NewDocument("movies/alien", "name", "Alien"))
+	if !errors.Is(err, ErrInvalidDurability) {
+		t.Fatalf("expected error '%s' but got '%v'", ErrInvalidDurability, err)
+	}
+	storage.Durability = ""
+	_, err = storage.Set(c.NewDocument("movies/dune", "name", "Dune"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	storage.Close()
+
+	storage = &MemoryStorage{Dir: dir}
+	defer storage.Close()
+	ids, err := storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := []string{"dune", "matrix"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+}
+
+func Test_S3StorageReplaysOnlyAbandonedJournals(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}, maxKeys: 1000}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	// one left by a crash, the other still being applied by another instance
+	abandoned := c.S("godb/.journal/%020d-a-%010d", time.Now().Add(-time.Hour).UnixNano(), 1)
+	running := c.S("godb/.journal/%020d-b-%010d", time.Now().UnixNano(), 1)
+	fake.objects[abandoned] = []byte(`[{"type":"set","id":"","document":{"id":"movies/matrix","name":"Matrix"}}]`)
+	fake.objects[running] = []byte(`[{"type":"set","id":"","document":{"id":"movies/alien","name":"Alien"}}]`)
+
+	storage := &S3Storage{Endpoint: server.URL, Bucket: "godb", JournalTimeout: time.Minute}
+	ids, err := storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := []string{"matrix"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+	if _, found := fake.objects[abandoned]; found {
+		t.Fatalf("expected the abandoned journal to be removed")
+	}
+	if _, found := fake.objects[running]; !found {
+		t.Fatalf("expected the running journal to be kept")
+	}
+}
+
+func Test_MemoryStorageSurvivesRestarts(t *testing.T) {
+	dir := t.TempDir()
+	storage := &MemoryStorage{Dir: dir}
+
+	_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	err = storage.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	_, err = storage.Set(c.NewDocument("movies/alien", "name", "Alien"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	err = storage.Delete("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	storage.Close()
+
+	// a torn write at the end of the operations file must be ignored
+	file, err := os.OpenFile(filepath.Join(dir, memoryAppendOnlyName), os.O_APPEND|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	file.Write([]byte(`[{"type":"set","id":"movies/super`))
+	file.Close()
+
+	storage = &MemoryStorage{Dir: dir}
+	ids, err := storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := []string{"alien"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+
+	err = storage.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, memoryAppendOnlyName))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if info.Size() != 0 {
+		t.Fatalf("expected the snapshot to truncate the operations file but it has %d bytes", info.Size())
+	}
+	storage.Close()
+
+	storage = &MemoryStorage{Dir: dir}
+	exists, err := storage.Exists("movies/alien")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !exists {
+		t.Fatalf("expected 'movies/alien' to exist after loading the snapshot")
+	}
+	storage.Close()
+}
+
+func Test_CachedStorageEvictsAndInvalidates(t *testing.T) {
+	backend := &MemoryStorage{}
+	storage := &CachedStorage{Backend: backend, MaxEntries: 2}
+
+	for _, name := range []string{"matrix", "alien", "superman"} {
+		_, err := storage.Set(c.NewDocument("movies/"+name, "name", name))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+		_, err = storage.Get("movies/" + name)
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+
+	stats := storage.Stats()
+	if stats.Misses != 3 || stats.Hits != 0 || stats.Evictions != 1 || stats.Entries != 2 {
+		t.Fatalf("expected 3 misses, 1 eviction and 2 entries but got %+v", stats)
+	}
+
+	_, err := storage.Get("movies/superman")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if storage.Stats().Hits != 1 {
+		t.Fatalf("expected a hit but got %+v", storage.Stats())
+	}
+
+	_, err = storage.Patch(c.NewDocument("movies/superman", "year", 1978))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	document, err := storage.Get("movies/superman")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := c.NewDocument("movies/superman", "name", "superman", "year", 1978)
+	if !objectsDeepEqual(document, expected) {
+		t.Fatalf("expected 'movies/superman' document to equal %v but got %v", expected, document)
+	}
+
+	err = storage.DeleteFolder("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if storage.Stats().Entries != 0 {
+		t.Fatalf("expected the cache to be empty but got %+v", storage.Stats())
+	}
+
+	// hits keep the types of the values and can't change the cached document
+	_, err = storage.Set(c.NewDocument("movies/dune", "year", int64(1965), "cast", []any{"Paul"}))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	for i := 0; i < 2; i++ {
+		document, err = storage.Get("movies/dune")
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+		if document["year"] != int64(1965) || document["cast"].([]any)[0] != "Paul" {
+			t.Fatalf("expected the cached document to be unchanged but got %v", document)
+		}
+		document["cast"].([]any)[0] = "Leto"
+	}
+	if storage.Stats().Hits != 2 {
+		t.Fatalf("expected a hit but got %+v", storage.Stats())
+	}
+
+	storage = &CachedStorage{Backend: backend, MaxBytes: 10}
+	_, err = backend.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	_, err = storage.Get("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if storage.Stats().Bytes != 0 {
+		t.Fatalf("expected documents bigger than MaxBytes to not be cached but got %+v", storage.Stats())
+	}
+}
+
+func Test_TieredStorageWritesBackAndEvicts(t *testing.T) {
+	hot := &MemoryStorage{}
+	cold := &MemoryStorage{}
+	storage := &TieredStorage{Hot: hot, Cold: cold, WriteBack: true, MaxHotDocuments: 2}
+
+	for _, name := range []string{"matrix", "alien", "superman"} {
+		_, err := storage.Set(c.NewDocument("movies/"+name, "name", name))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+
+	hot_ids, err := hot.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !objectsDeepEqual(hot_ids, []string{"alien", "superman"}) {
+		t.Fatalf("expected the hot tier to keep the last 2 documents but got %v", hot_ids)
+	}
+	cold_ids, err := cold.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(cold_ids) != 0 {
+		t.Fatalf("expected the cold tier to be empty before flushing but got %v", cold_ids)
+	}
+
+	ids, err := storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !objectsDeepEqual(ids, []string{"alien", "matrix", "superman"}) {
+		t.Fatalf("expected to list the documents of both tiers but got %v", ids)
+	}
+	document, err := storage.Get("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if document["name"] != "matrix" {
+		t.Fatalf("expected to get the evicted document but got %v", document)
+	}
+
+	err = storage.Delete("movies/alien")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	err = storage.Close()
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	cold_ids, err = cold.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !objectsDeepEqual(cold_ids, []string{"matrix", "superman"}) {
+		t.Fatalf("expected the cold tier to have the flushed documents but got %v", cold_ids)
+	}
+}
+
+func Test_ShardedStorageRebalancesNewShards(t *testing.T) {
+	shards := []Storage{&MemoryStorage{}, &MemoryStorage{}}
+	metadata := &MemoryStorage{}
+	storage := &ShardedStorage{Shards: shards, Metadata: metadata}
+
+	for i := 0; i < 100; i++ {
+		_, err := storage.Set(c.NewDocument(c.S("movies/%03d", i), "number", i))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+	// the rebalance record isn't a document, whatever its id
+	_, err := storage.Set(c.NewDocument("_rebalance", "name", "mine"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	for i, shard := range shards {
+		ids, err := shard.List("movies")
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+		if len(ids) == 0 {
+			t.Fatalf("expected shard %d to have documents", i)
+		}
+	}
+
+	err = (&ShardedStorage{Shards: []Storage{&MemoryStorage{}}}).AddShard(&MemoryStorage{})
+	if !errors.Is(err, ErrNoMetadata) {
+		t.Fatalf("expected error '%s' but got '%v'", ErrNoMetadata, err)
+	}
+
+	new_shard := &MemoryStorage{}
+	err = storage.AddShard(new_shard)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	err = storage.AddShard(&MemoryStorage{})
+	if !errors.Is(err, ErrRebalancing) {
+		t.Fatalf("expected error '%s' but got '%v'", ErrRebalancing, err)
+	}
+
+	// documents are found before being moved to the new shard
+	for i := 0; i < 100; i++ {
+		_, err := storage.Get(c.S("movies/%03d", i))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+	_, err = storage.Patch(c.NewDocument("movies/000", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	// and after a restart in the middle of the rebalance
+	restarted := &ShardedStorage{Shards: storage.Shards, Metadata: metadata}
+	for i := 0; i < 100; i++ {
+		_, err := restarted.Get(c.S("movies/%03d", i))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+	ids, err := restarted.List("")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !reflect.DeepEqual(ids, []string{"_rebalance", "movies/"}) {
+		t.Fatalf("expected the documents only but got %v", ids)
+	}
+	err = restarted.AddShard(&MemoryStorage{})
+	if !errors.Is(err, ErrRebalancing) {
+		t.Fatalf("expected error '%s' but got '%v'", ErrRebalancing, err)
+	}
+
+	err = storage.Rebalance()
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	new_ids, err := new_shard.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(new_ids) == 0 || len(new_ids) == 100 {
+		t.Fatalf("expected the new shard to have part of the documents but it has %d", len(new_ids))
+	}
+	ids, err = storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(ids) != 100 {
+		t.Fatalf("expected 100 documents after rebalancing but got %d", len(ids))
+	}
+	exists, err := metadata.Exists(rebalanceId)
+	if err != nil || exists {
+		t.Fatalf("expected the rebalance record to be removed but got %v, '%v'", exists, err)
+	}
+	document, err := storage.Get("_rebalance")
+	if err != nil || document["name"] != "mine" {
+		t.Fatalf("expected the '_rebalance' document to be kept but got %v, '%v'", document, err)
+	}
+	document, err = storage.Get("movies/000")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := c.NewDocument("movies/000", "number", 0, "name", "Matrix")
+	if !objectsDeepEqual(document, expected) {
+		t.Fatalf("expected 'movies/000' document to equal %v but got %v", expected, document)
+	}
+
+	by_folder := &ShardedStorage{Shards: []Storage{&MemoryStorage{}, &MemoryStorage{}}, ByFolder: true}
+	for i := 0; i < 10; i++ {
+		_, err := by_folder.Set(c.NewDocument(c.S("movies/%03d", i)))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+	for _, shard := range by_folder.Shards {
+		ids, err := shard.List("movies")
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+		if len(ids) != 0 && len(ids) != 10 {
+			t.Fatalf("expected the folder to be in a single shard but got %v", ids)
+		}
 	}
 }
 
-func testEachStorage(t *testing.T, f func(*testing.T, Storage)) {
-	for storageName, storage := range getStorages(t.TempDir()) {
-		t.Run(storageName, func(tt *testing.T) {
-			f(tt, storage)
-		})
+func Test_EncryptedStorageHidesDocumentsAndRotatesKeys(t *testing.T) {
+	backend := &MemoryStorage{}
+	storage := &EncryptedStorage{
+		Backend:      backend,
+		Keys:         map[string][]byte{"old": []byte("0123456789abcdef")},
+		CurrentKeyId: "old",
+		IdKey:        []byte("fedcba9876543210"),
+	}
+
+	_, err := storage.Set(c.NewDocument("patients/john", "diagnosis", "flu"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	stored_ids := []string{}
+	err = Walk(backend, "", func(id string) error {
+		stored_ids = append(stored_ids, id)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(stored_ids) != 1 {
+		t.Fatalf("expected a single stored document but got %v", stored_ids)
+	}
+	stored_document, err := backend.Get(stored_ids[0])
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	stored_bytes, _ := json.Marshal(stored_document)
+	for _, secret := range []string{"patients", "john", "flu"} {
+		if strings.Contains(string(stored_bytes), secret) {
+			t.Fatalf("expected '%s' to not be stored in clear but got %s", secret, stored_bytes)
+		}
+	}
+
+	ids, err := storage.List("")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !objectsDeepEqual(ids, []string{"patients/"}) {
+		t.Fatalf("expected to list the decrypted folder but got %v", ids)
+	}
+
+	storage.Keys["new"] = []byte("abcdef0123456789")
+	storage.CurrentKeyId = "new"
+	err = storage.Rotate()
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	stored_document, err = backend.Get(stored_ids[0])
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if stored_document["_kid"] != "new" {
+		t.Fatalf("expected the document to be encrypted with the new key but got %v", stored_document)
+	}
+
+	delete(storage.Keys, "old")
+	document, err := storage.Get("patients/john")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := c.NewDocument("patients/john", "diagnosis", "flu")
+	if !objectsDeepEqual(document, expected) {
+		t.Fatalf("expected 'patients/john' document to equal %v but got %v", expected, document)
+	}
+
+	storage.CurrentKeyId = "missing"
+	_, err = storage.Set(c.NewDocument("patients/jane"))
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected error '%s' but got '%v'", ErrUnknownKey, err)
 	}
 }
 
-func Test_CanCreateDocuments(t *testing.T) {
-	testEachStorage(t, func(t *testing.T, storage Storage) {
-		_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+func Test_FaultStorageInjectsFaults(t *testing.T) {
+	backend := &MemoryStorage{}
+	storage := &FaultStorage{
+		Backend: backend,
+		Rules: []FaultRule{
+			{Operations: []string{"get"}, IdPattern: "movies/*", Nth: 2},
+			{Operations: []string{"commit"}, IdPattern: "orders/*", Partial: true, Crash: true},
+		},
+	}
+
+	_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	_, err = storage.Get("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	_, err = storage.Get("movies/matrix")
+	if !errors.Is(err, ErrInjectedFault) {
+		t.Fatalf("expected error '%s' on the second get but got '%v'", ErrInjectedFault, err)
+	}
+	_, err = storage.Get("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	err = storage.Commit([]Operation{
+		{Type: OperationSet, Document: c.NewDocument("orders/1", "item", "movies/matrix")},
+		{Type: OperationSet, Document: c.NewDocument("orders/2", "item", "movies/matrix")},
+	})
+	if !errors.Is(err, ErrInjectedFault) {
+		t.Fatalf("expected error '%s' but got '%v'", ErrInjectedFault, err)
+	}
+	_, err = storage.Get("movies/matrix")
+	if !errors.Is(err, ErrCrashed) {
+		t.Fatalf("expected error '%s' after the crash but got '%v'", ErrCrashed, err)
+	}
+
+	storage.Recover()
+	ids, err := storage.List("orders")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !objectsDeepEqual(ids, []string{"1"}) {
+		t.Fatalf("expected only the first half of the commit to be written but got %v", ids)
+	}
+
+	storage.Rules = []FaultRule{{Operations: []string{"set"}, Partial: true}}
+	_, err = storage.Set(c.NewDocument("movies/alien", "name", "Alien", "year", 1979))
+	if !errors.Is(err, ErrInjectedFault) {
+		t.Fatalf("expected error '%s' but got '%v'", ErrInjectedFault, err)
+	}
+	document, err := backend.Get("movies/alien")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := c.NewDocument("movies/alien", "name", "Alien")
+	if !objectsDeepEqual(document, expected) {
+		t.Fatalf("expected the torn document to equal %v but got %v", expected, document)
+	}
+
+	storage.Rules = []FaultRule{{Probability: 0.5}}
+	storage.Rand = rand.New(rand.NewSource(1))
+	failures := 0
+	for i := 0; i < 1000; i++ {
+		_, err := storage.Exists("movies/matrix")
 		if err != nil {
-			t.Fatalf("unexpected error '%s'", err)
+			failures++
 		}
+	}
+	if failures < 400 || failures > 600 {
+		t.Fatalf("expected about half of the calls to fail but got %d", failures)
+	}
+}
+
+func Test_TieredStorageReadsDontWaitForCold(t *testing.T) {
+	slow_cold := func() Storage {
+		rule := FaultRule{Operations: []string{"commit"}, IdPattern: "movies/slow*", Latency: time.Second}
+		return &FaultStorage{Backend: &MemoryStorage{}, Rules: []FaultRule{rule}}
+	}
+	timed := func(f func() error) (time.Duration, error) {
+		start := time.Now()
+		err := f()
+		return time.Since(start), err
+	}
+
+	// a write through to Cold doesn't hold back the reads
+	storage := &TieredStorage{Hot: &MemoryStorage{}, Cold: slow_cold()}
+	_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := storage.Set(c.NewDocument("movies/slow", "name", "Slow"))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	elapsed, err := timed(func() error {
+		_, err := storage.Get("movies/matrix")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Fatalf("expected the read to not wait for the write but took %s", elapsed)
+	}
+	err = <-done
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
 
-		exists, err := storage.Exists("movies/matrix")
+	// nor does a flush, which keeps the flushed writes readable
+	storage = &TieredStorage{Hot: &MemoryStorage{}, Cold: slow_cold(), WriteBack: true, MaxHotDocuments: 1}
+	for _, name := range []string{"matrix", "slow"} {
+		_, err := storage.Set(c.NewDocument("movies/"+name, "name", name))
 		if err != nil {
 			t.Fatalf("unexpected error '%s'", err)
 		}
-		if exists != true {
-			t.Fatalf("expected 'movies/matrix' to exists but didn't")
+	}
+	go func() {
+		done <- storage.Flush()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	elapsed, err = timed(func() error {
+		document, err := storage.Get("movies/matrix")
+		if err == nil && document["name"] != "matrix" {
+			t.Errorf("expected the flushed document but got %v", document)
+		}
+		if err == nil {
+			_, err = storage.Set(c.NewDocument("movies/alien", "name", "alien"))
 		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Fatalf("expected the read and write to not wait for the flush but took %s", elapsed)
+	}
+	err = <-done
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
 
-		exists, err = storage.Exists("movies/nope")
-		if err != nil {
-			t.Fatalf("unexpected error '%s'", err)
+	err = storage.Flush()
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	ids, err := storage.Cold.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := []string{"alien", "matrix", "slow"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+}
+
+func Test_DecoratorsStopWhenTheContextIsDone(t *testing.T) {
+	slow := func() Storage {
+		return &FaultStorage{Backend: &MemoryStorage{}, Rules: []FaultRule{{IdPattern: "movies/*", Latency: time.Hour}}}
+	}
+	decorators := map[string]Storage{
+		"CachedStorage":  &CachedStorage{Backend: slow()},
+		"TieredStorage":  &TieredStorage{Hot: &MemoryStorage{}, Cold: slow()},
+		"ShardedStorage": &ShardedStorage{Shards: []Storage{slow()}},
+		"EncryptedStorage": &EncryptedStorage{
+			Backend:      slow(),
+			Keys:         map[string][]byte{"2024": []byte("0123456789abcdef0123456789abcdef")},
+			CurrentKeyId: "2024",
+		},
+		"FaultStorage": slow(),
+	}
+
+	for name, storage := range decorators {
+		context_storage, ok := storage.(ContextStorage)
+		if !ok {
+			t.Fatalf("expected %s to implement ContextStorage", name)
 		}
-		if exists != false {
-			t.Fatalf("expected 'movies/nope' to not exist but exists")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err := context_storage.GetContext(ctx, "movies/matrix")
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected %s to stop the get with error '%s' but got '%v'", name, context.DeadlineExceeded, err)
 		}
-	})
+
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err = context_storage.CommitContext(ctx, []Operation{{Type: OperationSet, Document: c.NewDocument("movies/matrix")}})
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected %s to stop the commit with error '%s' but got '%v'", name, context.DeadlineExceeded, err)
+		}
+	}
 }
 
-func Test_CanGetDocuments(t *testing.T) {
-	testEachStorage(t, func(t *testing.T, storage Storage) {
-		_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+func Test_FileStorageCheckRepairsCrashLeftovers(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"movies/matrix.json":          `{"id":"movies/matrix","name":"Matrix"}`,
+		"movies/alien.json":           `{"id":"movies/alie`,
+		"movies/alien.json.backup":    `{"id":"movies/alien","name":"Alien"}`,
+		"movies/superman.json.backup": `{"id":"movies/superman","name":"Superman"}`,
+		"movies/matrix.json.backup":   `{"id":"movies/matrix","name":"Old"}`,
+		"movies/.matrix.json.1.tmp":   `{"id":"movies/matr`,
+		"movies/robocop.json":         `not json`,
+		"users/john.json":             `{"id":"users/jane","name":"John"}`,
+		".journal":                    `[{"type":"set","id":"","document":{"id":"users/jane","name":"Jane"}}]`,
+	}
+	for path, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, path)), os.ModePerm)
+		err := os.WriteFile(filepath.Join(root, path), []byte(content), 0644)
 		if err != nil {
 			t.Fatalf("unexpected error '%s'", err)
 		}
+	}
+	os.MkdirAll(filepath.Join(root, "empty", "nested"), os.ModePerm)
 
-		document, err := storage.Get("movies/matrix")
+	storage := &FileStorage{Root: root}
+	problems, err := storage.Check(false)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	kinds := map[string]ProblemKind{}
+	for _, problem := range problems {
+		if problem.Repaired {
+			t.Fatalf("expected nothing to be repaired but got %+v", problem)
+		}
+		kinds[problem.Path] = problem.Kind
+	}
+	expected_kinds := map[string]ProblemKind{
+		"movies/alien.json":           ProblemCorrupted,
+		"movies/superman.json.backup": ProblemBackup,
+		"movies/matrix.json.backup":   ProblemBackup,
+		"movies/.matrix.json.1.tmp":   ProblemTempFile,
+		"movies/robocop.json":         ProblemCorrupted,
+		"users/john.json":             ProblemIdMismatch,
+		"empty":                       ProblemEmptyFolder,
+		"empty/nested":                ProblemEmptyFolder,
+		".journal":                    ProblemJournal,
+	}
+	if !objectsDeepEqual(kinds, expected_kinds) {
+		t.Fatalf("expected the problems %v but got %v", expected_kinds, kinds)
+	}
+
+	_, err = storage.Check(true)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	problems, err = storage.Check(false)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("expected no problems after repairing but got %+v", problems)
+	}
+
+	expected_documents := map[string]c.Document{
+		"movies/matrix":   c.NewDocument("movies/matrix", "name", "Matrix"),
+		"movies/alien":    c.NewDocument("movies/alien", "name", "Alien"),
+		"movies/superman": c.NewDocument("movies/superman", "name", "Superman"),
+		"users/john":      c.NewDocument("users/john", "name", "John"),
+		"users/jane":      c.NewDocument("users/jane", "name", "Jane"),
+	}
+	for id, expected := range expected_documents {
+		document, err := storage.Get(id)
 		if err != nil {
-			t.Fatalf("unexpected error '%s'", err)
+			t.Fatalf("unexpected error '%s' getting %s", err, id)
 		}
-		expected := c.NewDocument("movies/matrix", "name", "Matrix")
 		if !objectsDeepEqual(document, expected) {
-			t.Fatalf("expected 'movies/matrix' document to equal %v but got %v", expected, document)
+			t.Fatalf("expected '%s' document to equal %v but got %v", id, expected, document)
 		}
+	}
+	_, err = storage.Get("movies/robocop")
+	if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+		t.Fatalf("expected the corrupted document to be quarantined but got '%v'", err)
+	}
+	_, err = os.Stat(filepath.Join(root, ".quarantine", "movies", "robocop.json"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+}
 
-		_, err = storage.Get("movies/nope")
-		if !errors.Is(err, c.ErrDocumentDoestNotExist) {
-			t.Fatalf("unexpected error 'DocumentDoesNotExist' but got '%s'", err)
+func Test_FileStorageEscapesIds(t *testing.T) {
+	root := t.TempDir()
+	storage := &FileStorage{Root: filepath.Join(root, "data")}
+
+	long_segment := strings.Repeat("ñandú ", 100)
+	ids := []string{"movies/..", "movies/.hidden", "movies/100%", "movies/nul\x00", "movies/" + long_segment, "../outside", long_segment + "/matrix"}
+	for _, id := range ids {
+		_, err := storage.Set(c.NewDocument(id, "name", id))
+		if err != nil {
+			t.Fatalf("unexpected error '%s' setting %q", err, id)
+		}
+		document, err := storage.Get(id)
+		if err != nil {
+			t.Fatalf("unexpected error '%s' getting %q", err, id)
+		}
+		if document["name"] != id {
+			t.Fatalf("expected %q document but got %v", id, document)
+		}
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected every file to be inside the root but got %v", entries)
+	}
+	err = filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if len(entry.Name()) > 255 {
+			t.Fatalf("expected the file names to fit the filesystem but got %s", entry.Name())
 		}
+		return err
 	})
-}
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	simple_ids, err := storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	sort.Strings(simple_ids)
+	expected := []string{"..", ".hidden", "100%", long_segment, "nul\x00"}
+	sort.Strings(expected)
+	if !objectsDeepEqual(simple_ids, expected) {
+		t.Fatalf("expected to list %q but got %q", expected, simple_ids)
+	}
+	simple_ids, err = storage.List("")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	sort.Strings(simple_ids)
+	expected = []string{"../", long_segment + "/", "movies/"}
+	sort.Strings(expected)
+	if !objectsDeepEqual(simple_ids, expected) {
+		t.Fatalf("expected to list %q but got %q", expected, simple_ids)
+	}
 
-func Test_CanListDocuments(t *testing.T) {
-	testEachStorage(t, func(t *testing.T, storage Storage) {
-		_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	for _, id := range ids {
+		err := storage.Delete(id)
 		if err != nil {
-			t.Fatalf("unexpected error '%s'", err)
+			t.Fatalf("unexpected error '%s' deleting %q", err, id)
 		}
+	}
+	simple_ids, err = storage.List("")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(simple_ids) != 0 {
+		t.Fatalf("expected the root to be empty but got %q", simple_ids)
+	}
+
+	_, err = storage.Get(strings.Repeat("a/", c.MaxIdLength))
+	if !errors.Is(err, c.ErrInvalidId) {
+		t.Fatalf("expected error '%s' but got '%v'", c.ErrInvalidId, err)
+	}
+}
 
-		ids, err := storage.List("")
+func Test_FileStorageReadsAndRenamesLegacyNames(t *testing.T) {
+	root := t.TempDir()
+	// written before the ids were escaped
+	for path, id := range map[string]string{
+		"movies/100%.json":  "movies/100%",
+		"movies/a%20b.json": "movies/a%20b",
+		"movies/x%25y.json": "movies/x%25y",
+		"a%20b/matrix.json": "a%20b/matrix",
+	} {
+		err := os.MkdirAll(filepath.Join(root, filepath.Dir(path)), os.ModePerm)
 		if err != nil {
 			t.Fatalf("unexpected error '%s'", err)
 		}
-		if ids == nil {
-			t.Fatalf("expected list ids to be an array but got nil")
-		}
-		expected := []string{"movies/"}
-		if !objectsDeepEqual(ids, expected) {
-			t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
-		}
-
-		ids, err = storage.List("movies")
+		err = os.WriteFile(filepath.Join(root, path), []byte(`{"id":"`+id+`","name":"`+id+`"}`), 0644)
 		if err != nil {
 			t.Fatalf("unexpected error '%s'", err)
 		}
-		expected = []string{"matrix"}
-		if !objectsDeepEqual(ids, expected) {
-			t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+	storage := &FileStorage{Root: root}
+
+	// "x%25y" is a valid escape, so it's listed as "x%y" until renamed
+	expectLegacyIds := func(movies ...string) {
+		for folder, expected := range map[string][]string{
+			"":       {"a%20b/", "movies/"},
+			"movies": movies,
+			"a%20b":  {"matrix"},
+		} {
+			simple_ids, err := storage.List(folder)
+			if err != nil {
+				t.Fatalf("unexpected error '%s'", err)
+			}
+			if !objectsDeepEqual(simple_ids, expected) {
+				t.Fatalf("expected to list %q in '%s' but got %q", expected, folder, simple_ids)
+			}
+			for _, simple_id := range expected {
+				if strings.HasSuffix(simple_id, "/") || simple_id == "x%y" {
+					continue
+				}
+				id := c.J(folder, simple_id)
+				document, err := storage.Get(id)
+				if err != nil {
+					t.Fatalf("unexpected error '%s' getting %q", err, id)
+				}
+				if document["name"] != id {
+					t.Fatalf("expected %q document but got %v", id, document)
+				}
+			}
 		}
-	})
+	}
+	expectLegacyIds("100%", "a%20b", "x%y")
+	document, err := storage.Get("movies/x%25y")
+	if err != nil || document["name"] != "movies/x%25y" {
+		t.Fatalf("expected the legacy document to be found but got %v and '%v'", document, err)
+	}
+
+	_, err = storage.Patch(c.NewDocument("movies/100%", "year", 1999))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	_, err = os.Stat(filepath.Join(root, "movies", "100%.json"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected the legacy file to be replaced by the escaped one but got '%v'", err)
+	}
+	expectLegacyIds("100%", "a%20b", "x%y")
+
+	problems, err := storage.Check(false)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	ids := []string{}
+	for _, problem := range problems {
+		if problem.Kind != ProblemLegacyName {
+			t.Fatalf("expected only legacy names but got %+v", problem)
+		}
+		ids = append(ids, problem.Id)
+	}
+	sort.Strings(ids)
+	if !objectsDeepEqual(ids, []string{"a%20b/matrix", "movies/a%20b", "movies/x%25y"}) {
+		t.Fatalf("expected the legacy names to be found but got %+v", problems)
+	}
+
+	_, err = storage.Check(true)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	_, err = os.Stat(filepath.Join(root, "movies", "a%2520b.json"))
+	if err != nil {
+		t.Fatalf("expected the legacy file to be renamed but got '%s'", err)
+	}
+	expectLegacyIds("100%", "a%20b", "x%25y")
+	problems, err = storage.Check(false)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("expected no problems after repairing but got %+v", problems)
+	}
 }
 
-func Test_CanPatchDocuments(t *testing.T) {
-	testEachStorage(t, func(t *testing.T, storage Storage) {
-		_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix", "desc", "wrong"))
+func Test_FileStorageIteratesPagesFromTheDirectory(t *testing.T) {
+	for _, fan_out := range []int{0, 1} {
+		storage := &FileStorage{Root: t.TempDir(), FanOut: fan_out}
+		for i := 0; i < 600; i++ {
+			_, err := storage.Set(c.NewDocument(c.S("movies/%03d", i)))
+			if err != nil {
+				t.Fatalf("unexpected error '%s'", err)
+			}
+		}
+		_, err := storage.Set(c.NewDocument("movies/300/sequel"))
 		if err != nil {
 			t.Fatalf("unexpected error '%s'", err)
 		}
 
-		// First check if the file matches what we wrote
-		document, err := storage.Get("movies/matrix")
+		// only the page is kept from the folder
+		simple_ids, err := storage.listAfter("movies", "297", 4)
 		if err != nil {
 			t.Fatalf("unexpected error '%s'", err)
 		}
-		expected := c.NewDocument("movies/matrix", "name", "Matrix", "desc", "wrong")
-		if !objectsDeepEqual(document, expected) {
-			t.Fatalf("expected 'movies/matrix' document to equal %v but got %v", expected, document)
+		expected := []string{"298", "299", "300", "300/"}
+		if !reflect.DeepEqual(simple_ids, expected) {
+			t.Fatalf("expected the page %v but got %v", expected, simple_ids)
 		}
-
-		// Patch the description and add a year
-		_, err = storage.Patch(c.NewDocument("movies/matrix", "desc", "It's about a guy...", "year", 1999))
+		// and the folder holding the cursor is kept
+		simple_ids, err = storage.listAfter("movies", "300/a", 2)
 		if err != nil {
 			t.Fatalf("unexpected error '%s'", err)
 		}
+		expected = []string{"300/", "301"}
+		if !reflect.DeepEqual(simple_ids, expected) {
+			t.Fatalf("expected the page %v but got %v", expected, simple_ids)
+		}
 
-		// First check if the file matches what we wrote
-		document, err = storage.Get("movies/matrix")
-		if err != nil {
-			t.Fatalf("unexpected error '%s'", err)
+		iterator := storage.Iterate("movies", IterateOptions{StartAfter: "300/sequel", Limit: 3, Recursive: true})
+		ids := []string{}
+		for iterator.Next() {
+			ids = append(ids, iterator.Id())
 		}
-		expected = c.NewDocument("movies/matrix", "name", "Matrix", "desc", "It's about a guy...", "year", 1999)
-		if !objectsDeepEqual(document, expected) {
-			t.Fatalf("expected 'movies/matrix' document to equal %v but got %v", expected, document)
+		if iterator.Err() != nil {
+			t.Fatalf("unexpected error '%s'", iterator.Err())
 		}
-	})
+		expected = []string{"301", "302", "303"}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Fatalf("expected the page %v but got %v", expected, ids)
+		}
+	}
 }
 
-func Test_CanDeleteDocuments(t *testing.T) {
-	testEachStorage(t, func(t *testing.T, storage Storage) {
-		_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+func Test_FileStorageFansOutFolders(t *testing.T) {
+	root := t.TempDir()
+	storage := &FileStorage{Root: root, FanOut: 1}
+
+	expected := []string{"@ab", "archive/"}
+	for i := 0; i < 100; i++ {
+		expected = append(expected, c.S("%03d", i))
+	}
+	sort.Strings(expected)
+	for _, simple_id := range expected {
+		id := "events/" + strings.TrimSuffix(simple_id, "/")
+		if strings.HasSuffix(simple_id, "/") {
+			id += "/old"
+		}
+		_, err := storage.Set(c.NewDocument(id, "name", simple_id))
 		if err != nil {
 			t.Fatalf("unexpected error '%s'", err)
 		}
-		_, err = storage.Set(c.NewDocument("movies/pride_and_prejudice", "name", "Pride and prejudice"))
+	}
+
+	entries, err := os.ReadDir(filepath.Join(root, storage.buckets("events")[0], "events"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(entries) < 10 {
+		t.Fatalf("expected the documents to be spread in buckets but got %d of them", len(entries))
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "@") {
+			t.Fatalf("expected only buckets but got %s", entry.Name())
+		}
+	}
+
+	simple_ids, err := storage.List("events")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !objectsDeepEqual(simple_ids, expected) {
+		t.Fatalf("expected to list %v but got %v", expected, simple_ids)
+	}
+	document, err := storage.Get("events/@ab")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if document["name"] != "@ab" {
+		t.Fatalf("expected 'events/@ab' document but got %v", document)
+	}
+
+	// the root keeps its fan out
+	_, err = (&FileStorage{Root: root, FanOut: 2}).Get("events/@ab")
+	if !errors.Is(err, ErrFanOutMismatch) {
+		t.Fatalf("expected error '%s' but got '%v'", ErrFanOutMismatch, err)
+	}
+	reopened_storage := &FileStorage{Root: root}
+	simple_ids, err = reopened_storage.List("events")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !objectsDeepEqual(simple_ids, expected) {
+		t.Fatalf("expected to list %v without FanOut but got %v", expected, simple_ids)
+	}
+	problems, err := reopened_storage.Check(false)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("expected no problems checking without FanOut but got %+v", problems)
+	}
+	unbucketed_root := t.TempDir()
+	_, err = (&FileStorage{Root: unbucketed_root}).Set(c.NewDocument("events/1"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	_, err = (&FileStorage{Root: unbucketed_root, FanOut: 1}).Get("events/1")
+	if !errors.Is(err, ErrFanOutMismatch) {
+		t.Fatalf("expected error '%s' on a root written without FanOut but got '%v'", ErrFanOutMismatch, err)
+	}
+
+	err = storage.DeleteFolder("events/archive")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	for _, simple_id := range expected {
+		if strings.HasSuffix(simple_id, "/") {
+			continue
+		}
+		err := storage.Delete("events/" + simple_id)
 		if err != nil {
 			t.Fatalf("unexpected error '%s'", err)
 		}
+	}
+	entries, err = os.ReadDir(root)
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != fanOutName {
+		t.Fatalf("expected the empty buckets to be removed but got %v", entries)
+	}
+}
+
+func Test_StoragesKeepAttachments(t *testing.T) {
+	dir := t.TempDir()
+	storages := map[string]func() Storage{
+		"FileStorage":                func() Storage { return &FileStorage{Root: filepath.Join(dir, "file")} },
+		"FileStorage (fan-out)":      func() Storage { return &FileStorage{Root: filepath.Join(dir, "fanout"), FanOut: 1} },
+		"MemoryStorage":              func() Storage { return &MemoryStorage{} },
+		"MemoryStorage (persistent)": func() Storage { return &MemoryStorage{Dir: filepath.Join(dir, "memory")} },
+	}
 
-		// List movies
-		ids, err := storage.List("movies")
+	for storageName, newStorage := range storages {
+		storage := newStorage()
+		poster := bytes.Repeat([]byte("poster"), 100000)
+
+		err := PutAttachment(storage, "movies/matrix", "poster.png", bytes.NewReader(poster))
+		if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+			t.Fatalf("%s: expected error '%s' but got '%v'", storageName, c.ErrDocumentDoestNotExist, err)
+		}
+		_, err = storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
 		if err != nil {
-			t.Fatalf("unexpected error '%s'", err)
+			t.Fatalf("%s: unexpected error '%s'", storageName, err)
 		}
-		expected := []string{"matrix", "pride_and_prejudice"}
-		if !objectsDeepEqual(ids, expected) {
-			t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+		err = PutAttachment(storage, "movies/matrix", "../poster", bytes.NewReader(poster))
+		if !errors.Is(err, c.ErrInvalidId) {
+			t.Fatalf("%s: expected error '%s' but got '%v'", storageName, c.ErrInvalidId, err)
 		}
-
-		// Delete matrix movie
-		err = storage.Delete("movies/matrix")
+		for _, name := range []string{"poster.png", "script 100%.pdf", strings.Repeat("x", 300)} {
+			err = PutAttachment(storage, "movies/matrix", name, bytes.NewReader(poster))
+			if err != nil {
+				t.Fatalf("%s: unexpected error '%s'", storageName, err)
+			}
+		}
+		err = PutAttachment(storage, "movies/matrix", "script 100%.pdf", strings.NewReader("%PDF"))
 		if err != nil {
-			t.Fatalf("unexpected error '%s'", err)
+			t.Fatalf("%s: unexpected error '%s'", storageName, err)
 		}
 
-		// List movies to see if has been removed
-		ids, err = storage.List("movies")
+		// staged content isn't seen until committed
+		staged, err := StageAttachment(storage, "movies/matrix", "trailer.mp4", strings.NewReader("mp4"))
 		if err != nil {
-			t.Fatalf("unexpected error '%s'", err)
+			t.Fatalf("%s: unexpected error '%s'", storageName, err)
 		}
-		expected = []string{"pride_and_prejudice"}
-		if !objectsDeepEqual(ids, expected) {
-			t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+		_, err = GetAttachment(storage, "movies/matrix", "trailer.mp4")
+		if !errors.Is(err, c.ErrAttachmentDoesNotExist) {
+			t.Fatalf("%s: expected error '%s' before the commit but got '%v'", storageName, c.ErrAttachmentDoesNotExist, err)
+		}
+		err = DiscardAttachment(storage, "movies/matrix", staged)
+		if err != nil {
+			t.Fatalf("%s: unexpected error '%s'", storageName, err)
+		}
+		err = CommitAttachment(storage, "movies/matrix", "trailer.mp4", staged)
+		if !errors.Is(err, ErrAttachmentNotStaged) {
+			t.Fatalf("%s: expected error '%s' after discarding but got '%v'", storageName, ErrAttachmentNotStaged, err)
+		}
+
+		if storageName == "MemoryStorage (persistent)" {
+			storage.(*MemoryStorage).Close()
+			storage = newStorage()
 		}
-	})
-}
 
-func Test_DeleteRemovesEmptyFolders(t *testing.T) {
-	testEachStorage(t, func(t *testing.T, storage Storage) {
-		_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+		names, err := ListAttachments(storage, "movies/matrix")
 		if err != nil {
-			t.Fatalf("unexpected error '%s'", err)
+			t.Fatalf("%s: unexpected error '%s'", storageName, err)
+		}
+		expected_names := []string{"poster.png", "script 100%.pdf", strings.Repeat("x", 300)}
+		if !reflect.DeepEqual(names, expected_names) {
+			t.Fatalf("%s: expected the attachments %v but got %v", storageName, expected_names, names)
+		}
+		simple_ids, err := storage.List("movies")
+		if err != nil {
+			t.Fatalf("%s: unexpected error '%s'", storageName, err)
+		}
+		if !reflect.DeepEqual(simple_ids, []string{"matrix"}) {
+			t.Fatalf("%s: expected only the document to be listed but got %v", storageName, simple_ids)
 		}
 
-		// List root
-		ids, err := storage.List("")
+		content, err := GetAttachment(storage, "movies/matrix", "poster.png")
 		if err != nil {
-			t.Fatalf("unexpected error '%s'", err)
+			t.Fatalf("%s: unexpected error '%s'", storageName, err)
+		}
+		_, err = content.Seek(6, io.SeekStart)
+		if err != nil {
+			t.Fatalf("%s: unexpected error '%s'", storageName, err)
+		}
+		content_bytes, err := io.ReadAll(content)
+		content.Close()
+		if err != nil {
+			t.Fatalf("%s: unexpected error '%s'", storageName, err)
 		}
-		expected := []string{"movies/"}
-		if !objectsDeepEqual(ids, expected) {
-			t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+		if !bytes.Equal(content_bytes, poster[6:]) {
+			t.Fatalf("%s: expected the poster from its 6th byte but got %d bytes", storageName, len(content_bytes))
 		}
 
-		// List movies
-		ids, err = storage.List("movies")
+		err = DeleteAttachment(storage, "movies/matrix", "poster.png")
 		if err != nil {
-			t.Fatalf("unexpected error '%s'", err)
+			t.Fatalf("%s: unexpected error '%s'", storageName, err)
 		}
-		expected = []string{"matrix"}
-		if !objectsDeepEqual(ids, expected) {
-			t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+		_, err = GetAttachment(storage, "movies/matrix", "poster.png")
+		if !errors.Is(err, c.ErrAttachmentDoesNotExist) {
+			t.Fatalf("%s: expected error '%s' but got '%v'", storageName, c.ErrAttachmentDoesNotExist, err)
 		}
 
-		// Delete matrix movie
+		// deleting the document deletes its attachments
 		err = storage.Delete("movies/matrix")
 		if err != nil {
-			t.Fatalf("unexpected error '%s'", err)
+			t.Fatalf("%s: unexpected error '%s'", storageName, err)
 		}
-
-		// List movies to see if has been removed
-		ids, err = storage.List("movies")
+		_, err = storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
 		if err != nil {
-			t.Fatalf("unexpected error '%s'", err)
+			t.Fatalf("%s: unexpected error '%s'", storageName, err)
+		}
+		names, err = ListAttachments(storage, "movies/matrix")
+		if err != nil {
+			t.Fatalf("%s: unexpected error '%s'", storageName, err)
 		}
-		expected = []string{}
-		if !objectsDeepEqual(ids, expected) {
-			t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+		if len(names) != 0 {
+			t.Fatalf("%s: expected the attachments to be deleted with the document but got %v", storageName, names)
 		}
+	}
+
+	_, err := GetAttachment(&LogStorage{Root: filepath.Join(dir, "log")}, "movies/matrix", "poster.png")
+	if !errors.Is(err, ErrAttachmentsNotSupported) {
+		t.Fatalf("expected error '%s' but got '%v'", ErrAttachmentsNotSupported, err)
+	}
+}
+
+func Test_OpenBuildsStoragesFromURIs(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := Open("file://" + dir + "?codec=msgpack&compression=zstd&fanout=1&cache=10")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	cached_storage, ok := storage.(*CachedStorage)
+	if !ok || cached_storage.MaxEntries != 10 {
+		t.Fatalf("expected a CachedStorage of 10 entries but got %#v", storage)
+	}
+	file_storage, ok := cached_storage.Backend.(*FileStorage)
+	if !ok || file_storage.Root != dir || file_storage.Codec != MsgpackCodec || file_storage.Compression != CompressionZstd || file_storage.FanOut != 1 {
+		t.Fatalf("expected a zstd msgpack fanned out FileStorage at %s but got %#v", dir, cached_storage.Backend)
+	}
 
-		// List root
-		ids, err = storage.List("")
+	for _, uri := range []string{"mem://", "file:relative", "log://" + dir + "/log", "btree://" + dir + "/godb.db", "sqlite://" + dir + "/sqlite.db?table=documents"} {
+		storage, err := Open(uri)
 		if err != nil {
-			t.Fatalf("unexpected error '%s'", err)
+			t.Fatalf("unexpected error '%s' opening %s", err, uri)
+		}
+		if uri == "file:relative" {
+			continue
 		}
-		expected = []string{}
-		if !objectsDeepEqual(ids, expected) {
-			t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+		_, err = storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+		if err != nil {
+			t.Fatalf("unexpected error '%s' on %s", err, uri)
+		}
+	}
+
+	s3_server := newFakeS3Server(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	storage, err = Open("s3://godb/data?endpoint=" + url.QueryEscape(s3_server.URL))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	s3_storage := storage.(*S3Storage)
+	if s3_storage.Bucket != "godb" || s3_storage.Prefix != "data/" || s3_storage.AccessKey != "key" {
+		t.Fatalf("expected the bucket, prefix and credentials to be set but got %#v", s3_storage)
+	}
+	_, err = storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	for _, uri := range []string{"nope://x", "file://" + dir + "?colour=red", "file://", "mem://?cache=none", "file:x?codec=xml",
+		"file:x?durability=always", "mem://?durability=sometimes", "log:x?durability=never", "btree:x?durability=fast",
+		"file:x?compression=lz4", "sqlite:x.db?table=my-docs"} {
+		_, err := Open(uri)
+		if !errors.Is(err, ErrInvalidURI) {
+			t.Fatalf("expected error '%s' opening %s but got '%v'", ErrInvalidURI, uri, err)
 		}
+	}
+
+	Register("test", func(uri *url.URL) (Storage, error) {
+		return &MemoryStorage{}, nil
 	})
+	storage, err = Open("test://")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if _, ok := storage.(*MemoryStorage); !ok {
+		t.Fatalf("expected the registered storage but got %#v", storage)
+	}
+}
+
+func BenchmarkFileStorageDurability(b *testing.B) {
+	for _, durability := range []Durability{DurabilityNone, DurabilityPerWrite, DurabilityGroupCommit} {
+		b.Run(string(durability), func(b *testing.B) {
+			storage := &FileStorage{Root: b.TempDir(), Durability: durability}
+			var counter int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddInt64(&counter, 1)
+					storage.Set(c.NewDocument(c.S("movies/%d", i), "name", "Matrix"))
+				}
+			})
+		})
+	}
 }
 
 func BenchmarkStorages(b *testing.B) {
-	for storageName, storage := range getStorages(b.TempDir()) {
+	for storageName, newStorage := range storageFactories {
 		b.Run(storageName, func(b *testing.B) {
+			storage := newStorage(b)
 			for i := 0; i < b.N; i++ {
 				storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
 				storage.List("movies")
@@ -0,0 +1,544 @@
+// Package storagetest checks that a storage.Storage behaves like the ones of
+// godb, so any backend can prove it can be used in their place:
+//
+//	func Test_MyStorage(t *testing.T) {
+//		storagetest.Run(t, func(tb testing.TB) storage.Storage {
+//			return &MyStorage{Dir: tb.TempDir()}
+//		})
+//	}
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	c "godb/common"
+	s "godb/storage"
+)
+
+// Run runs every check of the suite as a subtest, each one with a new empty
+// storage made by newStorage.
+func Run(t *testing.T, newStorage func(tb testing.TB) s.Storage) {
+	tests := []struct {
+		name string
+		test func(*testing.T, s.Storage)
+	}{
+		{"CanCreateDocuments", testCanCreateDocuments},
+		{"CanGetDocuments", testCanGetDocuments},
+		{"CanListDocuments", testCanListDocuments},
+		{"CanIterateDocuments", testCanIterateDocuments},
+		{"StopsWhenContextIsDone", testStopsWhenContextIsDone},
+		{"CanPatchDocuments", testCanPatchDocuments},
+		{"CanDeleteDocuments", testCanDeleteDocuments},
+		{"DeleteRemovesEmptyFolders", testDeleteRemovesEmptyFolders},
+		{"CanDeleteFolders", testCanDeleteFolders},
+		{"CanCommitOperations", testCanCommitOperations},
+		{"OverlayDoesNotTouchBase", testOverlayDoesNotTouchBase},
+		{"RejectsInvalidDocuments", testRejectsInvalidDocuments},
+		{"HandlesConcurrentWrites", testHandlesConcurrentWrites},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, newStorage(t))
+		})
+	}
+}
+
+func testCanCreateDocuments(t *testing.T, storage s.Storage) {
+	_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	exists, err := storage.Exists("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if exists != true {
+		t.Fatalf("expected 'movies/matrix' to exists but didn't")
+	}
+
+	exists, err = storage.Exists("movies/nope")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if exists != false {
+		t.Fatalf("expected 'movies/nope' to not exist but exists")
+	}
+}
+
+func testCanGetDocuments(t *testing.T, storage s.Storage) {
+	_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	document, err := storage.Get("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := c.NewDocument("movies/matrix", "name", "Matrix")
+	if !objectsDeepEqual(document, expected) {
+		t.Fatalf("expected 'movies/matrix' document to equal %v but got %v", expected, document)
+	}
+
+	_, err = storage.Get("movies/nope")
+	if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+		t.Fatalf("unexpected error 'DocumentDoesNotExist' but got '%s'", err)
+	}
+}
+
+func testCanListDocuments(t *testing.T, storage s.Storage) {
+	_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	ids, err := storage.List("")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if ids == nil {
+		t.Fatalf("expected list ids to be an array but got nil")
+	}
+	expected := []string{"movies/"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+
+	ids, err = storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected = []string{"matrix"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+}
+
+func testCanIterateDocuments(t *testing.T, storage s.Storage) {
+	for _, id := range []string{"movies/alien", "movies/a-team", "movies/a/x", "movies/2024/dune", "movies/2024/civil-war", "series/lost"} {
+		_, err := storage.Set(c.NewDocument(id, "name", id))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+
+	collect := func(options s.IterateOptions) ([]string, []c.Document) {
+		iterator := s.Iterate(storage, "movies", options)
+		defer iterator.Close()
+
+		ids := []string{}
+		documents := []c.Document{}
+		for iterator.Next() {
+			ids = append(ids, iterator.Id())
+			if iterator.Document() != nil {
+				documents = append(documents, iterator.Document())
+			}
+		}
+		if iterator.Err() != nil {
+			t.Fatalf("unexpected error '%s'", iterator.Err())
+		}
+		return ids, documents
+	}
+
+	ids, _ := collect(s.IterateOptions{})
+	expected := []string{"2024/", "a-team", "a/", "alien"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected ids to be %v but got %v", expected, ids)
+	}
+
+	ids, documents := collect(s.IterateOptions{Recursive: true, IncludeDocuments: true})
+	expected = []string{"2024/civil-war", "2024/dune", "a-team", "a/x", "alien"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected ids to be %v but got %v", expected, ids)
+	}
+	if len(documents) != 5 || documents[1]["name"] != "movies/2024/dune" {
+		t.Fatalf("expected the documents along with the ids but got %v", documents)
+	}
+
+	paged_ids := []string{}
+	after := ""
+	for {
+		ids, _ := collect(s.IterateOptions{Recursive: true, StartAfter: after, Limit: 2})
+		if len(ids) == 0 {
+			break
+		}
+		paged_ids = append(paged_ids, ids...)
+		after = ids[len(ids)-1]
+	}
+	if !objectsDeepEqual(paged_ids, expected) {
+		t.Fatalf("expected the pages to have ids %v but got %v", expected, paged_ids)
+	}
+
+	ids, _ = collect(s.IterateOptions{StartAfter: "2024/"})
+	expected = []string{"a-team", "a/", "alien"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected ids to be %v but got %v", expected, ids)
+	}
+}
+
+func testStopsWhenContextIsDone(t *testing.T, storage s.Storage) {
+	_, err := storage.Set(c.NewDocument("movies/matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = s.GetContext(ctx, storage, "movies/matrix")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected error '%s' but got '%v'", context.Canceled, err)
+	}
+	err = s.CommitContext(ctx, storage, []s.Operation{{Type: s.OperationDelete, Id: "movies/matrix"}})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected error '%s' but got '%v'", context.Canceled, err)
+	}
+
+	exists, err := s.ExistsContext(context.Background(), storage, "movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !exists {
+		t.Fatalf("expected 'movies/matrix' to not be deleted by the cancelled commit")
+	}
+}
+
+func testCanPatchDocuments(t *testing.T, storage s.Storage) {
+	_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix", "desc", "wrong"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	// First check if the file matches what we wrote
+	document, err := storage.Get("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := c.NewDocument("movies/matrix", "name", "Matrix", "desc", "wrong")
+	if !objectsDeepEqual(document, expected) {
+		t.Fatalf("expected 'movies/matrix' document to equal %v but got %v", expected, document)
+	}
+
+	// Patch the description and add a year
+	_, err = storage.Patch(c.NewDocument("movies/matrix", "desc", "It's about a guy...", "year", 1999))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	// First check if the file matches what we wrote
+	document, err = storage.Get("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected = c.NewDocument("movies/matrix", "name", "Matrix", "desc", "It's about a guy...", "year", 1999)
+	if !objectsDeepEqual(document, expected) {
+		t.Fatalf("expected 'movies/matrix' document to equal %v but got %v", expected, document)
+	}
+}
+
+func testCanDeleteDocuments(t *testing.T, storage s.Storage) {
+	_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	_, err = storage.Set(c.NewDocument("movies/pride_and_prejudice", "name", "Pride and prejudice"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	// List movies
+	ids, err := storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := []string{"matrix", "pride_and_prejudice"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+
+	// Delete matrix movie
+	err = storage.Delete("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	// List movies to see if has been removed
+	ids, err = storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected = []string{"pride_and_prejudice"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+}
+
+func testDeleteRemovesEmptyFolders(t *testing.T, storage s.Storage) {
+	_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	// List root
+	ids, err := storage.List("")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := []string{"movies/"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+
+	// List movies
+	ids, err = storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected = []string{"matrix"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+
+	// Delete matrix movie
+	err = storage.Delete("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	// List movies to see if has been removed
+	ids, err = storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected = []string{}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+
+	// List root
+	ids, err = storage.List("")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected = []string{}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+}
+
+func testCanCommitOperations(t *testing.T, storage s.Storage) {
+	_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	_, err = storage.Set(c.NewDocument("series/lost", "name", "Lost"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	err = storage.Commit([]s.Operation{
+		{Type: s.OperationDelete, Id: "movies/matrix"},
+		{Type: s.OperationSet, Id: "movies/alien", Document: c.NewDocument("movies/alien", "name", "Alien")},
+		{Type: s.OperationDeleteFolder, Id: "series"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	ids, err := storage.List("")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := []string{"movies/"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+
+	ids, err = storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected = []string{"alien"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+}
+
+func testOverlayDoesNotTouchBase(t *testing.T, storage s.Storage) {
+	_, err := storage.Set(c.NewDocument("movies/matrix", "name", "Matrix"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	overlay := s.NewOverlayStorage(storage)
+	_, err = overlay.Set(c.NewDocument("movies/alien", "name", "Alien"))
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	err = overlay.Delete("movies/matrix")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	ids, err := overlay.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := []string{"alien"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected overlay list ids to equal %v but got %v", expected, ids)
+	}
+
+	ids, err = storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected = []string{"matrix"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected base list ids to equal %v but got %v", expected, ids)
+	}
+
+	err = storage.Commit(overlay.Operations())
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	ids, err = storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected = []string{"alien"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected base list ids to equal %v but got %v", expected, ids)
+	}
+}
+
+func testCanDeleteFolders(t *testing.T, storage s.Storage) {
+	for _, id := range []string{"movies/matrix", "movies/2024/dune", "movies2/alien", "series/lost"} {
+		_, err := storage.Set(c.NewDocument(id, "name", id))
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+
+	err := storage.DeleteFolder("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	ids, err := storage.List("")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	expected := []string{"movies2/", "series/"}
+	if !objectsDeepEqual(ids, expected) {
+		t.Fatalf("expected list ids to equal %v but got %v", expected, ids)
+	}
+	_, err = storage.Get("movies/2024/dune")
+	if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+		t.Fatalf("expected error '%s' but got '%v'", c.ErrDocumentDoestNotExist, err)
+	}
+	exists, err := storage.Exists("movies2/alien")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !exists {
+		t.Fatalf("expected 'movies2/alien' to not be deleted with 'movies'")
+	}
+
+	err = storage.DeleteFolder("nope")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+
+	err = storage.DeleteFolder("")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	ids, err = storage.List("")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !objectsDeepEqual(ids, []string{}) {
+		t.Fatalf("expected the root to be empty but got %v", ids)
+	}
+}
+
+func testRejectsInvalidDocuments(t *testing.T, storage s.Storage) {
+	_, err := storage.Set(c.Document{"name": "Matrix"})
+	if !errors.Is(err, c.ErrInvalidId) {
+		t.Fatalf("expected error '%s' but got '%v'", c.ErrInvalidId, err)
+	}
+
+	_, err = storage.Set(nil)
+	if !errors.Is(err, c.ErrEmptyDocument) {
+		t.Fatalf("expected error '%s' but got '%v'", c.ErrEmptyDocument, err)
+	}
+
+	err = storage.Delete("movies/nope")
+	if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+		t.Fatalf("expected error '%s' but got '%v'", c.ErrDocumentDoestNotExist, err)
+	}
+
+	ids, err := storage.List("")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if !objectsDeepEqual(ids, []string{}) {
+		t.Fatalf("expected the invalid documents to not be stored but got %v", ids)
+	}
+}
+
+func testHandlesConcurrentWrites(t *testing.T, storage s.Storage) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 60)
+	for i := 0; i < 20; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			_, err := storage.Set(c.NewDocument(c.S("movies/%02d", i), "number", i))
+			errs <- err
+		}(i)
+		go func() {
+			defer wg.Done()
+			_, err := storage.List("movies")
+			errs <- err
+		}()
+		go func(i int) {
+			defer wg.Done()
+			_, err := storage.Get(c.S("movies/%02d", i))
+			if errors.Is(err, c.ErrDocumentDoestNotExist) {
+				err = nil
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error '%s'", err)
+		}
+	}
+
+	ids, err := storage.List("movies")
+	if err != nil {
+		t.Fatalf("unexpected error '%s'", err)
+	}
+	if len(ids) != 20 {
+		t.Fatalf("expected 20 documents but got %v", ids)
+	}
+}
+
+func objectsDeepEqual(x any, y any) bool {
+	xx := c.DeepClone(x)
+	yy := c.DeepClone(y)
+
+	return reflect.DeepEqual(xx, yy)
+}
@@ -0,0 +1,411 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	c "godb/common"
+)
+
+// TieredStorage keeps the recently used documents in the Hot storage and all
+// of them in the Cold one. Hot should be fast and start empty, like a
+// MemoryStorage, as it only holds the MaxHotDocuments most recently used
+// documents.
+//
+// With WriteBack the writes only reach Hot and are buffered until Flush, which
+// runs every FlushInterval when set. Otherwise they're written to Cold before
+// returning. In both modes List and Exists see the buffered writes.
+//
+// Reads found in Hot don't wait for the writes to Cold, nor does any read
+// wait for a Flush.
+type TieredStorage struct {
+	Storage
+	Hot             Storage
+	Cold            Storage
+	WriteBack       bool
+	FlushInterval   time.Duration
+	MaxHotDocuments int
+
+	// writeMutex serializes the writes, flushMutex the flushes
+	writeMutex sync.Mutex
+	flushMutex sync.Mutex
+	// mutex guards pending, written while locked and read while read locked
+	mutex sync.RWMutex
+	// lruMutex guards lru, hotIds and generation
+	lruMutex   sync.Mutex
+	startOnce  sync.Once
+	lru        *list.List
+	hotIds     map[string]*list.Element
+	generation uint64
+	pending    *OverlayStorage
+	stop       chan struct{}
+	stopped    sync.WaitGroup
+}
+
+func (ts *TieredStorage) Get(id string) (c.Document, error) {
+	return ts.GetContext(context.Background(), id)
+}
+
+func (ts *TieredStorage) GetContext(ctx context.Context, id string) (c.Document, error) {
+	ts.start()
+
+	return ts.get(ctx, id)
+}
+
+func (ts *TieredStorage) Set(document c.Document) (c.Document, error) {
+	return ts.SetContext(context.Background(), document)
+}
+
+func (ts *TieredStorage) SetContext(ctx context.Context, document c.Document) (c.Document, error) {
+	err := ts.CommitContext(ctx, []Operation{{Type: OperationSet, Document: document}})
+	if err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+func (ts *TieredStorage) Patch(document c.Document) (c.Document, error) {
+	return ts.PatchContext(context.Background(), document)
+}
+
+func (ts *TieredStorage) PatchContext(ctx context.Context, document c.Document) (c.Document, error) {
+	ts.start()
+	ts.writeMutex.Lock()
+	defer ts.writeMutex.Unlock()
+
+	document_id, err := document.GetId()
+	if err != nil {
+		return nil, err
+	}
+
+	patched_document := c.NewDocument(document_id)
+	existing_document, err := ts.get(ctx, document_id)
+	if err != nil {
+		if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+			return nil, err
+		}
+	} else {
+		patched_document.Patch(existing_document)
+	}
+	patched_document.Patch(document)
+
+	err = ts.commit(ctx, []Operation{{Type: OperationSet, Document: patched_document}})
+	if err != nil {
+		return nil, err
+	}
+
+	return patched_document, nil
+}
+
+func (ts *TieredStorage) Exists(id string) (bool, error) {
+	return ts.ExistsContext(context.Background(), id)
+}
+
+func (ts *TieredStorage) ExistsContext(ctx context.Context, id string) (bool, error) {
+	ts.start()
+	ts.lruMutex.Lock()
+	_, found := ts.hotIds[id]
+	ts.lruMutex.Unlock()
+	if found {
+		return true, nil
+	}
+
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	return ExistsContext(ctx, ts.coldView(ctx), id)
+}
+
+func (ts *TieredStorage) List(folder string) ([]string, error) {
+	return ts.ListContext(context.Background(), folder)
+}
+
+func (ts *TieredStorage) ListContext(ctx context.Context, folder string) ([]string, error) {
+	ts.start()
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	return ListContext(ctx, ts.coldView(ctx), folder)
+}
+
+func (ts *TieredStorage) Delete(id string) error {
+	return ts.DeleteContext(context.Background(), id)
+}
+
+func (ts *TieredStorage) DeleteContext(ctx context.Context, id string) error {
+	ts.start()
+	ts.writeMutex.Lock()
+	defer ts.writeMutex.Unlock()
+
+	ts.mutex.RLock()
+	exists, err := ExistsContext(ctx, ts.coldView(ctx), id)
+	ts.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return c.ErrDocumentDoestNotExist
+	}
+
+	return ts.commit(ctx, []Operation{{Type: OperationDelete, Id: id}})
+}
+
+func (ts *TieredStorage) DeleteFolder(folder string) error {
+	return ts.DeleteFolderContext(context.Background(), folder)
+}
+
+func (ts *TieredStorage) DeleteFolderContext(ctx context.Context, folder string) error {
+	return ts.CommitContext(ctx, []Operation{{Type: OperationDeleteFolder, Id: folder}})
+}
+
+func (ts *TieredStorage) Commit(operations []Operation) error {
+	return ts.CommitContext(context.Background(), operations)
+}
+
+func (ts *TieredStorage) CommitContext(ctx context.Context, operations []Operation) error {
+	ts.start()
+	ts.writeMutex.Lock()
+	defer ts.writeMutex.Unlock()
+
+	return ts.commit(ctx, operations)
+}
+
+// Flush writes the buffered writes to Cold, all at once. Meanwhile they're
+// read from the flushed overlay, and the new writes are buffered on top of
+// it.
+func (ts *TieredStorage) Flush() error {
+	ts.start()
+	ts.flushMutex.Lock()
+	defer ts.flushMutex.Unlock()
+
+	ts.mutex.Lock()
+	flushed := ts.pending
+	operations := flushed.Operations()
+	if len(operations) == 0 {
+		ts.mutex.Unlock()
+		return nil
+	}
+	ts.pending = NewOverlayStorage(flushed)
+	ts.mutex.Unlock()
+
+	flush_err := ts.Cold.Commit(operations)
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	pending := NewOverlayStorage(ts.Cold)
+	if flush_err != nil {
+		operations = append(operations, ts.pending.Operations()...)
+	} else {
+		operations = ts.pending.Operations()
+	}
+	err := pending.Commit(operations)
+	if err != nil {
+		return err
+	}
+	ts.pending = pending
+
+	return flush_err
+}
+
+// Close stops the periodic flushes and flushes the buffered writes.
+func (ts *TieredStorage) Close() error {
+	ts.start()
+	if ts.stop != nil {
+		close(ts.stop)
+		ts.stopped.Wait()
+		ts.stop = nil
+	}
+
+	return ts.Flush()
+}
+
+func (ts *TieredStorage) get(ctx context.Context, id string) (c.Document, error) {
+	ts.lruMutex.Lock()
+	_, found := ts.hotIds[id]
+	generation := ts.generation
+	ts.lruMutex.Unlock()
+
+	if found {
+		document, err := GetContext(ctx, ts.Hot, id)
+		if err == nil {
+			ts.lruMutex.Lock()
+			if element, found := ts.hotIds[id]; found {
+				ts.lru.MoveToFront(element)
+			}
+			ts.lruMutex.Unlock()
+			return document, nil
+		}
+		if !errors.Is(err, c.ErrDocumentDoestNotExist) {
+			return nil, err
+		}
+	}
+
+	ts.mutex.RLock()
+	document, err := GetContext(ctx, ts.coldView(ctx), id)
+	ts.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	ts.lruMutex.Lock()
+	defer ts.lruMutex.Unlock()
+
+	// a write after the read could have changed the document
+	if generation != ts.generation {
+		return document, nil
+	}
+	err = ts.cache(ctx, document)
+	if err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+// commit writes the operations to Cold, or buffers them, and to Hot. The
+// caller must hold the write lock.
+func (ts *TieredStorage) commit(ctx context.Context, operations []Operation) error {
+	for _, operation := range operations {
+		if operation.Type == OperationSet {
+			_, err := operation.Document.GetId()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var err error
+	if ts.WriteBack {
+		ts.mutex.Lock()
+		err = CommitContext(ctx, ts.pending, operations)
+		ts.mutex.Unlock()
+	} else {
+		err = CommitContext(ctx, ts.Cold, operations)
+	}
+	if err != nil {
+		return err
+	}
+
+	ts.lruMutex.Lock()
+	defer ts.lruMutex.Unlock()
+
+	ts.generation++
+	for _, operation := range operations {
+		switch operation.Type {
+		case OperationSet:
+			err = ts.cache(ctx, operation.Document)
+		case OperationDelete:
+			err = ts.evict(ctx, operation.Id)
+		case OperationDeleteFolder:
+			folder := strings.Trim(operation.Id, "/")
+			err = DeleteFolderContext(ctx, ts.Hot, folder)
+			for id := range ts.hotIds {
+				if folder == "" || strings.HasPrefix(id, folder+"/") {
+					ts.forget(id)
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cache stores the document in Hot, evicting the least recently used ones
+// when it's full. The caller must hold the LRU lock, as for evict and forget.
+func (ts *TieredStorage) cache(ctx context.Context, document c.Document) error {
+	document_id, err := document.GetId()
+	if err != nil {
+		return err
+	}
+
+	_, err = SetContext(ctx, ts.Hot, document)
+	if err != nil {
+		return err
+	}
+	if element, found := ts.hotIds[document_id]; found {
+		ts.lru.MoveToFront(element)
+	} else {
+		ts.hotIds[document_id] = ts.lru.PushFront(document_id)
+	}
+
+	for ts.MaxHotDocuments > 0 && ts.lru.Len() > ts.MaxHotDocuments {
+		err = ts.evict(ctx, ts.lru.Back().Value.(string))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ts *TieredStorage) evict(ctx context.Context, id string) error {
+	if _, found := ts.hotIds[id]; !found {
+		return nil
+	}
+	ts.forget(id)
+
+	err := DeleteContext(ctx, ts.Hot, id)
+	if errors.Is(err, c.ErrDocumentDoestNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+func (ts *TieredStorage) forget(id string) {
+	element, found := ts.hotIds[id]
+	if !found {
+		return
+	}
+
+	ts.lru.Remove(element)
+	delete(ts.hotIds, id)
+}
+
+// coldView is Cold as it will be once the buffered writes are flushed, to
+// be read with the context. The caller must hold the read lock.
+func (ts *TieredStorage) coldView(ctx context.Context) Storage {
+	if ts.WriteBack {
+		return ts.pending.reader(ctx)
+	}
+
+	return ts.Cold
+}
+
+func (ts *TieredStorage) start() {
+	ts.startOnce.Do(func() {
+		ts.lru = list.New()
+		ts.hotIds = map[string]*list.Element{}
+		ts.pending = NewOverlayStorage(ts.Cold)
+
+		if !ts.WriteBack || ts.FlushInterval <= 0 {
+			return
+		}
+
+		ts.stop = make(chan struct{})
+		ts.stopped.Add(1)
+		go func() {
+			defer ts.stopped.Done()
+
+			ticker := time.NewTicker(ts.FlushInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ts.stop:
+					return
+				case <-ticker.C:
+					ts.Flush()
+				}
+			}
+		}()
+	})
+}